@@ -36,9 +36,10 @@ func handle(addr string) {
 		buffer := make([]byte, 1024)
 		numBytes, err := c.Read(buffer)
 		if err != nil {
+			// e.g. a connect only health check
 			log.Error(err)
 			c.Close()
-			return
+			continue
 		}
 		log.Println(string(buffer[:numBytes]))
 
@@ -49,7 +50,7 @@ func handle(addr string) {
 		if err != nil {
 			log.Error(err)
 			c.Close()
-			return
+			continue
 		}
 		c.Close()
 	}
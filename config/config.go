@@ -11,22 +11,292 @@ import (
 type HealthCheckCfg struct {
 	HealthCheckInterval time.Duration
 	Timeout             time.Duration
+	// Jitter moves each interval randomly by up to this fraction of it either way,
+	// so that the checks of many upstreams do not line up.
+	Jitter float64
+	// MaxConcurrentProbes bounds the checks running at once. 0 runs all at once.
+	MaxConcurrentProbes int
+	// HistorySize is how many recent changes of health are kept per upstream, 20 if 0.
+	HistorySize int
+	// Check is how upstreams not listed in Checks are checked.
+	Check CheckCfg
+	// Checks overrides Check by upstream address, as in "127.0.0.1:8000".
+	Checks map[string]CheckCfg
+}
+
+// CheckCfg defines the active health check of an upstream.
+type CheckCfg struct {
+	// Type is "tcp" (the default), "http" or "grpc".
+	Type string
+	// Send is written to the upstream once connected. If Expect is set, the upstream
+	// must reply with data matching the regular expression. With neither, the check
+	// only connects. For http checks they are the request and response bodies.
+	Send   string
+	Expect string
+	// Method (GET by default) and Path ("/" by default) make the request of http checks,
+	// which pass if the response status is within StatusMin and StatusMax (200 and 399 by default).
+	Method    string
+	Path      string
+	StatusMin int
+	StatusMax int
+	// Service is the service grpc checks ask the gRPC health service about.
+	// If empty, they ask about the server as a whole.
+	Service string
+	// TLS makes http and grpc checks connect with TLS, trusting the CA in CaPath,
+	// or the system roots if CaPath is empty.
+	TLS    bool
+	CaPath string
+	// Timeout overrides HealthCheckCfg.Timeout.
+	Timeout time.Duration
+	// Rise is how many checks in a row must pass to mark an upstream healthy,
+	// Fall how many must fail to mark it unhealthy. Both default to 1.
+	Rise int
+	Fall int
 }
 
 type RateLimiterCfg struct {
 	CleanupInterval time.Duration
-	Burst           int
-	Token           int
+	// Algorithm is "token_bucket" (the default), "fixed_window" or "sliding_window_log".
+	Algorithm string
+	// RatePerSecond is the sustained number of connections a client may open per second.
+	RatePerSecond float64
+	// Burst is the most connections a token bucket allows at once.
+	Burst int
+	// Window is the period window algorithms count over. They allow
+	// RatePerSecond × Window connections per window. Defaults to a second.
+	Window time.Duration
+	// Tiers are named limits assigned to clients by Assignments. Clients without
+	// an assignment use DefaultTier, or the limit above if DefaultTier is empty.
+	Tiers       []RateLimitTierCfg
+	Assignments []TierAssignmentCfg
+	DefaultTier string
+	// Store shares counts between load balancer replicas. Shared counts use fixed
+	// windows of Window width, and fall back to the local algorithm when the store fails.
+	Store RateLimitStoreCfg
+}
+
+// RateLimitStoreCfg picks where replicas share rate limit counts.
+type RateLimitStoreCfg struct {
+	// Type is "" (local limits only), "redis" or "gossip".
+	Type string
+	// Addr, Password and Timeout reach a server speaking the Redis protocol.
+	Addr     string
+	Password string
+	Timeout  time.Duration
+	// Bind is the UDP address gossip listens on, Peers the replicas it sends its
+	// counts to every Interval. Gossip counts lag by up to Interval, so they are approximate.
+	// Counts are only taken from Peers. Key, if set, must be the same on every replica; it
+	// signs the counts so that no one else can send them.
+	Bind     string
+	Peers    []string
+	Interval time.Duration
+	Key      string
+	// RetryInterval is how long limits stay local after the store fails, before it is tried
+	// again. One second if zero.
+	RetryInterval time.Duration
+}
+
+type RateLimitTierCfg struct {
+	Name          string
+	RatePerSecond float64
+	Burst         int
+}
+
+// TierAssignmentCfg assigns clients whose certificate matches every non-empty field to Tier.
+// The first matching assignment wins.
+type TierAssignmentCfg struct {
+	Tier               string
+	CommonName         string // pattern as in path.Match, e.g. "batch-*"
+	Organization       string
+	OrganizationalUnit string
+}
+
+// BandwidthCfg limits throughput in bytes per second. Upload is client to upstream,
+// download is upstream to client. A zero value means unlimited.
+type BandwidthCfg struct {
+	ClientUpload     int
+	ClientDownload   int
+	UpstreamUpload   int
+	UpstreamDownload int
+}
+
+// MetricsCfg configures where metrics are served. Metrics are not served if Bind is empty.
+type MetricsCfg struct {
+	Bind string
+}
+
+// ConnLimitCfg caps simultaneous connections. A zero value means unlimited.
+// Per upstream limits are set with Upstream.MaxConns.
+type ConnLimitCfg struct {
+	MaxConns          int
+	MaxConnsPerClient int
+	// QueueTimeout is how long a client waits for a free upstream when all of them
+	// are at MaxConns. If zero, the client is rejected right away.
+	QueueTimeout time.Duration
 }
 
 type AuthzCfg struct {
 	Rules []string
 }
 
+// AdmissionCfg controls how refused clients are told about it.
+type AdmissionCfg struct {
+	// TLSAlert runs admission during the TLS handshake so that refused clients
+	// receive a TLS alert rather than a connection closed after the handshake.
+	TLSAlert bool
+	// DenialMessage sends clients refused after the TLS handshake one line
+	// "denied: <reason>" before their connection is closed.
+	DenialMessage bool
+}
+
+// BanCfg puts abusive clients in a penalty box. A client that collects Strikes rate limit
+// violations or failed TLS handshakes within StrikeWindow is banned, by common name and
+// by source IP, for BanDuration. Each new ban doubles, up to MaxBanDuration, until the
+// client has behaved for ForgetAfter. Bans are disabled if Strikes is zero.
+type BanCfg struct {
+	Strikes        int
+	StrikeWindow   time.Duration
+	BanDuration    time.Duration
+	MaxBanDuration time.Duration
+	ForgetAfter    time.Duration
+	// BanFile keeps bans across restarts. If empty, bans are only kept in memory.
+	BanFile string
+}
+
+// OutlierCfg ejects upstreams that fail live connections: dial failures, resets and
+// connections the upstream closes within MinConnDuration. An upstream with at least Failures
+// such failures within FailureWindow, making up at least FailureRatio of its connections there,
+// is ejected for EjectionDuration. Every ejection in a row doubles, up to MaxEjectionDuration
+// (uncapped if zero); an upstream that behaves for MaxEjectionDuration, or for as long as its last
+// ejection if uncapped, starts over. At most MaxEjectionPercent of the upstreams, and at least
+// one, are ejected at once. Disabled if Failures is zero.
+type OutlierCfg struct {
+	Failures            int
+	FailureRatio        float64
+	FailureWindow       time.Duration
+	MinConnDuration     time.Duration
+	EjectionDuration    time.Duration
+	MaxEjectionDuration time.Duration
+	MaxEjectionPercent  int
+}
+
+// BreakerCfg opens the circuit of an upstream after ConsecutiveFailures failed connections
+// in a row, so that no new connection goes to it for OpenDuration. Then the circuit is half
+// open: up to HalfOpenTrials connections at a time try the upstream, HalfOpenSuccesses
+// successes in a row close the circuit and a failure opens it again. Failures are counted
+// as in OutlierCfg. Disabled if ConsecutiveFailures is zero.
+type BreakerCfg struct {
+	ConsecutiveFailures int
+	OpenDuration        time.Duration
+	HalfOpenTrials      int
+	HalfOpenSuccesses   int
+}
+
+// BalancerCfg selects how upstreams are balanced: "least_connection" (the default) picks the
+// upstream with the fewest active connections, "peak_ewma" the one with the lowest average
+// latency times active connections. Latencies of dials and health checks are averaged over
+// about LatencyDecay.
+type BalancerCfg struct {
+	Balancer     string
+	LatencyDecay time.Duration
+}
+
+// SlowStartCfg ramps up the share of connections of an upstream that just became healthy,
+// over SlowStartWindow, from SlowStartMinWeight of its full share. The share grows with
+// (elapsed/SlowStartWindow)^(1/SlowStartAggression): linearly if SlowStartAggression is 1,
+// faster at first if greater. Disabled if SlowStartWindow is zero.
+type SlowStartCfg struct {
+	SlowStartWindow     time.Duration
+	SlowStartAggression float64
+	SlowStartMinWeight  float64
+}
+
+// FailoverCfg spills connections over from a priority tier of upstreams to the next
+// when less than MinHealthyPercent of its upstreams are healthy.
+type FailoverCfg struct {
+	MinHealthyPercent int
+}
+
+// ZoneCfg makes the load balancer prefer the upstreams in its own Zone, sending connections
+// to other zones only as the share of healthy upstreams in it drops below MinLocalHealthyPercent.
+// Disabled if Zone is empty.
+type ZoneCfg struct {
+	Zone                   string
+	MinLocalHealthyPercent int
+}
+
+// SplitCfg splits connections between groups of upstreams. CanaryPercent percent of
+// connections go to the upstreams in CanaryGroup, the same clients every time if CanarySticky,
+// and the others to the upstreams in ActiveGroup, or to every other group if it is empty.
+// Upstreams in no group take connections from either side.
+type SplitCfg struct {
+	ActiveGroup   string
+	CanaryGroup   string
+	CanaryPercent float64
+	CanarySticky  bool
+}
+
+// MirrorCfg copies what MirrorPercent percent of clients send to the shadow upstream at
+// MirrorAddr, discarding its replies. A connection stops being mirrored once the shadow
+// falls MirrorQueue reads behind, or fails. Disabled if MirrorAddr is empty.
+type MirrorCfg struct {
+	MirrorAddr    string
+	MirrorPercent float64
+	MirrorQueue   int
+}
+
+// DiscoveryCfg adds upstreams as sources list them and drains them once they do not, looking
+// them up every DiscoveryInterval. Discovered upstreams take at most DiscoveredMaxConns connections.
+type DiscoveryCfg struct {
+	DiscoveryInterval  time.Duration
+	DiscoveredMaxConns int
+	// DNSName is resolved for the A and AAAA records of upstreams listening on DNSPort, or for
+	// SRV records, e.g. "_lb._tcp.example.com", if DNSRecord is "SRV". Disabled if empty.
+	DNSName   string
+	DNSRecord string
+	DNSPort   string
+	// DNSServer is the host:port of the DNS server asked, the system's resolver if empty.
+	DNSServer string
+	// DiscoveryFile is a JSON file listing upstreams, e.g. [{"Host": "10.0.0.1", "Port": "8000"}],
+	// read again whenever it changes. Disabled if empty.
+	DiscoveryFile string
+	// DiscoveryURL is polled for a list of upstreams in the shape of the Consul catalog,
+	// e.g. "http://127.0.0.1:8500/v1/catalog/service/web". Disabled if empty.
+	DiscoveryURL string
+}
+
+// AdminCfg configures where the admin interface is served. It is not served if Bind is empty.
+type AdminCfg struct {
+	Bind string
+	// Token must be sent as "Authorization: Bearer <Token>" with every request.
+	// Without a Token, every request is refused.
+	Token string
+	// CaPath, if set, serves the admin interface over TLS with the server's certificate,
+	// only to clients with a certificate of this CA, which should not be the clients' CA.
+	// ClientNames, if not empty, also limits it to certificates with these common names.
+	CaPath      string
+	ClientNames []string
+}
+
 type ServerCfg struct {
 	HealthCheckCfg
 	RateLimiterCfg
+	BandwidthCfg
+	ConnLimitCfg
 	AuthzCfg
+	AdmissionCfg
+	BanCfg
+	OutlierCfg
+	BreakerCfg
+	BalancerCfg
+	SlowStartCfg
+	FailoverCfg
+	ZoneCfg
+	SplitCfg
+	MirrorCfg
+	DiscoveryCfg
+	MetricsCfg
+	AdminCfg
 	TlsCfg
 	Bind      string
 	Upstreams []*u.Upstream
@@ -44,12 +314,45 @@ func InitConfig() ServerCfg {
 	healthCheckCfg := HealthCheckCfg{
 		HealthCheckInterval: 3 * time.Second,
 		Timeout:             1 * time.Second,
+		Jitter:              0.1,
+		MaxConcurrentProbes: 16,
+		HistorySize:         20,
+		Check: CheckCfg{
+			Type:   "tcp",
+			Send:   "Health checker: Hello from Doctor\n",
+			Expect: "^Reply from upstream",
+			Rise:   2,
+			Fall:   3,
+		},
 	}
 
 	rateLimiterCfg := RateLimiterCfg{
 		CleanupInterval: 20 * time.Second,
-		Burst:           2,
-		Token:           4,
+		Algorithm:       "token_bucket",
+		RatePerSecond:   2,
+		Burst:           4,
+		Window:          time.Second,
+		Tiers: []RateLimitTierCfg{
+			{Name: "batch", RatePerSecond: 1, Burst: 2},
+			{Name: "admin", RatePerSecond: 10, Burst: 20},
+		},
+		Assignments: []TierAssignmentCfg{
+			{Tier: "batch", CommonName: "client.d"},
+			{Tier: "admin", OrganizationalUnit: "admin"},
+		},
+	}
+
+	bandwidthCfg := BandwidthCfg{
+		ClientUpload:     1 << 20,
+		ClientDownload:   4 << 20,
+		UpstreamUpload:   0,
+		UpstreamDownload: 0,
+	}
+
+	connLimitCfg := ConnLimitCfg{
+		MaxConns:          1000,
+		MaxConnsPerClient: 100,
+		QueueTimeout:      500 * time.Millisecond,
 	}
 
 	authzCfg := AuthzCfg{
@@ -73,6 +376,84 @@ func InitConfig() ServerCfg {
 			"client.e-allow-127.0.0.1:8002",
 		},
 	}
+	admissionCfg := AdmissionCfg{
+		TLSAlert:      false,
+		DenialMessage: false,
+	}
+
+	metricsCfg := MetricsCfg{
+		Bind: "127.0.0.1:9100",
+	}
+
+	outlierCfg := OutlierCfg{
+		Failures:            5,
+		FailureRatio:        0.5,
+		FailureWindow:       10 * time.Second,
+		MinConnDuration:     0,
+		EjectionDuration:    30 * time.Second,
+		MaxEjectionDuration: 5 * time.Minute,
+		MaxEjectionPercent:  50,
+	}
+
+	breakerCfg := BreakerCfg{
+		ConsecutiveFailures: 5,
+		OpenDuration:        10 * time.Second,
+		HalfOpenTrials:      2,
+		HalfOpenSuccesses:   3,
+	}
+
+	balancerCfg := BalancerCfg{
+		Balancer:     "least_connection",
+		LatencyDecay: 10 * time.Second,
+	}
+
+	slowStartCfg := SlowStartCfg{
+		SlowStartWindow:     30 * time.Second,
+		SlowStartAggression: 1,
+		SlowStartMinWeight:  0.1,
+	}
+
+	failoverCfg := FailoverCfg{
+		MinHealthyPercent: 70,
+	}
+
+	zoneCfg := ZoneCfg{
+		Zone:                   "zone-a",
+		MinLocalHealthyPercent: 100,
+	}
+
+	splitCfg := SplitCfg{
+		ActiveGroup:   "",
+		CanaryGroup:   "canary",
+		CanaryPercent: 5,
+		CanarySticky:  true,
+	}
+
+	mirrorCfg := MirrorCfg{
+		MirrorAddr:    "",
+		MirrorPercent: 100,
+		MirrorQueue:   64,
+	}
+
+	discoveryCfg := DiscoveryCfg{
+		DiscoveryInterval:  10 * time.Second,
+		DiscoveredMaxConns: 300,
+		DNSName:            "",
+		DNSRecord:          "A",
+		DNSPort:            "8000",
+		DNSServer:          "",
+		DiscoveryFile:      "",
+		DiscoveryURL:       "",
+	}
+
+	adminCfg := AdminCfg{
+		Bind:  "127.0.0.1:9101",
+		Token: os.Getenv("LB_ADMIN_TOKEN"),
+		// e.g. pwd + "/certs/admin-ca.crt"
+		CaPath:      "",
+		ClientNames: []string{},
+	}
+
 	pwd, _ := os.Getwd()
 	certPath := fmt.Sprintf(pwd + "/certs/server.crt")
 
@@ -85,10 +466,34 @@ func InitConfig() ServerCfg {
 		CaPath:   caPath,
 	}
 
+	banCfg := BanCfg{
+		Strikes:        10,
+		StrikeWindow:   10 * time.Second,
+		BanDuration:    time.Minute,
+		MaxBanDuration: time.Hour,
+		ForgetAfter:    24 * time.Hour,
+		BanFile:        pwd + "/bans.json",
+	}
+
 	serverCfg := ServerCfg{
 		HealthCheckCfg: healthCheckCfg,
 		RateLimiterCfg: rateLimiterCfg,
+		BandwidthCfg:   bandwidthCfg,
+		ConnLimitCfg:   connLimitCfg,
 		AuthzCfg:       authzCfg,
+		AdmissionCfg:   admissionCfg,
+		BanCfg:         banCfg,
+		OutlierCfg:     outlierCfg,
+		BreakerCfg:     breakerCfg,
+		BalancerCfg:    balancerCfg,
+		SlowStartCfg:   slowStartCfg,
+		FailoverCfg:    failoverCfg,
+		ZoneCfg:        zoneCfg,
+		SplitCfg:       splitCfg,
+		MirrorCfg:      mirrorCfg,
+		DiscoveryCfg:   discoveryCfg,
+		MetricsCfg:     metricsCfg,
+		AdminCfg:       adminCfg,
 		TlsCfg:         tlsCfg,
 		Bind:           ":1234",
 		Timeout:        1 * time.Second,
@@ -97,19 +502,25 @@ func InitConfig() ServerCfg {
 				Host:          "127.0.0.1",
 				Port:          "8000",
 				NumActiveConn: 0,
+				MaxConns:      300,
 				IsAlive:       true,
+				Zone:          "zone-a",
 			},
 			{
 				Host:          "127.0.0.1",
 				Port:          "8001",
 				NumActiveConn: 0,
+				MaxConns:      300,
 				IsAlive:       true,
+				Zone:          "zone-a",
 			},
 			{
 				Host:          "127.0.0.1",
 				Port:          "8002",
 				NumActiveConn: 0,
+				MaxConns:      300,
 				IsAlive:       true,
+				Zone:          "zone-b",
 			},
 		},
 	}
@@ -4,7 +4,11 @@ go 1.18
 
 require (
 	github.com/sirupsen/logrus v1.9.0
+	golang.org/x/net v0.33.0
 	golang.org/x/time v0.0.0-20220722155302-e5dcc9cfc0b9
 )
 
-require golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+require (
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
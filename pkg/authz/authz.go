@@ -3,7 +3,9 @@ package authz
 import (
 	"errors"
 	"layer4balancer/config"
+	u "layer4balancer/pkg/upstream"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -13,21 +15,28 @@ type AuthzRule struct {
 	IsAllowed    bool
 	CommonName   string
 	UpstreamAddr string // ip:port
+	// Conditions must all be met for the rule to apply.
+	Conditions []Condition
 }
 
 type AuthzScheme struct {
 	Rules []AuthzRule
+	// Now is the clock used when a ConnContext carries no time. Defaults to time.Now.
+	Now func() time.Time
 }
 
+// New parses rules of the form "commonName - allow|deny - ip:port [condition ...]".
+// See parseConditions for the supported conditions.
 func New(cfg config.AuthzCfg) (AuthzScheme, error) {
 
 	authzScheme := AuthzScheme{
 		Rules: make([]AuthzRule, 0),
+		Now:   time.Now,
 	}
 
 	for _, rule := range cfg.Rules {
 		// parse rules
-		parts := strings.Split(rule, "-")
+		parts := strings.SplitN(rule, "-", 3)
 		if len(parts) != 3 {
 			log.Error("Bad authz rule format", rule)
 			return AuthzScheme{}, errors.New("Bad authz rule format: " + rule)
@@ -35,17 +44,29 @@ func New(cfg config.AuthzCfg) (AuthzScheme, error) {
 
 		commonName := strings.TrimSpace(parts[0])
 		isAllowed := strings.TrimSpace(parts[1])
-		upstreamAddr := strings.TrimSpace(parts[2])
+		target := strings.Fields(parts[2])
+		if len(target) == 0 {
+			log.Error("Bad authz rule format", rule)
+			return AuthzScheme{}, errors.New("Bad authz rule format: " + rule)
+		}
+		upstreamAddr := target[0]
 
 		if isAllowed != "allow" && isAllowed != "deny" {
 			log.Error("Unsupported isAllow value: ", isAllowed)
 			return AuthzScheme{}, errors.New("Unsupported isAllow value: " + isAllowed)
 		}
 
+		conditions, err := parseConditions(target[1:])
+		if err != nil {
+			log.Error("Bad authz rule conditions ", rule, err)
+			return AuthzScheme{}, err
+		}
+
 		rule := AuthzRule{
 			IsAllowed:    isAllowed == "allow",
 			CommonName:   commonName,
 			UpstreamAddr: upstreamAddr,
+			Conditions:   conditions,
 		}
 
 		authzScheme.Rules = append(authzScheme.Rules, rule)
@@ -53,12 +74,52 @@ func New(cfg config.AuthzCfg) (AuthzScheme, error) {
 	return authzScheme, nil
 }
 
+// Allows checks access for a client known only by its common name.
+// Rules conditioned on the source address or TLS state never apply.
 func (a *AuthzScheme) Allows(commonName string, upstreamAddr string) bool {
+	return a.AllowsConn(&ConnContext{CommonName: commonName}, upstreamAddr)
+}
+
+// AllowsConn checks whether the client connection may reach upstreamAddr.
+// The first rule that matches and whose conditions are met decides.
+func (a *AuthzScheme) AllowsConn(ctx *ConnContext, upstreamAddr string) bool {
+	if ctx.Time.IsZero() {
+		c := *ctx
+		c.Time = a.now()
+		ctx = &c
+	}
 	for _, r := range a.Rules {
-		if strings.Compare(r.CommonName, commonName) == 0 && strings.Compare(r.UpstreamAddr, upstreamAddr) == 0 {
+		if strings.Compare(r.CommonName, ctx.CommonName) == 0 && strings.Compare(r.UpstreamAddr, upstreamAddr) == 0 && r.conditionsMet(ctx) {
 			return r.IsAllowed
 		}
 	}
 	// if no matches found, by default, allow access
 	return true
 }
+
+func (r *AuthzRule) conditionsMet(ctx *ConnContext) bool {
+	for _, c := range r.Conditions {
+		if !c.Matches(ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *AuthzScheme) now() time.Time {
+	if a.Now == nil {
+		return time.Now()
+	}
+	return a.Now()
+}
+
+// Filter returns the upstreams the client connection may reach.
+func (a *AuthzScheme) Filter(ctx *ConnContext, upstreams []*u.Upstream) []*u.Upstream {
+	allowed := make([]*u.Upstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		if a.AllowsConn(ctx, upstream.Host+":"+upstream.Port) {
+			allowed = append(allowed, upstream)
+		}
+	}
+	return allowed
+}
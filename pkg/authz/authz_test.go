@@ -1,8 +1,11 @@
 package authz
 
 import (
+	"crypto/tls"
 	"layer4balancer/config"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestAuthZ(t *testing.T) {
@@ -73,3 +76,213 @@ func TestAuthZ(t *testing.T) {
 		}
 	}
 }
+
+func TestConditions(t *testing.T) {
+
+	// Wednesday 2022-08-03 10:30 UTC
+	wednesday := time.Date(2022, 8, 3, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		description string
+		rules       config.AuthzCfg
+		now         time.Time
+		conn        ConnContext
+		want        bool
+	}{
+		{
+			description: "source address inside allowed range",
+			rules: config.AuthzCfg{
+				Rules: []string{
+					"client c - allow - 127.0.0.1:8002 src=10.0.0.0/8",
+					"client c - deny - 127.0.0.1:8002",
+				},
+			},
+			now:  wednesday,
+			conn: ConnContext{CommonName: "client c", SourceAddr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5000}},
+			want: true,
+		},
+		{
+			description: "source address outside allowed range falls through to deny",
+			rules: config.AuthzCfg{
+				Rules: []string{
+					"client c - allow - 127.0.0.1:8002 src=10.0.0.0/8",
+					"client c - deny - 127.0.0.1:8002",
+				},
+			},
+			now:  wednesday,
+			conn: ConnContext{CommonName: "client c", SourceAddr: &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 5000}},
+			want: false,
+		},
+		{
+			description: "unknown source address never matches a source condition",
+			rules: config.AuthzCfg{
+				Rules: []string{
+					"client c - allow - 127.0.0.1:8002 src=10.0.0.0/8",
+					"client c - deny - 127.0.0.1:8002",
+				},
+			},
+			now:  wednesday,
+			conn: ConnContext{CommonName: "client c"},
+			want: false,
+		},
+		{
+			description: "TLS version below minimum",
+			rules: config.AuthzCfg{
+				Rules: []string{
+					"client a - deny - 127.0.0.1:8002 tls=1.3",
+					"client a - allow - 127.0.0.1:8002",
+				},
+			},
+			now:  wednesday,
+			conn: ConnContext{CommonName: "client a", TLS: &tls.ConnectionState{Version: tls.VersionTLS12}},
+			want: true,
+		},
+		{
+			description: "TLS version meets minimum",
+			rules: config.AuthzCfg{
+				Rules: []string{
+					"client a - deny - 127.0.0.1:8002 tls=1.3",
+				},
+			},
+			now:  wednesday,
+			conn: ConnContext{CommonName: "client a", TLS: &tls.ConnectionState{Version: tls.VersionTLS13}},
+			want: false,
+		},
+		{
+			description: "inside business hours",
+			rules: config.AuthzCfg{
+				Rules: []string{
+					"client b - allow - 127.0.0.1:8000 days=mon-fri hours=09:00-17:00",
+					"client b - deny - 127.0.0.1:8000",
+				},
+			},
+			now:  wednesday,
+			conn: ConnContext{CommonName: "client b"},
+			want: true,
+		},
+		{
+			description: "outside business hours",
+			rules: config.AuthzCfg{
+				Rules: []string{
+					"client b - allow - 127.0.0.1:8000 days=mon-fri hours=09:00-17:00",
+					"client b - deny - 127.0.0.1:8000",
+				},
+			},
+			now:  wednesday.Add(8 * time.Hour),
+			conn: ConnContext{CommonName: "client b"},
+			want: false,
+		},
+		{
+			description: "business hours on weekend",
+			rules: config.AuthzCfg{
+				Rules: []string{
+					"client b - allow - 127.0.0.1:8000 days=mon-fri hours=09:00-17:00",
+					"client b - deny - 127.0.0.1:8000",
+				},
+			},
+			now:  wednesday.AddDate(0, 0, 3),
+			conn: ConnContext{CommonName: "client b"},
+			want: false,
+		},
+		{
+			description: "overnight window wraps past midnight",
+			rules: config.AuthzCfg{
+				Rules: []string{
+					"client b - deny - 127.0.0.1:8000 hours=22:00-06:00",
+				},
+			},
+			now:  wednesday.Add(15 * time.Hour),
+			conn: ConnContext{CommonName: "client b"},
+			want: false,
+		},
+		{
+			description: "overnight window after midnight belongs to the day it started",
+			rules: config.AuthzCfg{
+				Rules: []string{
+					"client b - allow - 127.0.0.1:8000 days=fri hours=22:00-06:00",
+					"client b - deny - 127.0.0.1:8000",
+				},
+			},
+			now:  time.Date(2022, 8, 6, 2, 0, 0, 0, time.UTC),
+			conn: ConnContext{CommonName: "client b"},
+			want: true,
+		},
+		{
+			description: "overnight window is closed after midnight of a day it did not start",
+			rules: config.AuthzCfg{
+				Rules: []string{
+					"client b - allow - 127.0.0.1:8000 days=fri hours=22:00-06:00",
+					"client b - deny - 127.0.0.1:8000",
+				},
+			},
+			now:  time.Date(2022, 8, 5, 2, 0, 0, 0, time.UTC),
+			conn: ConnContext{CommonName: "client b"},
+			want: false,
+		},
+		{
+			description: "window ending at midnight",
+			rules: config.AuthzCfg{
+				Rules: []string{
+					"client b - allow - 127.0.0.1:8000 hours=18:00-24:00",
+					"client b - deny - 127.0.0.1:8000",
+				},
+			},
+			now:  wednesday.Add(13 * time.Hour),
+			conn: ConnContext{CommonName: "client b"},
+			want: true,
+		},
+		{
+			description: "inside maintenance window",
+			rules: config.AuthzCfg{
+				Rules: []string{
+					"client d - deny - 127.0.0.1:8001 window=2022-08-03T10:00:00Z/2022-08-03T11:00:00Z",
+				},
+			},
+			now:  wednesday,
+			conn: ConnContext{CommonName: "client d"},
+			want: false,
+		},
+		{
+			description: "after maintenance window",
+			rules: config.AuthzCfg{
+				Rules: []string{
+					"client d - deny - 127.0.0.1:8001 window=2022-08-03T10:00:00Z/2022-08-03T11:00:00Z",
+				},
+			},
+			now:  wednesday.Add(time.Hour),
+			conn: ConnContext{CommonName: "client d"},
+			want: true,
+		},
+	}
+
+	for _, tc := range tests {
+		a, err := New(tc.rules)
+		if err != nil {
+			t.Errorf("%s, %v", tc.description, err)
+			continue
+		}
+		now := tc.now
+		a.Now = func() time.Time { return now }
+		if got := a.AllowsConn(&tc.conn, a.Rules[0].UpstreamAddr); got != tc.want {
+			t.Errorf("%s, %v != %v", tc.description, got, tc.want)
+		}
+	}
+}
+
+func TestBadConditions(t *testing.T) {
+	rules := []string{
+		"client a - allow - 127.0.0.1:8000 src=10.0.0.0",
+		"client a - allow - 127.0.0.1:8000 tls=2.0",
+		"client a - allow - 127.0.0.1:8000 days=someday",
+		"client a - allow - 127.0.0.1:8000 hours=9-17",
+		"client a - allow - 127.0.0.1:8000 hours=24:00-06:00",
+		"client a - allow - 127.0.0.1:8000 window=2022-08-03T10:00:00Z",
+		"client a - allow - 127.0.0.1:8000 color=blue",
+		"client a - allow - 127.0.0.1:8000 src",
+	}
+	for _, rule := range rules {
+		if _, err := New(config.AuthzCfg{Rules: []string{rule}}); err == nil {
+			t.Errorf("%s, expected an error", rule)
+		}
+	}
+}
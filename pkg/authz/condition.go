@@ -0,0 +1,235 @@
+package authz
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ConnContext describes the client connection an authorization decision is made for.
+type ConnContext struct {
+	// Time of the decision. If zero, the scheme's clock is used.
+	Time       time.Time
+	SourceAddr net.Addr
+	TLS        *tls.ConnectionState
+	CommonName string
+}
+
+// Condition restricts when an AuthzRule applies.
+// A rule whose conditions are not all met is skipped.
+type Condition interface {
+	Matches(ctx *ConnContext) bool
+}
+
+// SourceCIDR matches connections originating from one of the networks.
+type SourceCIDR struct {
+	Nets []*net.IPNet
+}
+
+func (c SourceCIDR) Matches(ctx *ConnContext) bool {
+	ip := sourceIP(ctx.SourceAddr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.Nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// MinTLSVersion matches connections negotiated with at least the given TLS version.
+type MinTLSVersion uint16
+
+func (c MinTLSVersion) Matches(ctx *ConnContext) bool {
+	return ctx.TLS != nil && ctx.TLS.Version >= uint16(c)
+}
+
+// TimeWindow matches between two instants, e.g. a maintenance window.
+type TimeWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+func (c TimeWindow) Matches(ctx *ConnContext) bool {
+	return !ctx.Time.Before(c.Start) && ctx.Time.Before(c.End)
+}
+
+// DailyWindow matches a recurring period of the day on selected weekdays, e.g. business hours.
+// Start and End are offsets from midnight. If End is before Start the window wraps past midnight,
+// and the hours after midnight belong to the day the window started on.
+type DailyWindow struct {
+	Days  [7]bool // indexed by time.Weekday
+	Start time.Duration
+	End   time.Duration
+}
+
+func (c DailyWindow) Matches(ctx *ConnContext) bool {
+	t := ctx.Time
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if c.Start <= c.End {
+		return c.Days[t.Weekday()] && offset >= c.Start && offset < c.End
+	}
+	if offset >= c.Start {
+		return c.Days[t.Weekday()]
+	}
+	return offset < c.End && c.Days[(t.Weekday()+6)%7]
+}
+
+func sourceIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return net.ParseIP(addr.String())
+		}
+		return net.ParseIP(host)
+	}
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseConditions parses the key=value options that may follow the upstream address of a rule:
+//
+//	src=10.0.0.0/8,192.168.0.0/16                     source address ranges
+//	tls=1.3                                           minimum TLS version
+//	window=2022-08-01T00:00:00Z/2022-08-01T04:00:00Z  absolute time window (RFC 3339)
+//	days=mon-fri hours=09:00-17:00                    recurring daily window
+func parseConditions(options []string) ([]Condition, error) {
+	conditions := make([]Condition, 0)
+	var daily *DailyWindow
+
+	for _, option := range options {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, errors.New("Bad authz condition format: " + option)
+		}
+		key, value := kv[0], kv[1]
+
+		switch key {
+		case "src":
+			c := SourceCIDR{}
+			for _, cidr := range strings.Split(value, ",") {
+				_, n, err := net.ParseCIDR(cidr)
+				if err != nil {
+					return nil, fmt.Errorf("bad source range %q: %w", cidr, err)
+				}
+				c.Nets = append(c.Nets, n)
+			}
+			conditions = append(conditions, c)
+
+		case "tls":
+			version, found := tlsVersions[value]
+			if !found {
+				return nil, errors.New("Unsupported TLS version: " + value)
+			}
+			conditions = append(conditions, MinTLSVersion(version))
+
+		case "window":
+			bounds := strings.Split(value, "/")
+			if len(bounds) != 2 {
+				return nil, errors.New("Bad time window format: " + value)
+			}
+			start, err := time.Parse(time.RFC3339, bounds[0])
+			if err != nil {
+				return nil, err
+			}
+			end, err := time.Parse(time.RFC3339, bounds[1])
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, TimeWindow{Start: start, End: end})
+
+		case "days", "hours":
+			if daily == nil {
+				daily = &DailyWindow{Days: [7]bool{true, true, true, true, true, true, true}, End: 24 * time.Hour}
+			}
+			var err error
+			if key == "days" {
+				daily.Days, err = parseDays(value)
+			} else {
+				daily.Start, daily.End, err = parseHours(value)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+		default:
+			return nil, errors.New("Unsupported authz condition: " + key)
+		}
+	}
+
+	if daily != nil {
+		conditions = append(conditions, *daily)
+	}
+	return conditions, nil
+}
+
+// parseDays parses a comma separated list of weekdays or weekday ranges, e.g. "mon-fri,sun".
+func parseDays(value string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(value, ",") {
+		bounds := strings.Split(part, "-")
+		first, found := weekdays[bounds[0]]
+		if !found || len(bounds) > 2 {
+			return days, errors.New("Bad days format: " + value)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, found = weekdays[bounds[1]]; !found {
+				return days, errors.New("Bad days format: " + value)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseHours parses a "15:04-15:04" range into offsets from midnight. The end may be "24:00".
+func parseHours(value string) (time.Duration, time.Duration, error) {
+	bounds := strings.Split(value, "-")
+	if len(bounds) != 2 {
+		return 0, 0, errors.New("Bad hours format: " + value)
+	}
+	var offsets [2]time.Duration
+	for i, b := range bounds {
+		if i == 1 && b == "24:00" {
+			offsets[i] = 24 * time.Hour
+			continue
+		}
+		t, err := time.Parse("15:04", b)
+		if err != nil {
+			return 0, 0, err
+		}
+		offsets[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return offsets[0], offsets[1], nil
+}
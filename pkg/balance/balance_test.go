@@ -1,9 +1,15 @@
 package balance
 
 import (
+	"layer4balancer/config"
 	a "layer4balancer/pkg/authz"
+	"layer4balancer/pkg/breaker"
+	"layer4balancer/pkg/latency"
 	u "layer4balancer/pkg/upstream"
+	"math"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestBalancer(t *testing.T) {
@@ -102,13 +108,53 @@ func TestBalancer(t *testing.T) {
 			},
 			want: 1,
 		},
+		{
+			description: "upstreams at max connections are skipped",
+			upstreams: []*u.Upstream{
+				{
+					Host:          "127.0.0.0",
+					Port:          "8000",
+					NumActiveConn: 10,
+					IsAlive:       true,
+				},
+				{
+					Host:          "127.0.0.1",
+					Port:          "8000",
+					NumActiveConn: 5,
+					MaxConns:      5,
+					IsAlive:       true,
+				},
+			},
+			clientId: "ClientA",
+			authz: a.AuthzScheme{
+				Rules: []a.AuthzRule{},
+			},
+			want: 0,
+		},
+		{
+			description: "all upstreams at max connections",
+			upstreams: []*u.Upstream{
+				{
+					Host:          "127.0.0.0",
+					Port:          "8000",
+					NumActiveConn: 10,
+					MaxConns:      10,
+					IsAlive:       true,
+				},
+			},
+			clientId: "ClientA",
+			authz: a.AuthzScheme{
+				Rules: []a.AuthzRule{},
+			},
+			want: -1,
+		},
 	}
 
 	for _, tc := range tests {
-		lb := LeastConnectionBalancer{
-			authz: tc.authz,
-		}
-		got, _ := lb.Select(tc.clientId, tc.upstreams)
+		lb := LeastConnectionBalancer{}
+		// upstreams are filtered by authz before being balanced
+		allowed := tc.authz.Filter(&a.ConnContext{CommonName: tc.clientId}, tc.upstreams)
+		got, _ := lb.Select(tc.clientId, allowed)
 		if tc.want == -1 {
 			if got != nil {
 				t.Errorf("%s, %v", tc.description, got)
@@ -120,3 +166,365 @@ func TestBalancer(t *testing.T) {
 		}
 	}
 }
+
+func TestNoCapacity(t *testing.T) {
+	lb := New()
+	upstreams := []*u.Upstream{
+		{Host: "127.0.0.0", Port: "8000", NumActiveConn: 1, MaxConns: 1, IsAlive: true},
+		{Host: "127.0.0.1", Port: "8000", IsAlive: false},
+	}
+	if _, err := lb.Select("ClientA", upstreams); err != ErrNoCapacity {
+		t.Errorf("%v != %v", err, ErrNoCapacity)
+	}
+	upstreams[0].IsAlive = false
+	if _, err := lb.Select("ClientA", upstreams); err == nil || err == ErrNoCapacity {
+		t.Errorf("expected no upstreams available, got %v", err)
+	}
+}
+
+func TestBreakerBalancer(t *testing.T) {
+	breakers := breaker.New(config.BreakerCfg{ConsecutiveFailures: 1, OpenDuration: time.Hour}, nil)
+	lb := WithBreakers(New(), breakers)
+	upstreams := []*u.Upstream{
+		{Host: "127.0.0.1", Port: "8000", IsAlive: true},
+		{Host: "127.0.0.1", Port: "8001", NumActiveConn: 5, IsAlive: true},
+	}
+
+	got, err := lb.Select("ClientA", upstreams)
+	if err != nil || got != upstreams[0] {
+		t.Fatalf("%v, %v != %v", err, got, upstreams[0])
+	}
+	// the least loaded upstream fails, so its circuit opens
+	breakers.Get("127.0.0.1:8000").Done(false)
+	if got, err := lb.Select("ClientA", upstreams); err != nil || got != upstreams[1] {
+		t.Errorf("%v, %v != %v", err, got, upstreams[1])
+	}
+	breakers.Get("127.0.0.1:8001").Done(false)
+	if _, err := lb.Select("ClientA", upstreams); err != ErrCircuitOpen {
+		t.Errorf("%v != %v", err, ErrCircuitOpen)
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	now := time.Unix(0, 0)
+	slowStart := NewSlowStartWithClock(config.SlowStartCfg{
+		SlowStartWindow:     10 * time.Second,
+		SlowStartAggression: 1,
+		SlowStartMinWeight:  0.1,
+	}, func() time.Time { return now })
+
+	tests := []struct {
+		description string
+		elapsed     time.Duration
+		aggression  float64
+		want        float64
+	}{
+		{description: "ramp begins at the min weight", elapsed: 0, aggression: 1, want: 0.1},
+		{description: "linear halfway", elapsed: 5 * time.Second, aggression: 1, want: 0.5},
+		{description: "aggressive halfway", elapsed: 5 * time.Second, aggression: 2, want: math.Sqrt(0.5)},
+		{description: "ramp ends", elapsed: 10 * time.Second, aggression: 1, want: 1},
+	}
+	for _, tc := range tests {
+		slowStart.cfg.SlowStartAggression = tc.aggression
+		now = time.Unix(0, 0)
+		slowStart.Begin("127.0.0.1:8000")
+		now = now.Add(tc.elapsed)
+		if got := slowStart.Weight("127.0.0.1:8000"); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("%s, %v != %v", tc.description, got, tc.want)
+		}
+	}
+	if got := slowStart.Weight("127.0.0.1:8001"); got != 1 {
+		t.Errorf("%v != %v", got, 1)
+	}
+
+	// a recovered upstream takes a growing share of new connections
+	slowStart.cfg.SlowStartAggression = 1
+	lb := WithSlowStart(New(), slowStart)
+	upstreams := []*u.Upstream{
+		{Host: "127.0.0.1", Port: "8000", IsAlive: true},
+		{Host: "127.0.0.1", Port: "8001", NumActiveConn: 4, IsAlive: true},
+	}
+	now = time.Unix(0, 0)
+	slowStart.Begin("127.0.0.1:8000")
+	for _, step := range []struct {
+		elapsed time.Duration
+		want    *u.Upstream
+	}{
+		// (0+1)/0.1 = 10 > (4+1)/1
+		{elapsed: 0, want: upstreams[1]},
+		// (0+1)/0.5 = 2 < (4+1)/1
+		{elapsed: 5 * time.Second, want: upstreams[0]},
+	} {
+		now = time.Unix(0, 0).Add(step.elapsed)
+		if got, err := lb.Select("ClientA", upstreams); err != nil || got != step.want {
+			t.Errorf("after %v, %v, %v != %v", step.elapsed, err, got, step.want)
+		}
+	}
+
+	// peak EWMA still avoids a slow upstream while another ramps
+	latencies := latency.New(time.Second)
+	latencies.Observe("127.0.0.1:8000", 10*time.Millisecond)
+	latencies.Observe("127.0.0.1:8001", 10*time.Millisecond)
+	latencies.Observe("127.0.0.1:8002", 100*time.Millisecond)
+	ewma := WithSlowStart(NewPeakEWMA(latencies), slowStart)
+	slow := []*u.Upstream{
+		{Host: "127.0.0.1", Port: "8000", IsAlive: true},
+		{Host: "127.0.0.1", Port: "8001", NumActiveConn: 2, IsAlive: true},
+		{Host: "127.0.0.1", Port: "8002", IsAlive: true},
+	}
+	now = time.Unix(0, 0)
+	slowStart.Begin("127.0.0.1:8000")
+	for _, step := range []struct {
+		elapsed time.Duration
+		want    *u.Upstream
+	}{
+		// 10×(0+1)/0.1 = 100, 10×(2+1) = 30, 100×(0+1) = 100
+		{elapsed: 0, want: slow[1]},
+		// 10×(0+1)/0.5 = 20
+		{elapsed: 5 * time.Second, want: slow[0]},
+	} {
+		now = time.Unix(0, 0).Add(step.elapsed)
+		if got, err := ewma.Select("ClientA", slow); err != nil || got != step.want {
+			t.Errorf("peak EWMA after %v, %v, %v != %v", step.elapsed, err, got, step.want)
+		}
+	}
+
+	upstreams[0].IsAlive = false
+	upstreams[1].IsAlive = false
+	if _, err := lb.Select("ClientA", upstreams); err == nil {
+		t.Errorf("selected a dead upstream")
+	}
+}
+
+func TestPriorities(t *testing.T) {
+	tests := []struct {
+		description string
+		alive       []bool
+		// whether the primaries are at their max connections
+		primariesFull bool
+		want          int
+		wantErr       bool
+	}{
+		{description: "primaries healthy", alive: []bool{true, true, true, true}, want: 0},
+		{description: "enough primaries healthy", alive: []bool{false, true, true, true}, want: 1},
+		{description: "too few primaries healthy", alive: []bool{false, false, true, true}, want: 2},
+		{description: "spill over to the last tier", alive: []bool{false, false, false, true}, want: 3},
+		{description: "primaries recovered", alive: []bool{true, false, true, true}, want: 0},
+		{description: "primaries full", alive: []bool{true, true, true, true}, primariesFull: true, want: 2},
+		{description: "all down", alive: []bool{false, false, false, false}, wantErr: true},
+	}
+	// the upstreams the least connection balancer would pick come last in priority
+	upstreams := []*u.Upstream{
+		{Host: "127.0.0.1", Port: "8000", NumActiveConn: 5, MaxConns: 10},
+		{Host: "127.0.0.1", Port: "8001", NumActiveConn: 6, MaxConns: 10},
+		{Host: "127.0.0.1", Port: "8002", NumActiveConn: 1, Priority: 1},
+		{Host: "127.0.0.1", Port: "8003", NumActiveConn: 0, Priority: 2},
+	}
+	lb := WithPriorities(New(), 50, nil)
+	for _, tc := range tests {
+		for i := range upstreams {
+			upstreams[i].IsAlive = tc.alive[i]
+		}
+		upstreams[0].NumActiveConn, upstreams[1].NumActiveConn = 5, 6
+		if tc.primariesFull {
+			upstreams[0].NumActiveConn, upstreams[1].NumActiveConn = 10, 10
+		}
+		got, err := lb.Select("ClientA", upstreams)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s, selected %v", tc.description, got)
+			}
+			continue
+		}
+		if err != nil || got != upstreams[tc.want] {
+			t.Errorf("%s, %v, %v != %v", tc.description, err, got, upstreams[tc.want])
+		}
+	}
+}
+
+func TestZones(t *testing.T) {
+	tests := []struct {
+		description string
+		alive       []bool
+		// what the balancer draws to choose between zones
+		random  float64
+		want    int
+		wantErr bool
+	}{
+		{description: "local zone healthy", alive: []bool{true, true, true}, random: 0.99, want: 0},
+		{description: "half the local zone healthy, drawn local", alive: []bool{false, true, true}, random: 0.49, want: 1},
+		{description: "half the local zone healthy, drawn remote", alive: []bool{false, true, true}, random: 0.5, want: 2},
+		{description: "local zone down", alive: []bool{false, false, true}, random: 0, want: 2},
+		{description: "remote zone down, drawn remote", alive: []bool{false, true, false}, random: 0.9, want: 1},
+		{description: "all down", alive: []bool{false, false, false}, random: 0, wantErr: true},
+	}
+	// the remote upstream is the least loaded
+	upstreams := []*u.Upstream{
+		{Host: "127.0.0.1", Port: "8000", NumActiveConn: 5, Zone: "zone-a"},
+		{Host: "127.0.0.1", Port: "8001", NumActiveConn: 6, Zone: "zone-a"},
+		{Host: "127.0.0.1", Port: "8002", NumActiveConn: 0, Zone: "zone-b"},
+	}
+	lb := WithZones(New(), "zone-a", 100, nil)
+	for _, tc := range tests {
+		for i := range upstreams {
+			upstreams[i].IsAlive = tc.alive[i]
+		}
+		lb.(*ZoneBalancer).random = func() float64 { return tc.random }
+		got, err := lb.Select("ClientA", upstreams)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s, selected %v", tc.description, got)
+			}
+			continue
+		}
+		if err != nil || got != upstreams[tc.want] {
+			t.Errorf("%s, %v, %v != %v", tc.description, err, got, upstreams[tc.want])
+		}
+	}
+
+	// without a zone the balancer alone decides
+	for i := range upstreams {
+		upstreams[i].IsAlive = true
+	}
+	if got, err := WithZones(New(), "", 100, nil).Select("ClientA", upstreams); err != nil || got != upstreams[2] {
+		t.Errorf("%v, %v != %v", err, got, upstreams[2])
+	}
+}
+
+func TestPeakEWMA(t *testing.T) {
+	latencies := latency.New(time.Second)
+	latencies.Observe("127.0.0.1:8000", 10*time.Millisecond)
+	latencies.Observe("127.0.0.1:8001", 50*time.Millisecond)
+	latencies.Observe("127.0.0.1:8002", 100*time.Millisecond)
+	lb := NewPeakEWMA(latencies)
+
+	tests := []struct {
+		description string
+		activeConns []int64
+		want        int
+	}{
+		// costs are latency × (active connections + 1)
+		{description: "fast upstream", activeConns: []int64{0, 0, 0}, want: 0},
+		{description: "busy fast upstream", activeConns: []int64{5, 0, 0}, want: 1},
+		{description: "busy upstreams", activeConns: []int64{5, 2, 0}, want: 0},
+	}
+	upstreams := []*u.Upstream{
+		{Host: "127.0.0.1", Port: "8000", IsAlive: true},
+		{Host: "127.0.0.1", Port: "8001", IsAlive: true},
+		{Host: "127.0.0.1", Port: "8002", IsAlive: true},
+	}
+	for _, tc := range tests {
+		for i := range upstreams {
+			upstreams[i].NumActiveConn = tc.activeConns[i]
+		}
+		if got, err := lb.Select("ClientA", upstreams); err != nil || got != upstreams[tc.want] {
+			t.Errorf("%s, %v, %v != %v", tc.description, err, got, upstreams[tc.want])
+		}
+	}
+
+	// upstreams whose latency is unknown are tried first
+	unknown := &u.Upstream{Host: "127.0.0.1", Port: "8003", NumActiveConn: 3, IsAlive: true}
+	if got, err := lb.Select("ClientA", append(upstreams, unknown)); err != nil || got != unknown {
+		t.Errorf("%v, %v != %v", err, got, unknown)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	upstreams := []*u.Upstream{
+		{Host: "127.0.0.1", Port: "8000", IsAlive: true, Group: "blue"},
+		{Host: "127.0.0.1", Port: "8001", IsAlive: true, Group: "green", NumActiveConn: 1},
+		{Host: "127.0.0.1", Port: "8002", IsAlive: true, Group: "canary", NumActiveConn: 2},
+	}
+	tests := []struct {
+		description string
+		split       config.SplitCfg
+		// what the balancer draws for unpinned canaries
+		random float64
+		want   int
+	}{
+		{description: "no split", split: config.SplitCfg{}, want: 0},
+		{description: "blue active", split: config.SplitCfg{ActiveGroup: "blue", CanaryGroup: "canary"}, want: 0},
+		{description: "green active", split: config.SplitCfg{ActiveGroup: "green", CanaryGroup: "canary"}, want: 1},
+		{
+			description: "drawn canary",
+			split:       config.SplitCfg{ActiveGroup: "green", CanaryGroup: "canary", CanaryPercent: 5},
+			random:      0.049,
+			want:        2,
+		},
+		{
+			description: "drawn stable",
+			split:       config.SplitCfg{ActiveGroup: "green", CanaryGroup: "canary", CanaryPercent: 5},
+			random:      0.05,
+			want:        1,
+		},
+		{
+			description: "all canary",
+			split:       config.SplitCfg{ActiveGroup: "green", CanaryGroup: "canary", CanaryPercent: 100, CanarySticky: true},
+			want:        2,
+		},
+	}
+	lb := WithSplit(New(), config.SplitCfg{})
+	for _, tc := range tests {
+		lb.Set(tc.split)
+		lb.random = func() float64 { return tc.random }
+		if got, err := lb.Select("client.a", upstreams); err != nil || got != upstreams[tc.want] {
+			t.Errorf("%s, %v, %v != %v", tc.description, err, got, upstreams[tc.want])
+		}
+	}
+
+	// a dead canary group leaves the connection to the active group
+	upstreams[2].IsAlive = false
+	if got, err := lb.Select("client.a", upstreams); err != nil || got != upstreams[1] {
+		t.Errorf("%v, %v != %v", err, got, upstreams[1])
+	}
+	upstreams[2].IsAlive = true
+
+	// sticky canaries are the same clients every time, about CanaryPercent of them
+	lb.Set(config.SplitCfg{CanaryGroup: "canary", CanaryPercent: 20, CanarySticky: true})
+	canaries := 0
+	for i := 0; i < 1000; i++ {
+		clientId := "client." + strconv.Itoa(i)
+		first, _ := lb.Select(clientId, upstreams)
+		for j := 0; j < 3; j++ {
+			if again, _ := lb.Select(clientId, upstreams); again != first {
+				t.Fatalf("%s moved from %v to %v", clientId, first, again)
+			}
+		}
+		if first == upstreams[2] {
+			canaries++
+		}
+	}
+	if canaries < 150 || canaries > 250 {
+		t.Errorf("%v canary clients out of 1000", canaries)
+	}
+}
+
+func TestDraining(t *testing.T) {
+	slowStart := NewSlowStart(config.SlowStartCfg{SlowStartWindow: time.Hour, SlowStartAggression: 1, SlowStartMinWeight: 0.1})
+	slowStart.Begin("127.0.0.1:8001")
+
+	tests := []struct {
+		description string
+		lb          LoadBalancer
+	}{
+		{description: "least connection", lb: New()},
+		{description: "peak EWMA", lb: NewPeakEWMA(latency.New(time.Second))},
+		{description: "slow start", lb: WithSlowStart(New(), slowStart)},
+		{description: "priorities", lb: WithPriorities(New(), 100, nil)},
+		{description: "zones", lb: WithZones(New(), "zone-a", 100, nil)},
+	}
+	for _, tc := range tests {
+		// the idle upstream of the primary tier, in the local zone, is draining
+		upstreams := []*u.Upstream{
+			{Host: "127.0.0.1", Port: "8000", IsAlive: true, IsDraining: true, Zone: "zone-a"},
+			{Host: "127.0.0.1", Port: "8001", NumActiveConn: 5, IsAlive: true, Priority: 1, Zone: "zone-b"},
+		}
+		if got, err := tc.lb.Select("ClientA", upstreams); err != nil || got != upstreams[1] {
+			t.Errorf("%s, %v, %v != %v", tc.description, err, got, upstreams[1])
+		}
+		upstreams[1].SetDraining(true)
+		if got, err := tc.lb.Select("ClientA", upstreams); err == nil {
+			t.Errorf("%s, draining upstream %v selected", tc.description, got)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package balance
+
+import (
+	"errors"
+	"layer4balancer/pkg/breaker"
+	u "layer4balancer/pkg/upstream"
+)
+
+// ErrCircuitOpen is returned when the circuits of all upstreams are open.
+var ErrCircuitOpen = errors.New("circuits of all upstreams are open")
+
+// BreakerBalancer skips upstreams whose circuit is open and takes a trial slot
+// of the upstream it selects when its circuit is half open.
+type BreakerBalancer struct {
+	balancer LoadBalancer
+	breakers *breaker.Set
+}
+
+// WithBreakers wraps balancer so that it respects the circuits of upstreams.
+func WithBreakers(balancer LoadBalancer, breakers *breaker.Set) LoadBalancer {
+	return &BreakerBalancer{
+		balancer: balancer,
+		breakers: breakers,
+	}
+}
+
+// Select picks among the upstreams whose circuit lets a connection through.
+// The caller must report how the connection went with Done on the upstream's breaker,
+// or give its trial slot back with Release if it does not make the connection.
+func (b *BreakerBalancer) Select(clientId string, upstreams []*u.Upstream) (*u.Upstream, error) {
+	allowed := make([]*u.Upstream, 0, len(upstreams))
+	for _, up := range upstreams {
+		if b.breakers.Get(up.Host + ":" + up.Port).Allow() {
+			allowed = append(allowed, up)
+		}
+	}
+	for len(allowed) > 0 {
+		upstream, err := b.balancer.Select(clientId, allowed)
+		if err != nil {
+			return nil, err
+		}
+		if b.breakers.Get(upstream.Host + ":" + upstream.Port).Acquire() {
+			return upstream, nil
+		}
+		// the trial slots were taken since Allow
+		for i := range allowed {
+			if allowed[i] == upstream {
+				allowed = append(allowed[:i], allowed[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil, ErrCircuitOpen
+}
@@ -2,52 +2,97 @@ package balance
 
 import (
 	"errors"
-	a "layer4balancer/pkg/authz"
 	u "layer4balancer/pkg/upstream"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// ErrNoCapacity is returned when alive upstreams exist but all of them are at MaxConns.
+var ErrNoCapacity = errors.New("all upstreams are at max connections")
+
 type LoadBalancer interface {
 	Select(clientId string, upstreams []*u.Upstream) (*u.Upstream, error)
 }
 
-type LeastConnectionBalancer struct {
-	authz a.AuthzScheme
+// WeightedBalancer is a LoadBalancer that can also weigh upstreams, so that an upstream
+// of weight 0.5 counts as twice as loaded as it is. weights[i] is the weight of upstreams[i].
+type WeightedBalancer interface {
+	LoadBalancer
+	SelectWeighted(clientId string, upstreams []*u.Upstream, weights []float64) (*u.Upstream, error)
 }
 
-func New(authz a.AuthzScheme) LoadBalancer {
-	return &LeastConnectionBalancer{
-		authz: authz,
+// weight returns weights[i], or 1 without weights.
+func weight(weights []float64, i int) float64 {
+	if weights == nil {
+		return 1
 	}
+	return weights[i]
+}
+
+type LeastConnectionBalancer struct {
 }
 
-// Select upstream server using Least connection strategy
+func New() LoadBalancer {
+	return &LeastConnectionBalancer{}
+}
+
+// Select upstream server using Least connection strategy.
+// upstreams must already be filtered down to the ones the client is authorized to reach.
 func (s *LeastConnectionBalancer) Select(clientId string, upstreams []*u.Upstream) (*u.Upstream, error) {
+	return s.SelectWeighted(clientId, upstreams, nil)
+}
+
+// SelectWeighted picks the upstream with the fewest active connections for its weight.
+func (s *LeastConnectionBalancer) SelectWeighted(clientId string, upstreams []*u.Upstream, weights []float64) (*u.Upstream, error) {
+	return selectLeast(clientId, upstreams, weights, nil)
+}
+
+// inRotation is the default of the healthy filters of balancers.
+func inRotation(up *u.Upstream) bool {
+	return up.InRotation()
+}
+
+// selectLeast picks, among the upstreams in rotation and below MaxConns, the one of the lowest cost,
+// and of the fewest active connections for its weight among equal costs. Without cost, that load is the cost.
+func selectLeast(clientId string, upstreams []*u.Upstream, weights []float64, cost func(up *u.Upstream, load float64) float64) (*u.Upstream, error) {
 
 	if len(upstreams) == 0 {
 		log.Error("zero upstreams")
 		return nil, errors.New("zero upstreams")
 	}
 
-	var leastConnectionUpstream *u.Upstream
+	var selected *u.Upstream
+	var least, leastLoad float64
+	atCapacity := false
 
-	for idx := range upstreams {
-		upstreamAddr := upstreams[idx].Host + ":" + upstreams[idx].Port
-		// check authz rules
-		if upstreams[idx].IsAlive == false || s.authz.Allows(clientId, upstreamAddr) == false {
+	for i, up := range upstreams {
+		if !up.InRotation() {
+			continue
+		}
+		if up.AtCapacity() {
+			atCapacity = true
 			continue
 		}
 
-		if leastConnectionUpstream == nil || upstreams[idx].NumActiveConn < leastConnectionUpstream.NumActiveConn {
-			leastConnectionUpstream = upstreams[idx]
+		// counting the new connection, so that idle upstreams are ordered by weight and cost too
+		load := float64(up.ActiveConns()+1) / weight(weights, i)
+		c := load
+		if cost != nil {
+			c = cost(up, load)
+		}
+		if selected == nil || c < least || c == least && load < leastLoad {
+			selected, least, leastLoad = up, c, load
 		}
 	}
 
-	if leastConnectionUpstream == nil {
+	if selected == nil && atCapacity {
+		return nil, ErrNoCapacity
+	}
+
+	if selected == nil {
 		log.Error("No upstreams available for ", clientId)
 		return nil, errors.New("No upstreams available")
 	}
 
-	return leastConnectionUpstream, nil
+	return selected, nil
 }
@@ -0,0 +1,30 @@
+package balance
+
+import (
+	"layer4balancer/pkg/latency"
+	u "layer4balancer/pkg/upstream"
+)
+
+// PeakEWMABalancer picks the upstream with the lowest average latency times
+// active connections, so that slow upstreams take fewer connections.
+type PeakEWMABalancer struct {
+	latencies *latency.Tracker
+}
+
+func NewPeakEWMA(latencies *latency.Tracker) LoadBalancer {
+	return &PeakEWMABalancer{latencies: latencies}
+}
+
+// Select upstream server by the cost of its latency and load. Upstreams without any
+// latency observed yet cost nothing, so that they are tried first.
+func (b *PeakEWMABalancer) Select(clientId string, upstreams []*u.Upstream) (*u.Upstream, error) {
+	return b.SelectWeighted(clientId, upstreams, nil)
+}
+
+// SelectWeighted is like Select but divides the cost of each upstream by its weight.
+func (b *PeakEWMABalancer) SelectWeighted(clientId string, upstreams []*u.Upstream, weights []float64) (*u.Upstream, error) {
+	return selectLeast(clientId, upstreams, weights, func(up *u.Upstream, load float64) float64 {
+		avg, _ := b.latencies.Get(up.Host + ":" + up.Port)
+		return float64(avg) * load
+	})
+}
@@ -0,0 +1,74 @@
+package balance
+
+import (
+	u "layer4balancer/pkg/upstream"
+	"sort"
+)
+
+// PriorityBalancer sends connections to the upstreams of the lowest priority tier while
+// enough of them are healthy, spilling over to the next tiers when they are not.
+type PriorityBalancer struct {
+	balancer          LoadBalancer
+	minHealthyPercent int
+	healthy           func(*u.Upstream) bool
+}
+
+// WithPriorities wraps balancer so that a tier of upstreams takes connections only while the
+// tiers of lower priority have less than minHealthyPercent of their upstreams healthy, or
+// cannot take them. Upstreams are healthy if healthy says so, or if in rotation when it is nil.
+func WithPriorities(balancer LoadBalancer, minHealthyPercent int, healthy func(*u.Upstream) bool) LoadBalancer {
+	if healthy == nil {
+		healthy = inRotation
+	}
+	return &PriorityBalancer{
+		balancer:          balancer,
+		minHealthyPercent: minHealthyPercent,
+		healthy:           healthy,
+	}
+}
+
+// Select picks among the healthy upstreams of the tiers in use. It retries with the next
+// tier whenever those cannot take the connection, and returns the last error if none can.
+func (b *PriorityBalancer) Select(clientId string, upstreams []*u.Upstream) (*u.Upstream, error) {
+	tiers := byPriority(upstreams)
+	candidates := make([]*u.Upstream, 0, len(upstreams))
+	var err error
+	for i, tier := range tiers {
+		numHealthy := 0
+		for _, up := range tier {
+			if b.healthy(up) {
+				candidates = append(candidates, up)
+				numHealthy++
+			}
+		}
+		last := i == len(tiers)-1
+		if !last && (numHealthy == 0 || numHealthy*100 < b.minHealthyPercent*len(tier)) {
+			// spill over to the next tier
+			continue
+		}
+		var upstream *u.Upstream
+		if upstream, err = b.balancer.Select(clientId, candidates); err == nil {
+			return upstream, nil
+		}
+	}
+	if len(tiers) == 0 {
+		return b.balancer.Select(clientId, upstreams)
+	}
+	return nil, err
+}
+
+// byPriority groups upstreams by priority, the lowest first.
+func byPriority(upstreams []*u.Upstream) [][]*u.Upstream {
+	sorted := append([]*u.Upstream(nil), upstreams...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+	var tiers [][]*u.Upstream
+	for i, up := range sorted {
+		if i == 0 || up.Priority != sorted[i-1].Priority {
+			tiers = append(tiers, nil)
+		}
+		tiers[len(tiers)-1] = append(tiers[len(tiers)-1], up)
+	}
+	return tiers
+}
@@ -0,0 +1,116 @@
+package balance
+
+import (
+	"layer4balancer/config"
+	u "layer4balancer/pkg/upstream"
+	"math"
+	"sync"
+	"time"
+)
+
+// SlowStart tracks the upstreams ramping up after becoming healthy.
+type SlowStart struct {
+	cfg config.SlowStartCfg
+	// since is when each ramping upstream became healthy, by address
+	since map[string]time.Time
+	now   func() time.Time
+	mu    sync.Mutex
+}
+
+func NewSlowStart(cfg config.SlowStartCfg) *SlowStart {
+	return NewSlowStartWithClock(cfg, time.Now)
+}
+
+// NewSlowStartWithClock is like NewSlowStart but reads the time from now.
+func NewSlowStartWithClock(cfg config.SlowStartCfg, now func() time.Time) *SlowStart {
+	if cfg.SlowStartAggression <= 0 {
+		cfg.SlowStartAggression = 1
+	}
+	if cfg.SlowStartMinWeight <= 0 || cfg.SlowStartMinWeight > 1 {
+		cfg.SlowStartMinWeight = 0.1
+	}
+	return &SlowStart{
+		cfg:   cfg,
+		since: make(map[string]time.Time),
+		now:   now,
+	}
+}
+
+// Begin starts the ramp of the upstream at addr, e.g. when it becomes healthy.
+func (s *SlowStart) Begin(addr string) {
+	if s.cfg.SlowStartWindow <= 0 {
+		return
+	}
+	s.mu.Lock()
+	s.since[addr] = s.now()
+	s.mu.Unlock()
+}
+
+// Weight returns the share of its connections the upstream at addr takes now,
+// from SlowStartMinWeight when its ramp begins to 1 when it ends.
+func (s *SlowStart) Weight(addr string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.weight(addr, s.now())
+}
+
+func (s *SlowStart) weight(addr string, now time.Time) float64 {
+	since, found := s.since[addr]
+	if !found {
+		return 1
+	}
+	elapsed := now.Sub(since)
+	if elapsed >= s.cfg.SlowStartWindow {
+		delete(s.since, addr)
+		return 1
+	}
+	ramp := math.Pow(float64(elapsed)/float64(s.cfg.SlowStartWindow), 1/s.cfg.SlowStartAggression)
+	return math.Max(s.cfg.SlowStartMinWeight, ramp)
+}
+
+// weights returns the weights of upstreams, or nil if none of them is ramping.
+func (s *SlowStart) weights(upstreams []*u.Upstream) []float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.since) == 0 {
+		return nil
+	}
+	now := s.now()
+	weights := make([]float64, len(upstreams))
+	ramping := false
+	for i, up := range upstreams {
+		weights[i] = s.weight(up.Host+":"+up.Port, now)
+		ramping = ramping || weights[i] < 1
+	}
+	if !ramping {
+		return nil
+	}
+	return weights
+}
+
+// SlowStartBalancer passes the weights of ramping upstreams to a WeightedBalancer, so that
+// it weighs them into its own choice. Around other balancers, it picks the upstream with the
+// fewest active connections for its weight while upstreams are ramping up.
+type SlowStartBalancer struct {
+	balancer  LoadBalancer
+	slowStart *SlowStart
+}
+
+// WithSlowStart wraps balancer so that ramping upstreams take a growing share of connections.
+func WithSlowStart(balancer LoadBalancer, slowStart *SlowStart) LoadBalancer {
+	return &SlowStartBalancer{
+		balancer:  balancer,
+		slowStart: slowStart,
+	}
+}
+
+func (b *SlowStartBalancer) Select(clientId string, upstreams []*u.Upstream) (*u.Upstream, error) {
+	weights := b.slowStart.weights(upstreams)
+	if weights == nil {
+		return b.balancer.Select(clientId, upstreams)
+	}
+	if weighted, ok := b.balancer.(WeightedBalancer); ok {
+		return weighted.SelectWeighted(clientId, upstreams, weights)
+	}
+	return selectLeast(clientId, upstreams, weights, nil)
+}
@@ -0,0 +1,77 @@
+package balance
+
+import (
+	"hash/fnv"
+	"layer4balancer/config"
+	u "layer4balancer/pkg/upstream"
+	"math/rand"
+	"sync"
+)
+
+// SplitBalancer splits connections between groups of upstreams: a share of them goes to
+// the canary group, the rest to the active group. Upstreams in no group take either.
+type SplitBalancer struct {
+	balancer LoadBalancer
+	cfg      config.SplitCfg
+	random   func() float64
+	mu       sync.Mutex
+}
+
+// WithSplit wraps balancer so that connections are split between groups of upstreams as cfg says.
+func WithSplit(balancer LoadBalancer, cfg config.SplitCfg) *SplitBalancer {
+	return &SplitBalancer{
+		balancer: balancer,
+		cfg:      cfg,
+		random:   rand.Float64,
+	}
+}
+
+// Set changes the split at once, e.g. to switch from the blue group to the green one.
+func (b *SplitBalancer) Set(cfg config.SplitCfg) {
+	b.mu.Lock()
+	b.cfg = cfg
+	b.mu.Unlock()
+}
+
+// Get returns the split in use.
+func (b *SplitBalancer) Get() config.SplitCfg {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cfg
+}
+
+// Select picks from the canary group for its share of connections, falling back to the
+// rest if no canary can take the connection, and from the active group otherwise.
+func (b *SplitBalancer) Select(clientId string, upstreams []*u.Upstream) (*u.Upstream, error) {
+	cfg := b.Get()
+	if cfg.ActiveGroup == "" && cfg.CanaryGroup == "" {
+		return b.balancer.Select(clientId, upstreams)
+	}
+
+	var canaries, stable []*u.Upstream
+	for _, up := range upstreams {
+		switch {
+		case cfg.CanaryGroup != "" && up.Group == cfg.CanaryGroup:
+			canaries = append(canaries, up)
+		case up.Group == "" || cfg.ActiveGroup == "" || up.Group == cfg.ActiveGroup:
+			stable = append(stable, up)
+		}
+	}
+	if len(canaries) > 0 && b.toCanary(cfg, clientId) {
+		if upstream, err := b.balancer.Select(clientId, canaries); err == nil {
+			return upstream, nil
+		}
+	}
+	return b.balancer.Select(clientId, stable)
+}
+
+// toCanary reports whether a connection of the client goes to the canary group. Sticky
+// splits hash the client, so that the same clients always go to the canaries.
+func (b *SplitBalancer) toCanary(cfg config.SplitCfg, clientId string) bool {
+	if !cfg.CanarySticky {
+		return b.random()*100 < cfg.CanaryPercent
+	}
+	h := fnv.New32a()
+	h.Write([]byte(clientId))
+	return float64(h.Sum32()%10000) < cfg.CanaryPercent*100
+}
@@ -0,0 +1,80 @@
+package balance
+
+import (
+	u "layer4balancer/pkg/upstream"
+	"math/rand"
+)
+
+// ZoneBalancer keeps connections within the zone of the load balancer while it has enough
+// healthy upstreams there, and sends a share of them to other zones when it does not.
+type ZoneBalancer struct {
+	balancer               LoadBalancer
+	zone                   string
+	minLocalHealthyPercent int
+	healthy                func(*u.Upstream) bool
+	random                 func() float64
+}
+
+// WithZones wraps balancer so that it prefers the upstreams in zone. While fewer than
+// minLocalHealthyPercent of those are healthy, connections go to other zones in proportion
+// to the shortfall: none while the zone is healthy enough, all once it has no healthy upstream.
+// Upstreams are healthy if healthy says so, or if in rotation when it is nil.
+// If zone is empty, the choice is left to balancer.
+func WithZones(balancer LoadBalancer, zone string, minLocalHealthyPercent int, healthy func(*u.Upstream) bool) LoadBalancer {
+	if healthy == nil {
+		healthy = inRotation
+	}
+	return &ZoneBalancer{
+		balancer:               balancer,
+		zone:                   zone,
+		minLocalHealthyPercent: minLocalHealthyPercent,
+		healthy:                healthy,
+		random:                 rand.Float64,
+	}
+}
+
+// Select picks within the zone or across zones, and tries the other side if the first cannot take the connection.
+func (b *ZoneBalancer) Select(clientId string, upstreams []*u.Upstream) (*u.Upstream, error) {
+	if b.zone == "" {
+		return b.balancer.Select(clientId, upstreams)
+	}
+	var local, remote []*u.Upstream
+	numHealthy := 0
+	for _, up := range upstreams {
+		if up.Zone != b.zone {
+			remote = append(remote, up)
+			continue
+		}
+		local = append(local, up)
+		if b.healthy(up) {
+			numHealthy++
+		}
+	}
+	if len(local) == 0 || len(remote) == 0 {
+		return b.balancer.Select(clientId, upstreams)
+	}
+
+	first, second := local, remote
+	if b.random() >= b.localShare(numHealthy, len(local)) {
+		first, second = remote, local
+	}
+	upstream, err := b.balancer.Select(clientId, first)
+	if err == nil {
+		return upstream, nil
+	}
+	upstream, secondErr := b.balancer.Select(clientId, second)
+	if secondErr != nil && err == ErrNoCapacity {
+		// waiting for room is better than failing
+		return nil, err
+	}
+	return upstream, secondErr
+}
+
+// localShare returns the share of connections kept within the zone when numHealthy of its total upstreams are healthy.
+func (b *ZoneBalancer) localShare(numHealthy, total int) float64 {
+	wanted := float64(b.minLocalHealthyPercent) * float64(total) / 100
+	if float64(numHealthy) >= wanted {
+		return 1
+	}
+	return float64(numHealthy) / wanted
+}
@@ -0,0 +1,263 @@
+// ban package keeps a penalty box of clients that misbehaved too often
+package ban
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"layer4balancer/config"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CommonName returns the key tracking a client by its certificate common name.
+func CommonName(cn string) string {
+	return "cn:" + cn
+}
+
+// SourceIP returns the key tracking a client by the IP address it connects from.
+func SourceIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return "ip:" + host
+}
+
+// Ban is a client in the penalty box.
+type Ban struct {
+	Key string
+	// Until is when the ban ends.
+	Until time.Time
+	// Level counts the bans in a row; the Level-th ban lasts BanDuration × 2^(Level-1).
+	Level int
+}
+
+type offender struct {
+	strikes []time.Time
+	until   time.Time
+	level   int
+}
+
+// PenaltyBox bans clients that collect too many strikes in a short time.
+type PenaltyBox struct {
+	cfg       config.BanCfg
+	offenders map[string]*offender
+	now       func() time.Time
+	stop      chan bool
+	mu        sync.Mutex
+}
+
+// cleanupInterval is how often offenders that no longer matter are forgotten.
+const cleanupInterval = time.Minute
+
+func New(cfg config.BanCfg) (*PenaltyBox, error) {
+	return NewWithClock(cfg, time.Now)
+}
+
+// NewWithClock is like New but reads the time from now. Bans saved in cfg.BanFile are restored.
+func NewWithClock(cfg config.BanCfg, now func() time.Time) (*PenaltyBox, error) {
+	b := &PenaltyBox{
+		cfg:       cfg,
+		offenders: make(map[string]*offender),
+		now:       now,
+		stop:      make(chan bool),
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *PenaltyBox) Start() {
+	ticker := time.NewTicker(cleanupInterval)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				b.Cleanup()
+			case <-b.stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (b *PenaltyBox) Stop() {
+	b.stop <- true
+}
+
+// Enabled reports whether clients are ever banned.
+func (b *PenaltyBox) Enabled() bool {
+	return b.cfg.Strikes > 0
+}
+
+// Strike records misbehaviour of the client known by key, banning it once it has had
+// too many strikes. It reports whether the client is banned now.
+func (b *PenaltyBox) Strike(key string) bool {
+	if !b.Enabled() {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	o, found := b.offenders[key]
+	if !found {
+		o = &offender{}
+		b.offenders[key] = o
+	}
+	if now.Before(o.until) {
+		return true
+	}
+	start := now.Add(-b.cfg.StrikeWindow)
+	i := 0
+	for i < len(o.strikes) && !o.strikes[i].After(start) {
+		i++
+	}
+	o.strikes = append(o.strikes[i:], now)
+	if len(o.strikes) < b.cfg.Strikes {
+		return false
+	}
+
+	if !o.until.IsZero() && now.Sub(o.until) > b.cfg.ForgetAfter {
+		o.level = 0
+	}
+	o.level++
+	o.until = now.Add(b.duration(o.level))
+	o.strikes = nil
+	log.WithFields(log.Fields{
+		"client": key,
+		"until":  o.until,
+		"level":  o.level,
+	}).Warn("client banned")
+	b.save()
+	return true
+}
+
+// duration returns how long the level-th ban in a row lasts.
+func (b *PenaltyBox) duration(level int) time.Duration {
+	d := b.cfg.BanDuration
+	for i := 1; i < level && (b.cfg.MaxBanDuration <= 0 || d < b.cfg.MaxBanDuration); i++ {
+		d *= 2
+	}
+	if b.cfg.MaxBanDuration > 0 && d > b.cfg.MaxBanDuration {
+		return b.cfg.MaxBanDuration
+	}
+	return d
+}
+
+// Banned reports whether the client known by key is banned.
+func (b *PenaltyBox) Banned(key string) bool {
+	if !b.Enabled() {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, found := b.offenders[key]
+	return found && b.now().Before(o.until)
+}
+
+// List returns the clients banned now, ordered by key.
+func (b *PenaltyBox) List() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	bans := []Ban{}
+	for key, o := range b.offenders {
+		if now.Before(o.until) {
+			bans = append(bans, Ban{Key: key, Until: o.until, Level: o.level})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Key < bans[j].Key
+	})
+	return bans
+}
+
+// Clear lifts the ban of the client known by key and forgets its past bans.
+// It reports whether the client was banned.
+func (b *PenaltyBox) Clear(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, found := b.offenders[key]
+	if !found {
+		return false
+	}
+	delete(b.offenders, key)
+	b.save()
+	return b.now().Before(o.until)
+}
+
+// ClearAll lifts every ban.
+func (b *PenaltyBox) ClearAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.offenders = make(map[string]*offender)
+	b.save()
+}
+
+// Cleanup forgets clients without a ban that still counts towards escalation.
+func (b *PenaltyBox) Cleanup() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	for key, o := range b.offenders {
+		if now.Sub(o.until) > b.cfg.ForgetAfter && (len(o.strikes) == 0 || now.Sub(o.strikes[len(o.strikes)-1]) > b.cfg.StrikeWindow) {
+			delete(b.offenders, key)
+		}
+	}
+}
+
+// save writes the bans to the ban file, replacing it atomically. Strikes are not saved.
+func (b *PenaltyBox) save() {
+	if b.cfg.BanFile == "" {
+		return
+	}
+	var bans []Ban
+	for key, o := range b.offenders {
+		if o.level > 0 {
+			bans = append(bans, Ban{Key: key, Until: o.until, Level: o.level})
+		}
+	}
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		log.Error("failed to encode bans ", err)
+		return
+	}
+	tmp := b.cfg.BanFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		log.Error("failed to save bans ", err)
+		return
+	}
+	if err := os.Rename(tmp, b.cfg.BanFile); err != nil {
+		log.Error("failed to save bans ", err)
+	}
+}
+
+func (b *PenaltyBox) load() error {
+	if b.cfg.BanFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(b.cfg.BanFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return err
+	}
+	for _, ban := range bans {
+		b.offenders[ban.Key] = &offender{until: ban.Until, level: ban.Level}
+	}
+	return nil
+}
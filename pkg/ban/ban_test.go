@@ -0,0 +1,123 @@
+package ban
+
+import (
+	"layer4balancer/config"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestPenaltyBox(t *testing.T) {
+	cfg := config.BanCfg{
+		Strikes:        2,
+		StrikeWindow:   10 * time.Second,
+		BanDuration:    time.Minute,
+		MaxBanDuration: 3 * time.Minute,
+		ForgetAfter:    time.Hour,
+	}
+	clock := &fakeClock{now: time.Date(2022, 8, 3, 10, 0, 0, 0, time.UTC)}
+	b, err := NewWithClock(cfg, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := CommonName("client.a")
+
+	tests := []struct {
+		description string
+		advance     time.Duration
+		strike      bool
+		want        bool
+	}{
+		{"first strike", 0, true, false},
+		{"strikes outside the window do not add up", 11 * time.Second, true, false},
+		{"second strike bans", time.Second, true, true},
+		{"banned for a minute", 59 * time.Second, false, true},
+		{"ban over", time.Second, false, false},
+		{"second ban", 0, true, false},
+		{"second ban", 0, true, true},
+		{"second ban lasts two minutes", 119 * time.Second, false, true},
+		{"second ban over", time.Second, false, false},
+		{"third ban", 0, true, false},
+		{"third ban", 0, true, true},
+		{"third ban is capped at three minutes", 3 * time.Minute, false, false},
+		{"escalation forgotten", 2 * time.Hour, true, false},
+		{"escalation forgotten", 0, true, true},
+		{"back to a minute", time.Minute, false, false},
+	}
+	for _, tc := range tests {
+		clock.Advance(tc.advance)
+		if tc.strike {
+			b.Strike(key)
+		}
+		if got := b.Banned(key); got != tc.want {
+			t.Errorf("%s, %v != %v", tc.description, got, tc.want)
+		}
+	}
+	if b.Banned(CommonName("client.b")) {
+		t.Errorf("other clients are banned")
+	}
+
+	disabled, _ := NewWithClock(config.BanCfg{}, clock.Now)
+	if disabled.Strike(key) || disabled.Strike(key) {
+		t.Errorf("banned with bans disabled")
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	cfg := config.BanCfg{
+		Strikes:     1,
+		BanDuration: time.Minute,
+		ForgetAfter: time.Hour,
+		BanFile:     filepath.Join(t.TempDir(), "bans.json"),
+	}
+	clock := &fakeClock{now: time.Date(2022, 8, 3, 10, 0, 0, 0, time.UTC)}
+	b, err := NewWithClock(cfg, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := SourceIP(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4321})
+	if ip != "ip:10.0.0.1" {
+		t.Errorf("%q != %q", ip, "ip:10.0.0.1")
+	}
+	b.Strike(ip)
+	b.Strike(CommonName("client.a"))
+
+	restarted, err := NewWithClock(cfg, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bans := restarted.List()
+	if len(bans) != 2 || bans[0].Key != "cn:client.a" || bans[1].Key != ip {
+		t.Fatalf("bans not restored: %v", bans)
+	}
+
+	if !restarted.Clear(ip) {
+		t.Errorf("ban of %s not cleared", ip)
+	}
+	if restarted.Clear(ip) {
+		t.Errorf("ban of %s cleared twice", ip)
+	}
+	restarted, _ = NewWithClock(cfg, clock.Now)
+	if restarted.Banned(ip) || !restarted.Banned(CommonName("client.a")) {
+		t.Errorf("cleared ban not saved: %v", restarted.List())
+	}
+
+	restarted.ClearAll()
+	restarted, _ = NewWithClock(cfg, clock.Now)
+	if len(restarted.List()) != 0 {
+		t.Errorf("%v not cleared", restarted.List())
+	}
+}
@@ -0,0 +1,222 @@
+// breaker package stops sending connections to failing upstreams for a while, then tries them again carefully
+package breaker
+
+import (
+	"layer4balancer/config"
+	"sync"
+	"time"
+)
+
+// State is the state of the circuit of an upstream.
+type State int
+
+const (
+	// Closed circuits let connections through.
+	Closed State = iota
+	// Open circuits let no connection through.
+	Open
+	// HalfOpen circuits let a few trial connections through.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	}
+	return "unknown"
+}
+
+// Transition is a change of the state of the circuit of an upstream.
+type Transition struct {
+	Upstream string
+	From     State
+	To       State
+	Time     time.Time
+}
+
+// Breaker is the circuit of one upstream.
+type Breaker struct {
+	addr  string
+	set   *Set
+	state State
+	// failures in a row while closed, successes in a row while half open
+	failures  int
+	successes int
+	openedAt  time.Time
+	// trial connections in flight while half open
+	trials int
+}
+
+// Set keeps the circuits of upstreams by address.
+type Set struct {
+	cfg      config.BreakerCfg
+	breakers map[string]*Breaker
+	now      func() time.Time
+	// onTransition is called, without locks held, on every change of state
+	onTransition func(Transition)
+	mu           sync.Mutex
+}
+
+func New(cfg config.BreakerCfg, onTransition func(Transition)) *Set {
+	return NewWithClock(cfg, onTransition, time.Now)
+}
+
+// NewWithClock is like New but reads the time from now.
+func NewWithClock(cfg config.BreakerCfg, onTransition func(Transition), now func() time.Time) *Set {
+	if cfg.HalfOpenTrials < 1 {
+		cfg.HalfOpenTrials = 1
+	}
+	if cfg.HalfOpenSuccesses < 1 {
+		cfg.HalfOpenSuccesses = 1
+	}
+	if onTransition == nil {
+		onTransition = func(Transition) {}
+	}
+	return &Set{
+		cfg:          cfg,
+		breakers:     make(map[string]*Breaker),
+		now:          now,
+		onTransition: onTransition,
+	}
+}
+
+// Get returns the circuit of the upstream at addr.
+func (s *Set) Get(addr string) *Breaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, found := s.breakers[addr]
+	if !found {
+		b = &Breaker{addr: addr, set: s}
+		s.breakers[addr] = b
+	}
+	return b
+}
+
+// State returns the state of the circuit, moving an open circuit whose time is up to half open.
+func (b *Breaker) State() State {
+	var t *Transition
+	b.set.mu.Lock()
+	state := b.refresh(&t)
+	b.set.mu.Unlock()
+	b.set.notify(t)
+	return state
+}
+
+// Allow reports whether a connection may go to the upstream now.
+func (b *Breaker) Allow() bool {
+	var t *Transition
+	b.set.mu.Lock()
+	allowed := b.allow(&t)
+	b.set.mu.Unlock()
+	b.set.notify(t)
+	return allowed
+}
+
+// Acquire is like Allow but also takes a trial slot when the circuit is half open.
+// Every acquired connection must be reported with Done, or given back with Release.
+func (b *Breaker) Acquire() bool {
+	var t *Transition
+	b.set.mu.Lock()
+	allowed := b.allow(&t)
+	if allowed && b.state == HalfOpen {
+		b.trials++
+	}
+	b.set.mu.Unlock()
+	b.set.notify(t)
+	return allowed
+}
+
+// Release gives back what Acquire took for a connection that was never made, without
+// reporting an outcome.
+func (b *Breaker) Release() {
+	b.set.mu.Lock()
+	if b.state == HalfOpen && b.trials > 0 {
+		b.trials--
+	}
+	b.set.mu.Unlock()
+}
+
+// Done reports how an acquired connection went. Connections still open
+// when the circuit half opens are taken for trials.
+func (b *Breaker) Done(success bool) {
+	if !b.set.enabled() {
+		return
+	}
+	var t *Transition
+	b.set.mu.Lock()
+	now := b.set.now()
+	switch b.state {
+	case Closed:
+		if success {
+			b.failures = 0
+		} else {
+			b.failures++
+			if b.failures >= b.set.cfg.ConsecutiveFailures {
+				b.open(now, &t)
+			}
+		}
+	case HalfOpen:
+		if b.trials > 0 {
+			b.trials--
+		}
+		if !success {
+			b.open(now, &t)
+			break
+		}
+		b.successes++
+		if b.successes >= b.set.cfg.HalfOpenSuccesses {
+			t = b.to(Closed, now)
+			b.failures = 0
+		}
+	case Open:
+		// connections that started before the circuit opened tell nothing new
+	}
+	b.set.mu.Unlock()
+	b.set.notify(t)
+}
+
+func (s *Set) enabled() bool {
+	return s.cfg.ConsecutiveFailures > 0
+}
+
+func (b *Breaker) allow(t **Transition) bool {
+	switch b.refresh(t) {
+	case Open:
+		return false
+	case HalfOpen:
+		return b.trials < b.set.cfg.HalfOpenTrials
+	}
+	return true
+}
+
+func (b *Breaker) refresh(t **Transition) State {
+	now := b.set.now()
+	if b.state == Open && now.Sub(b.openedAt) >= b.set.cfg.OpenDuration {
+		*t = b.to(HalfOpen, now)
+		b.successes = 0
+		b.trials = 0
+	}
+	return b.state
+}
+
+func (b *Breaker) open(now time.Time, t **Transition) {
+	*t = b.to(Open, now)
+	b.openedAt = now
+}
+
+func (b *Breaker) to(state State, now time.Time) *Transition {
+	t := &Transition{Upstream: b.addr, From: b.state, To: state, Time: now}
+	b.state = state
+	return t
+}
+
+func (s *Set) notify(t *Transition) {
+	if t != nil {
+		s.onTransition(*t)
+	}
+}
@@ -0,0 +1,106 @@
+package breaker
+
+import (
+	"layer4balancer/config"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestBreaker(t *testing.T) {
+	cfg := config.BreakerCfg{
+		ConsecutiveFailures: 2,
+		OpenDuration:        10 * time.Second,
+		HalfOpenTrials:      1,
+		HalfOpenSuccesses:   2,
+	}
+	clock := &fakeClock{now: time.Date(2022, 8, 3, 10, 0, 0, 0, time.UTC)}
+	var transitions []Transition
+	set := NewWithClock(cfg, func(t Transition) {
+		transitions = append(transitions, t)
+	}, clock.Now)
+	b := set.Get("127.0.0.1:8000")
+
+	tests := []struct {
+		description string
+		advance     time.Duration
+		// connections acquired and how they went, in order
+		results   []bool
+		wantState State
+		wantAllow bool
+	}{
+		{"closed", 0, nil, Closed, true},
+		{"a success resets the failures", 0, []bool{false, true, false}, Closed, true},
+		{"failures in a row open the circuit", 0, []bool{false}, Open, false},
+		{"open until its time is up", 9 * time.Second, nil, Open, false},
+		{"half open", time.Second, nil, HalfOpen, true},
+		{"a failed trial opens the circuit again", 0, []bool{false}, Open, false},
+		{"half open again", 10 * time.Second, []bool{true}, HalfOpen, true},
+		{"enough successful trials close the circuit", 0, []bool{true}, Closed, true},
+	}
+	for _, tc := range tests {
+		clock.Advance(tc.advance)
+		for _, success := range tc.results {
+			if !b.Acquire() {
+				t.Fatalf("%s, connection refused", tc.description)
+			}
+			b.Done(success)
+		}
+		if got := b.State(); got != tc.wantState {
+			t.Errorf("%s, %v != %v", tc.description, got, tc.wantState)
+		}
+		if got := b.Allow(); got != tc.wantAllow {
+			t.Errorf("%s, %v != %v", tc.description, got, tc.wantAllow)
+		}
+	}
+
+	want := []State{Open, HalfOpen, Open, HalfOpen, Closed}
+	if len(transitions) != len(want) {
+		t.Fatalf("%v != %v", transitions, want)
+	}
+	for i := range want {
+		if transitions[i].To != want[i] || transitions[i].Upstream != "127.0.0.1:8000" {
+			t.Errorf("transition %d, %v != %v", i, transitions[i], want[i])
+		}
+	}
+}
+
+func TestHalfOpenTrials(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 8, 3, 10, 0, 0, 0, time.UTC)}
+	set := NewWithClock(config.BreakerCfg{ConsecutiveFailures: 1, OpenDuration: time.Second, HalfOpenTrials: 2}, nil, clock.Now)
+	b := set.Get("127.0.0.1:8000")
+	b.Acquire()
+	b.Done(false)
+	clock.Advance(time.Second)
+
+	if !b.Acquire() || !b.Acquire() {
+		t.Fatalf("trials refused")
+	}
+	if b.Acquire() {
+		t.Errorf("more trials than HalfOpenTrials at a time")
+	}
+	b.Done(true)
+	if b.State() != Closed {
+		t.Errorf("%v != %v", b.State(), Closed)
+	}
+
+	disabled := New(config.BreakerCfg{}, nil).Get("127.0.0.1:8000")
+	for i := 0; i < 10; i++ {
+		disabled.Acquire()
+		disabled.Done(false)
+	}
+	if !disabled.Allow() {
+		t.Errorf("circuit opened with circuit breaking disabled")
+	}
+}
@@ -0,0 +1,143 @@
+// discovery package keeps the upstream registry in step with sources of upstreams
+package discovery
+
+import (
+	"context"
+	"layer4balancer/config"
+	u "layer4balancer/pkg/upstream"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Lookup returns the upstreams a source lists at the moment.
+type Lookup func(ctx context.Context) ([]*u.Upstream, error)
+
+// Poller looks up the upstreams of a source on an interval, adding the new ones to the
+// registry and draining the ones that are gone. It only drains upstreams it added itself,
+// and keeps them all when a lookup fails.
+type Poller struct {
+	source   string
+	lookup   Lookup
+	interval time.Duration
+	registry *u.Registry
+	// upstreams the poller added, by address
+	known   map[string]*u.Upstream
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+	mu      sync.Mutex
+}
+
+// New returns a poller for every source of upstreams cfg enables.
+func New(cfg config.DiscoveryCfg, registry *u.Registry) ([]*Poller, error) {
+	var pollers []*Poller
+	if cfg.DNSName != "" {
+		lookup, err := DNSLookup(NewResolver(cfg.DNSServer), cfg)
+		if err != nil {
+			return nil, err
+		}
+		pollers = append(pollers, NewPoller("dns", lookup, cfg.DiscoveryInterval, registry))
+	}
+	if cfg.DiscoveryFile != "" {
+		pollers = append(pollers, NewPoller("file", FileLookup(cfg), cfg.DiscoveryInterval, registry))
+	}
+	if cfg.DiscoveryURL != "" {
+		pollers = append(pollers, NewPoller("http", HTTPLookup(cfg), cfg.DiscoveryInterval, registry))
+	}
+	return pollers, nil
+}
+
+// NewPoller returns a poller adding the upstreams lookup finds to registry. The source names
+// it in logs.
+func NewPoller(source string, lookup Lookup, interval time.Duration, registry *u.Registry) *Poller {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	return &Poller{
+		source:   source,
+		lookup:   lookup,
+		interval: interval,
+		registry: registry,
+		known:    make(map[string]*u.Upstream),
+	}
+}
+
+// Start looks up the upstreams right away, then every interval until Stop.
+func (p *Poller) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.running.Add(1)
+	go func() {
+		defer p.running.Done()
+		for {
+			if err := p.Refresh(ctx); err != nil && ctx.Err() == nil {
+				log.WithFields(log.Fields{"source": p.source}).Warn("failed to discover upstreams ", err)
+			}
+			timer := time.NewTimer(p.interval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+	log.WithFields(log.Fields{"source": p.source}).Info("discovering upstreams")
+}
+
+// Stop cancels the lookup in flight and returns once the poller has stopped. The upstreams
+// it added stay in the registry.
+func (p *Poller) Stop() {
+	if p.cancel != nil {
+		p.cancel()
+		p.running.Wait()
+	}
+}
+
+// Refresh looks up the upstreams once and brings the registry in step with them.
+func (p *Poller) Refresh(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	upstreams, err := p.lookup(ctx)
+	if err != nil {
+		return err
+	}
+	p.reconcile(upstreams)
+	return nil
+}
+
+// reconcile is called with p.mu held.
+func (p *Poller) reconcile(upstreams []*u.Upstream) {
+	listed := make(map[string]bool)
+	for _, up := range upstreams {
+		addr := up.Host + ":" + up.Port
+		listed[addr] = true
+		if known, found := p.known[addr]; found {
+			// still there, unless it was removed by hand since
+			if current, _ := p.registry.Get(addr); current == known {
+				continue
+			}
+			delete(p.known, addr)
+		}
+		if err := p.registry.Add(up); err != nil {
+			// e.g. a static upstream at the same address, which is not ours to drain
+			log.WithFields(log.Fields{"source": p.source, "upstream": addr}).Debug("discovered upstream not added ", err)
+			continue
+		}
+		p.known[addr] = up
+		log.WithFields(log.Fields{"source": p.source, "upstream": addr}).Info("discovered upstream")
+	}
+
+	for addr, known := range p.known {
+		if listed[addr] {
+			continue
+		}
+		delete(p.known, addr)
+		if current, _ := p.registry.Get(addr); current != known {
+			continue
+		}
+		p.registry.Drain(addr)
+		log.WithFields(log.Fields{"source": p.source, "upstream": addr}).Info("upstream no longer discovered, draining")
+	}
+}
@@ -0,0 +1,356 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"layer4balancer/config"
+	u "layer4balancer/pkg/upstream"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	typeA    = 1
+	typeAAAA = 28
+	typeSRV  = 33
+)
+
+type fakeRecord struct {
+	rtype uint16
+	data  []byte
+}
+
+// fakeDNS is a DNS server answering from records, by name, over UDP.
+type fakeDNS struct {
+	conn    net.PacketConn
+	records map[string][]fakeRecord
+	mu      sync.Mutex
+}
+
+func startFakeDNS(t *testing.T) *fakeDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDNS{conn: conn, records: make(map[string][]fakeRecord)}
+	go d.serve()
+	return d
+}
+
+func (d *fakeDNS) set(name string, records ...fakeRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.records[name] = records
+}
+
+func (d *fakeDNS) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if reply := d.answer(buf[:n]); reply != nil {
+			d.conn.WriteTo(reply, addr)
+		}
+	}
+}
+
+// answer replies to a query of one question, ignoring its other sections.
+func (d *fakeDNS) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	var labels []string
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		size := int(query[end])
+		if end+1+size > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[end+1:end+1+size]))
+		end += 1 + size
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	name := strings.ToLower(strings.Join(labels, ".")) + "."
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+
+	d.mu.Lock()
+	records, found := d.records[name]
+	d.mu.Unlock()
+	var answers []fakeRecord
+	for _, r := range records {
+		if r.rtype == qtype {
+			answers = append(answers, r)
+		}
+	}
+
+	reply := append([]byte(nil), query[:2]...)
+	flags := uint16(0x8180)
+	if !found {
+		// NXDOMAIN
+		flags |= 3
+	}
+	reply = appendUint16(reply, flags)
+	reply = appendUint16(reply, 1)
+	reply = appendUint16(reply, uint16(len(answers)))
+	reply = append(reply, 0, 0, 0, 0)
+	reply = append(reply, query[12:end]...)
+	for _, r := range answers {
+		// the name points at the question
+		reply = append(reply, 0xc0, 12)
+		reply = appendUint16(reply, r.rtype)
+		reply = appendUint16(reply, 1)
+		reply = append(reply, 0, 0, 0, 60)
+		reply = appendUint16(reply, uint16(len(r.data)))
+		reply = append(reply, r.data...)
+	}
+	return reply
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func ipRecord(ip string) fakeRecord {
+	parsed := net.ParseIP(ip)
+	if v4 := parsed.To4(); v4 != nil {
+		return fakeRecord{rtype: typeA, data: v4}
+	}
+	return fakeRecord{rtype: typeAAAA, data: parsed.To16()}
+}
+
+func srvRecord(priority, weight, port uint16, target string) fakeRecord {
+	var data []byte
+	data = appendUint16(data, priority)
+	data = appendUint16(data, weight)
+	data = appendUint16(data, port)
+	for _, label := range strings.Split(strings.TrimSuffix(target, "."), ".") {
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+	data = append(data, 0)
+	return fakeRecord{rtype: typeSRV, data: data}
+}
+
+// describe lists upstreams as host:port/priority, sorted.
+func describe(upstreams []*u.Upstream) []string {
+	described := []string{}
+	for _, up := range upstreams {
+		described = append(described, up.Host+":"+up.Port+"/"+string(rune('0'+up.Priority)))
+	}
+	sort.Strings(described)
+	return described
+}
+
+func TestDNSLookup(t *testing.T) {
+	dns := startFakeDNS(t)
+	defer dns.conn.Close()
+	dns.set("app.test.", ipRecord("10.0.0.1"), ipRecord("10.0.0.2"), ipRecord("fd00::1"))
+	dns.set("_lb._tcp.app.test.",
+		srvRecord(20, 1, 9001, "backup.app.test."),
+		srvRecord(10, 1, 9000, "a.app.test."),
+		srvRecord(10, 1, 9000, "b.app.test."))
+	resolver := NewResolver(dns.conn.LocalAddr().String())
+
+	tests := []struct {
+		description string
+		cfg         config.DiscoveryCfg
+		want        []string
+		wantErr     bool
+	}{
+		{
+			description: "A and AAAA records",
+			cfg:         config.DiscoveryCfg{DNSName: "app.test.", DNSPort: "8000"},
+			want:        []string{"10.0.0.1:8000/0", "10.0.0.2:8000/0", "[fd00::1]:8000/0"},
+		},
+		{
+			description: "SRV records, tiered by priority",
+			cfg:         config.DiscoveryCfg{DNSName: "_lb._tcp.app.test.", DNSRecord: "SRV"},
+			want:        []string{"a.app.test:9000/0", "b.app.test:9000/0", "backup.app.test:9001/1"},
+		},
+		{
+			description: "unknown name",
+			cfg:         config.DiscoveryCfg{DNSName: "missing.test.", DNSPort: "8000"},
+			wantErr:     true,
+		},
+	}
+	for _, tc := range tests {
+		lookup, err := DNSLookup(resolver, tc.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstreams, err := lookup(context.Background())
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s, %v", tc.description, err)
+			continue
+		}
+		if got := describe(upstreams); !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s, %v != %v", tc.description, got, tc.want)
+		}
+	}
+
+	if _, err := DNSLookup(resolver, config.DiscoveryCfg{DNSName: "app.test.", DNSRecord: "MX"}); err == nil {
+		t.Errorf("MX records accepted")
+	}
+	if _, err := DNSLookup(resolver, config.DiscoveryCfg{DNSName: "app.test."}); err == nil {
+		t.Errorf("A records accepted without a port")
+	}
+}
+
+func TestPoller(t *testing.T) {
+	static := &u.Upstream{Host: "10.0.0.1", Port: "8000", IsAlive: true}
+	registry := u.NewRegistry([]*u.Upstream{static})
+	var listed []string
+	var lookupErr error
+	lookup := func(ctx context.Context) ([]*u.Upstream, error) {
+		var upstreams []*u.Upstream
+		for _, host := range listed {
+			upstreams = append(upstreams, &u.Upstream{Host: host, Port: "8000"})
+		}
+		return upstreams, lookupErr
+	}
+	poller := NewPoller("test", lookup, 0, registry)
+
+	tests := []struct {
+		description string
+		listed      []string
+		lookupErr   error
+		// a connection is open to 10.0.0.3 while it is looked up
+		busy bool
+		want []string
+	}{
+		{description: "added", listed: []string{"10.0.0.2", "10.0.0.3"}, want: []string{"10.0.0.1:8000/0", "10.0.0.2:8000/0", "10.0.0.3:8000/0"}},
+		{description: "static upstream is not ours", listed: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, want: []string{"10.0.0.1:8000/0", "10.0.0.2:8000/0", "10.0.0.3:8000/0"}},
+		{description: "failed lookup keeps upstreams", lookupErr: errors.New("timeout"), want: []string{"10.0.0.1:8000/0", "10.0.0.2:8000/0", "10.0.0.3:8000/0"}},
+		{description: "gone upstreams are drained", listed: []string{"10.0.0.2"}, busy: true, want: []string{"10.0.0.1:8000/0", "10.0.0.2:8000/0"}},
+		{description: "back while draining", listed: []string{"10.0.0.2", "10.0.0.3"}, busy: true, want: []string{"10.0.0.1:8000/0", "10.0.0.2:8000/0"}},
+		{description: "back once drained", listed: []string{"10.0.0.2", "10.0.0.3"}, want: []string{"10.0.0.1:8000/0", "10.0.0.2:8000/0", "10.0.0.3:8000/0"}},
+		{description: "none listed", listed: []string{}, want: []string{"10.0.0.1:8000/0"}},
+	}
+	var busy *u.Upstream
+	for _, tc := range tests {
+		if busy == nil && tc.busy {
+			busy, _ = registry.Get("10.0.0.3:8000")
+			registry.Acquire(busy)
+		} else if busy != nil && !tc.busy {
+			registry.Release(busy)
+			busy = nil
+		}
+		listed, lookupErr = tc.listed, tc.lookupErr
+		if err := poller.Refresh(context.Background()); (err != nil) != (tc.lookupErr != nil) {
+			t.Errorf("%s, %v", tc.description, err)
+		}
+		if got := describe(registry.Snapshot()); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s, %v != %v", tc.description, got, tc.want)
+		}
+	}
+	if current, _ := registry.Get("10.0.0.1:8000"); current != static {
+		t.Errorf("static upstream replaced")
+	}
+}
+
+func TestFileLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "upstreams.json")
+	registry := u.NewRegistry(nil)
+	poller := NewPoller("file", FileLookup(config.DiscoveryCfg{DiscoveryFile: path, DiscoveredMaxConns: 300}), 0, registry)
+
+	tests := []struct {
+		description string
+		// nothing is written if empty
+		file    string
+		wantErr bool
+		want    []string
+	}{
+		{description: "missing file", wantErr: true, want: []string{}},
+		{description: "listed", file: `[{"Host": "10.0.0.1", "Port": "8000"}, {"Host": "10.0.0.2", "Port": "8000", "Priority": 1}]`, want: []string{"10.0.0.1:8000/0", "10.0.0.2:8000/1"}},
+		{description: "unchanged", want: []string{"10.0.0.1:8000/0", "10.0.0.2:8000/1"}},
+		{description: "half written", file: `[{"Host": "10.0.0.1", "Po`, wantErr: true, want: []string{"10.0.0.1:8000/0", "10.0.0.2:8000/1"}},
+		{description: "no port", file: `[{"Host": "10.0.0.1"}]`, wantErr: true, want: []string{"10.0.0.1:8000/0", "10.0.0.2:8000/1"}},
+		{description: "one gone", file: `[{"Host": "10.0.0.2", "Port": "8000", "Priority": 1, "MaxConns": 10}]`, want: []string{"10.0.0.2:8000/1"}},
+		{description: "emptied", file: `[]`, want: []string{}},
+	}
+	for i, tc := range tests {
+		if tc.file != "" {
+			if err := ioutil.WriteFile(path, []byte(tc.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			// a new modification time even if the file is written within the same tick
+			modTime := time.Now().Add(time.Duration(i) * time.Second)
+			os.Chtimes(path, modTime, modTime)
+		}
+		if err := poller.Refresh(context.Background()); (err != nil) != tc.wantErr {
+			t.Errorf("%s, %v", tc.description, err)
+		}
+		if got := describe(registry.Snapshot()); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s, %v != %v", tc.description, got, tc.want)
+		}
+	}
+}
+
+func TestHTTPLookup(t *testing.T) {
+	var reply string
+	status := http.StatusOK
+	var mu sync.Mutex
+	catalog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(status)
+		w.Write([]byte(reply))
+	}))
+	defer catalog.Close()
+	registry := u.NewRegistry(nil)
+	poller := NewPoller("http", HTTPLookup(config.DiscoveryCfg{DiscoveryURL: catalog.URL + "/v1/catalog/service/web"}), 0, registry)
+
+	tests := []struct {
+		description string
+		status      int
+		reply       string
+		wantErr     bool
+		want        []string
+	}{
+		{
+			description: "listed",
+			status:      http.StatusOK,
+			reply: `[{"Node": "a", "Address": "10.0.0.1", "ServiceAddress": "", "ServicePort": 8000},
+				{"Node": "b", "Address": "10.0.0.2", "ServiceAddress": "10.0.1.2", "ServicePort": 8001, "ServiceMeta": {"zone": "zone-b"}}]`,
+			want: []string{"10.0.0.1:8000/0", "10.0.1.2:8001/0"},
+		},
+		{description: "catalog down", status: http.StatusInternalServerError, reply: "oops", wantErr: true, want: []string{"10.0.0.1:8000/0", "10.0.1.2:8001/0"}},
+		{description: "bad reply", status: http.StatusOK, reply: `{"Node": "a"}`, wantErr: true, want: []string{"10.0.0.1:8000/0", "10.0.1.2:8001/0"}},
+		{description: "one gone", status: http.StatusOK, reply: `[{"Node": "b", "Address": "10.0.0.2", "ServiceAddress": "10.0.1.2", "ServicePort": 8001, "ServiceMeta": {"zone": "zone-b"}}]`, want: []string{"10.0.1.2:8001/0"}},
+	}
+	for _, tc := range tests {
+		mu.Lock()
+		status, reply = tc.status, tc.reply
+		mu.Unlock()
+		if err := poller.Refresh(context.Background()); (err != nil) != tc.wantErr {
+			t.Errorf("%s, %v", tc.description, err)
+		}
+		if got := describe(registry.Snapshot()); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s, %v != %v", tc.description, got, tc.want)
+		}
+	}
+	if up, _ := registry.Get("10.0.1.2:8001"); up == nil || up.Zone != "zone-b" {
+		t.Errorf("%+v", up)
+	}
+}
@@ -0,0 +1,109 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"layer4balancer/config"
+	u "layer4balancer/pkg/upstream"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Resolver looks up the DNS records of upstreams. *net.Resolver is one.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// NewResolver returns a resolver asking the DNS server at addr, or the system's resolver if addr is empty.
+func NewResolver(addr string) Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// DNSLookup returns a lookup of the upstreams in the A and AAAA records of cfg.DNSName, listening
+// on cfg.DNSPort, or in its SRV records if cfg.DNSRecord is "SRV". SRV records of lower priority
+// make upstreams of lower priority tiers.
+func DNSLookup(resolver Resolver, cfg config.DiscoveryCfg) (Lookup, error) {
+	switch strings.ToUpper(cfg.DNSRecord) {
+	case "", "A", "AAAA":
+		if cfg.DNSPort == "" {
+			return nil, fmt.Errorf("no port for the A records of %s", cfg.DNSName)
+		}
+		return func(ctx context.Context) ([]*u.Upstream, error) {
+			addrs, err := resolver.LookupIPAddr(ctx, cfg.DNSName)
+			if err != nil {
+				return nil, err
+			}
+			upstreams := make([]*u.Upstream, 0, len(addrs))
+			for _, addr := range addrs {
+				upstreams = append(upstreams, discovered(cfg, ipHost(addr.IP), cfg.DNSPort, 0))
+			}
+			return upstreams, nil
+		}, nil
+	case "SRV":
+		return func(ctx context.Context) ([]*u.Upstream, error) {
+			_, records, err := resolver.LookupSRV(ctx, "", "", cfg.DNSName)
+			if err != nil {
+				return nil, err
+			}
+			tiers := srvTiers(records)
+			upstreams := make([]*u.Upstream, 0, len(records))
+			for _, srv := range records {
+				host := strings.TrimSuffix(srv.Target, ".")
+				if ip := net.ParseIP(host); ip != nil {
+					host = ipHost(ip)
+				}
+				upstreams = append(upstreams, discovered(cfg, host, strconv.Itoa(int(srv.Port)), tiers[srv.Priority]))
+			}
+			return upstreams, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown DNS record type %s", cfg.DNSRecord)
+}
+
+// discovered returns a new upstream. It takes connections once its health checks pass.
+func discovered(cfg config.DiscoveryCfg, host, port string, priority int) *u.Upstream {
+	return &u.Upstream{
+		Host:     host,
+		Port:     port,
+		MaxConns: cfg.DiscoveredMaxConns,
+		Priority: priority,
+	}
+}
+
+// ipHost brackets IPv6 addresses, so that Host+":"+Port is an address to dial.
+func ipHost(ip net.IP) string {
+	if ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+	return ip.String()
+}
+
+// srvTiers numbers the priorities of records from 0, the lowest first.
+func srvTiers(records []*net.SRV) map[uint16]int {
+	var priorities []int
+	seen := make(map[uint16]bool)
+	for _, srv := range records {
+		if !seen[srv.Priority] {
+			seen[srv.Priority] = true
+			priorities = append(priorities, int(srv.Priority))
+		}
+	}
+	sort.Ints(priorities)
+	tiers := make(map[uint16]int)
+	for i, priority := range priorities {
+		tiers[uint16(priority)] = i
+	}
+	return tiers
+}
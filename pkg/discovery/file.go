@@ -0,0 +1,64 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"layer4balancer/config"
+	u "layer4balancer/pkg/upstream"
+	"os"
+	"time"
+)
+
+// fileEntry is an upstream as listed in a discovery file.
+type fileEntry struct {
+	Host     string
+	Port     string
+	MaxConns int
+	Priority int
+	Zone     string
+	Group    string
+}
+
+// FileLookup returns a lookup of the upstreams listed in cfg.DiscoveryFile. The file is
+// only read again once it changes. A file that cannot be parsed, e.g. while it is being
+// written, fails the lookup so that the upstreams are left as they are.
+func FileLookup(cfg config.DiscoveryCfg) Lookup {
+	var modTime time.Time
+	var size int64
+	var entries []fileEntry
+	return func(ctx context.Context) ([]*u.Upstream, error) {
+		info, err := os.Stat(cfg.DiscoveryFile)
+		if err != nil {
+			return nil, err
+		}
+		if !info.ModTime().Equal(modTime) || info.Size() != size {
+			data, err := ioutil.ReadFile(cfg.DiscoveryFile)
+			if err != nil {
+				return nil, err
+			}
+			var read []fileEntry
+			if err := json.Unmarshal(data, &read); err != nil {
+				return nil, fmt.Errorf("bad discovery file %s: %v", cfg.DiscoveryFile, err)
+			}
+			for _, e := range read {
+				if e.Host == "" || e.Port == "" {
+					return nil, fmt.Errorf("bad discovery file %s: upstream without host or port", cfg.DiscoveryFile)
+				}
+			}
+			modTime, size, entries = info.ModTime(), info.Size(), read
+		}
+
+		upstreams := make([]*u.Upstream, 0, len(entries))
+		for _, e := range entries {
+			up := discovered(cfg, e.Host, e.Port, e.Priority)
+			if e.MaxConns > 0 {
+				up.MaxConns = e.MaxConns
+			}
+			up.Zone, up.Group = e.Zone, e.Group
+			upstreams = append(upstreams, up)
+		}
+		return upstreams, nil
+	}
+}
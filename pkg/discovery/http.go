@@ -0,0 +1,67 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"layer4balancer/config"
+	u "layer4balancer/pkg/upstream"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// catalogService is an instance of a service as listed by the Consul catalog. Zone and
+// Group are read from the "zone" and "group" keys of its metadata.
+type catalogService struct {
+	Address        string
+	ServiceAddress string
+	ServicePort    int
+	ServiceMeta    map[string]string
+}
+
+// HTTPLookup returns a lookup of the upstreams listed at cfg.DiscoveryURL in the shape of
+// the Consul catalog. Instances without a service address are at the address of their node.
+func HTTPLookup(cfg config.DiscoveryCfg) Lookup {
+	client := &http.Client{Timeout: cfg.DiscoveryInterval}
+	if client.Timeout <= 0 {
+		client.Timeout = 10 * time.Second
+	}
+	return func(ctx context.Context) ([]*u.Upstream, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.DiscoveryURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s replied %s", cfg.DiscoveryURL, res.Status)
+		}
+		var services []catalogService
+		if err := json.NewDecoder(res.Body).Decode(&services); err != nil {
+			return nil, fmt.Errorf("bad reply from %s: %v", cfg.DiscoveryURL, err)
+		}
+
+		upstreams := make([]*u.Upstream, 0, len(services))
+		for _, s := range services {
+			host := s.ServiceAddress
+			if host == "" {
+				host = s.Address
+			}
+			if host == "" || s.ServicePort <= 0 {
+				return nil, fmt.Errorf("bad reply from %s: service without address or port", cfg.DiscoveryURL)
+			}
+			if ip := net.ParseIP(host); ip != nil {
+				host = ipHost(ip)
+			}
+			up := discovered(cfg, host, strconv.Itoa(s.ServicePort), 0)
+			up.Zone, up.Group = s.ServiceMeta["zone"], s.ServiceMeta["group"]
+			upstreams = append(upstreams, up)
+		}
+		return upstreams, nil
+	}
+}
@@ -1,62 +1,89 @@
 package healthcheck
 
 import (
+	"context"
+	"layer4balancer/pkg/latency"
 	u "layer4balancer/pkg/upstream"
-	"net"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Doctor keeps the health of one upstream. Its probes are run by the HealthChecker.
 type Doctor struct {
-	upstream            *u.Upstream
-	stop                chan bool
-	healthCheckInterval time.Duration
-	timeout             time.Duration
-	unhealthyUpstreams  chan *u.Upstream
-	healthyUpstreams    chan *u.Upstream
+	upstream *u.Upstream
+	check    *check
+	// latencies, if not nil, is told the latency of every probe that passes
+	latencies *latency.Tracker
+	state     State
+	// consecutive probes that passed and failed
+	passed int
+	failed int
+	mu     sync.Mutex
 }
 
-func (d *Doctor) Start() {
-	ticker := time.NewTicker(d.healthCheckInterval)
+// examine probes the upstream once and reports whether its health changed, and how.
+// The upstream becomes healthy once rise probes in a row have passed, and unhealthy once
+// fall probes in a row have failed, so a single flaky probe does not flip its state.
+func (d *Doctor) examine(ctx context.Context) (e Event, changed bool) {
 
-	go func() {
-		for {
-			select {
-
-			case <-ticker.C:
-				go d.check()
+	address := d.upstream.Host + ":" + d.upstream.Port
+	probeCtx, cancel := context.WithTimeout(ctx, d.check.timeout)
+	started := time.Now()
+	err := d.check.probe.Probe(probeCtx, address)
+	elapsed := time.Since(started)
+	cancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			// stopped; the probe says nothing about the upstream
+			return Event{}, false
+		}
+		log.Debug("health check of ", address, " failed: ", err)
+	}
 
-			case <-d.stop:
-				ticker.Stop()
-				return
-			default:
-			}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		d.passed = 0
+		d.failed++
+		if d.failed >= d.check.fall && d.state != Unhealthy {
+			return d.to(Unhealthy, err.Error(), elapsed), true
+		}
+	} else {
+		if d.latencies != nil {
+			d.latencies.Observe(address, elapsed)
 		}
-	}()
+		d.failed = 0
+		d.passed++
+		if d.passed >= d.check.rise && d.state != Healthy {
+			return d.to(Healthy, "health check passed", elapsed), true
+		}
+	}
+	return Event{}, false
 }
 
-func (d *Doctor) Stop() {
-	d.stop <- true
+// markUnhealthy takes the upstream for unhealthy without waiting for probes, and
+// reports whether that is a change. It needs rise probes in a row to be healthy again.
+func (d *Doctor) markUnhealthy(reason string) (e Event, changed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.passed = 0
+	if d.state == Unhealthy {
+		return Event{}, false
+	}
+	return d.to(Unhealthy, reason, 0), true
 }
 
-// check polls the status of an upstream service
-// it tries to set up a connection with the upstream service
-// if connection is successful without timeout, close the connection
-// if timeout, mark the upstream as unhealthy, push the result to unhealthyUpstreams channel
-func (d *Doctor) check() {
-
-	address := d.upstream.Host + ":" + d.upstream.Port
-	conn, err := net.DialTimeout("tcp", address, d.timeout)
-	if err != nil {
-		d.unhealthyUpstreams <- d.upstream
-	} else {
-		message := "Health checker: Hello from Doctor\n"
-		_, err = conn.Write([]byte(message))
-		if err != nil {
-			log.Error("doctor write error ", err)
-		}
-		d.healthyUpstreams <- d.upstream
-		conn.Close()
+func (d *Doctor) to(state State, reason string, latency time.Duration) Event {
+	e := Event{
+		Upstream: d.upstream.Host + ":" + d.upstream.Port,
+		From:     d.state,
+		To:       state,
+		Reason:   reason,
+		Latency:  latency,
+		Time:     time.Now(),
 	}
+	d.state = state
+	return e
 }
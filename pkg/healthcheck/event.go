@@ -0,0 +1,115 @@
+package healthcheck
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// State is the health of an upstream as the health checker sees it.
+type State int
+
+const (
+	// Unknown is the state of upstreams not checked enough yet.
+	Unknown State = iota
+	Healthy
+	Unhealthy
+)
+
+func (s State) String() string {
+	switch s {
+	case Unknown:
+		return "unknown"
+	case Healthy:
+		return "healthy"
+	case Unhealthy:
+		return "unhealthy"
+	}
+	return "invalid"
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Event is a change of the health of an upstream.
+type Event struct {
+	// Upstream is the address of the upstream, as in "127.0.0.1:8000".
+	Upstream string
+	From     State
+	To       State
+	// Reason is why the upstream changed state, e.g. the error of the failing probe.
+	Reason string
+	// Latency is how long the probe that made the change took, 0 if no probe did.
+	Latency time.Duration
+	Time    time.Time
+}
+
+// defaultHistorySize is how many events are kept per upstream if HistorySize is not set.
+const defaultHistorySize = 20
+
+// Subscribe returns a channel receiving every event from now on, buffering up to buffer
+// events. Events are dropped rather than wait for a subscriber that falls behind.
+// The channel is closed by cancel, or when the health checker stops.
+func (h *HealthChecker) Subscribe(buffer int) (events <-chan Event, cancel func()) {
+	ch := make(chan Event, buffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopped {
+		close(ch)
+		return ch, func() {}
+	}
+	h.subscribers[ch] = true
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.subscribers[ch] {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// History returns the recent events of the upstream at addr, oldest first.
+func (h *HealthChecker) History(addr string) []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Event(nil), h.history[addr]...)
+}
+
+// Histories returns the recent events of every upstream by address, oldest first.
+func (h *HealthChecker) Histories() map[string][]Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	histories := make(map[string][]Event, len(h.history))
+	for addr, events := range h.history {
+		histories[addr] = append([]Event(nil), events...)
+	}
+	return histories
+}
+
+// record keeps e in the history of its upstream and hands it to the subscribers.
+// It is called with h.mu held.
+func (h *HealthChecker) record(e Event) {
+	events := append(h.history[e.Upstream], e)
+	if len(events) > h.historySize {
+		events = events[len(events)-h.historySize:]
+	}
+	h.history[e.Upstream] = events
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			log.Warn("health event subscriber is falling behind, dropped event of ", e.Upstream)
+		}
+	}
+}
+
+// unsubscribeAll closes the channels of every subscriber. It is called with h.mu held.
+func (h *HealthChecker) unsubscribeAll() {
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
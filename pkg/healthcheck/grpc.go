@@ -0,0 +1,183 @@
+package healthcheck
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"layer4balancer/config"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// GRPCProbe calls grpc.health.v1.Health/Check and passes if the call succeeds and the
+// service is SERVING.
+//
+// Calls go through the HTTP/2 client of golang.org/x/net, over TLS or in cleartext with
+// prior knowledge (h2c), so the load balancer does not depend on a gRPC library.
+type GRPCProbe struct {
+	client  *http.Client
+	scheme  string
+	service string
+}
+
+const (
+	healthCheckPath = "/grpc.health.v1.Health/Check"
+	servingStatus   = 1
+)
+
+func NewGRPCProbe(cfg config.CheckCfg) (*GRPCProbe, error) {
+	p := &GRPCProbe{scheme: "https", service: cfg.Service}
+	transport := &http2.Transport{}
+	if cfg.TLS {
+		tlsConfig, err := probeTlsConfig(cfg.CaPath)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	} else {
+		p.scheme = "http"
+		transport.AllowHTTP = true
+		transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	p.client = &http.Client{Transport: transport}
+	return p, nil
+}
+
+func (p *GRPCProbe) Probe(ctx context.Context, address string) error {
+	var request []byte
+	if p.service != "" {
+		var l [binary.MaxVarintLen64]byte
+		request = append(request, 0x0a) // field 1, length delimited
+		request = append(request, l[:binary.PutUvarint(l[:], uint64(len(p.service)))]...)
+		request = append(request, p.service...)
+	}
+	req, err := http.NewRequest(http.MethodPost, p.scheme+"://"+address+healthCheckPath, bytes.NewReader(grpcMessage(request)))
+	if err != nil {
+		return err
+	}
+	// every probe opens a new connection, as clients of the load balancer would
+	req.Close = true
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %d", res.StatusCode)
+	}
+	// trailers are only known once the body is read
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxResponse))
+	if err != nil {
+		return err
+	}
+	if err := grpcStatus(res); err != nil {
+		return err
+	}
+
+	message, err := grpcResponse(data)
+	if err != nil {
+		return err
+	}
+	status, err := healthStatus(message)
+	if err != nil {
+		return err
+	}
+	if status != servingStatus {
+		return fmt.Errorf("gRPC health status %d, not SERVING", status)
+	}
+	return nil
+}
+
+// grpcStatus returns the error of a call whose grpc-status is not OK. A call that fails
+// right away may send its status in the headers instead of the trailers.
+func grpcStatus(res *http.Response) error {
+	status, message := res.Trailer.Get("Grpc-Status"), res.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = res.Header.Get("Grpc-Status"), res.Header.Get("Grpc-Message")
+	}
+	switch status {
+	case "0":
+		return nil
+	case "":
+		return errors.New("no gRPC status")
+	default:
+		return fmt.Errorf("gRPC status %s: %s", status, message)
+	}
+}
+
+func grpcMessage(m []byte) []byte {
+	b := make([]byte, 5, 5+len(m))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(m)))
+	return append(b, m...)
+}
+
+// grpcResponse returns the message of a response body.
+func grpcResponse(data []byte) ([]byte, error) {
+	// a message is prefixed by a compression flag and its length
+	if len(data) < 5 {
+		return nil, errors.New("no gRPC health check response")
+	}
+	if data[0] != 0 {
+		return nil, errors.New("compressed gRPC response")
+	}
+	n := binary.BigEndian.Uint32(data[1:5])
+	if uint32(len(data)-5) < n {
+		return nil, errors.New("truncated gRPC response")
+	}
+	return data[5 : 5+n], nil
+}
+
+// healthStatus returns the status field of a HealthCheckResponse.
+func healthStatus(m []byte) (uint64, error) {
+	var status uint64
+	for len(m) > 0 {
+		tag, n := binary.Uvarint(m)
+		if n <= 0 {
+			return 0, errors.New("malformed gRPC health check response")
+		}
+		m = m[n:]
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(m)
+			if n <= 0 {
+				return 0, errors.New("malformed gRPC health check response")
+			}
+			if tag>>3 == 1 {
+				status = v
+			}
+			m = m[n:]
+		case 1:
+			if len(m) < 8 {
+				return 0, errors.New("malformed gRPC health check response")
+			}
+			m = m[8:]
+		case 2:
+			l, n := binary.Uvarint(m)
+			if n <= 0 || uint64(len(m)-n) < l {
+				return 0, errors.New("malformed gRPC health check response")
+			}
+			m = m[n+int(l):]
+		case 5:
+			if len(m) < 4 {
+				return 0, errors.New("malformed gRPC health check response")
+			}
+			m = m[4:]
+		default:
+			return 0, errors.New("malformed gRPC health check response")
+		}
+	}
+	return status, nil
+}
@@ -1,67 +1,370 @@
 package healthcheck
 
 import (
+	"context"
 	"layer4balancer/config"
+	"layer4balancer/pkg/latency"
 	u "layer4balancer/pkg/upstream"
+	"math/rand"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// HealthChecker probes upstreams and reports changes of their health on
+// HealthyUpstreams and UnhealthyUpstreams. Probing never waits for the reports
+// to be received: when changes pile up, only the latest of each upstream is kept.
 type HealthChecker struct {
-	UnhealthyUpstreams  chan *u.Upstream
-	HealthyUpstreams    chan *u.Upstream
-	stop                chan bool
+	UnhealthyUpstreams chan *u.Upstream
+	HealthyUpstreams   chan *u.Upstream
+	// Latencies, if set before Start, is told the latency of every probe that passes.
+	Latencies           *latency.Tracker
 	healthCheckInterval time.Duration
-	timeout             time.Duration
-	doctors             []*Doctor
+	jitter              float64
+	maxProbes           int
+	check               *check
+	checks              map[string]*check
+	doctors             map[*u.Upstream]*Doctor
+	// upstreams added and removed since the scheduler last looked
+	updates []u.Change
+	wake    chan struct{}
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+	// changes not yet received, the latest health of each upstream
+	pending     map[*u.Upstream]bool
+	changed     chan struct{}
+	historySize int
+	history     map[string][]Event
+	subscribers map[chan Event]bool
+	stopped     bool
+	mu          sync.Mutex
 }
 
-func New(cfg config.HealthCheckCfg) *HealthChecker {
+func New(cfg config.HealthCheckCfg) (*HealthChecker, error) {
+
+	defaultCheck, err := newCheck(cfg.Check, cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	checks := make(map[string]*check)
+	for addr, checkCfg := range cfg.Checks {
+		if checks[addr], err = newCheck(checkCfg, cfg.Timeout); err != nil {
+			return nil, err
+		}
+	}
 
 	h := HealthChecker{
 		HealthyUpstreams:    make(chan *u.Upstream),
 		UnhealthyUpstreams:  make(chan *u.Upstream),
-		stop:                make(chan bool),
 		healthCheckInterval: cfg.HealthCheckInterval,
-		timeout:             cfg.Timeout,
-		doctors:             []*Doctor{},
+		jitter:              cfg.Jitter,
+		maxProbes:           cfg.MaxConcurrentProbes,
+		check:               defaultCheck,
+		checks:              checks,
+		doctors:             make(map[*u.Upstream]*Doctor),
+		wake:                make(chan struct{}, 1),
+		pending:             make(map[*u.Upstream]bool),
+		changed:             make(chan struct{}, 1),
+		historySize:         cfg.HistorySize,
+		history:             make(map[string][]Event),
+		subscribers:         make(map[chan Event]bool),
+	}
+	if h.healthCheckInterval <= 0 {
+		h.healthCheckInterval = time.Second
+	}
+	if h.historySize <= 0 {
+		h.historySize = defaultHistorySize
 	}
-	return &h
+	return &h, nil
 }
 
+// Start checks upstreams until Stop. More may be added and removed at any time.
 func (h *HealthChecker) Start(upstreams []*u.Upstream) {
-	for i := range upstreams {
-		doctor := &Doctor{
-			upstream:            upstreams[i],
-			stop:                make(chan bool),
-			healthCheckInterval: h.healthCheckInterval,
-			timeout:             h.timeout,
-			unhealthyUpstreams:  h.UnhealthyUpstreams,
-			healthyUpstreams:    h.HealthyUpstreams,
-		}
-		h.doctors = append(h.doctors, doctor)
-		doctor.Start()
-		h.doctors = append(h.doctors, doctor)
+	for _, up := range upstreams {
+		h.Add(up)
 	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.running.Add(2)
+	go h.schedule(ctx)
+	go h.deliver(ctx)
 	log.Info("health checker started!")
-	go func() {
-		for {
-			select {
-			case <-h.stop:
-				for i := range h.doctors {
-					h.doctors[i].Stop()
+}
+
+// Stop cancels the probes in flight and returns once every goroutine of the health checker
+// has exited. It closes the channels of the subscribers.
+func (h *HealthChecker) Stop() {
+	if h.cancel != nil {
+		h.cancel()
+		h.running.Wait()
+	}
+	h.mu.Lock()
+	h.stopped = true
+	h.unsubscribeAll()
+	h.mu.Unlock()
+	log.Info("health checker stopped")
+}
+
+// Add starts checking up.
+func (h *HealthChecker) Add(up *u.Upstream) {
+	h.update(u.Change{Type: u.Added, Upstream: up})
+}
+
+// Remove stops checking up. Its health is no longer reported.
+func (h *HealthChecker) Remove(up *u.Upstream) {
+	h.update(u.Change{Type: u.Removed, Upstream: up})
+}
+
+func (h *HealthChecker) update(c u.Change) {
+	h.mu.Lock()
+	switch c.Type {
+	case u.Added:
+		if _, found := h.doctors[c.Upstream]; !found {
+			h.doctors[c.Upstream] = h.newDoctor(c.Upstream)
+		}
+	case u.Removed:
+		delete(h.doctors, c.Upstream)
+		delete(h.pending, c.Upstream)
+	}
+	h.updates = append(h.updates, c)
+	h.mu.Unlock()
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// newDoctor is called with h.mu held.
+func (h *HealthChecker) newDoctor(up *u.Upstream) *Doctor {
+	c, found := h.checks[up.Host+":"+up.Port]
+	if !found {
+		c = h.check
+	}
+	return &Doctor{
+		upstream:  up,
+		check:     c,
+		latencies: h.Latencies,
+	}
+}
+
+// MarkUnhealthy reports an upstream unhealthy without waiting for its probes,
+// e.g. when it refused a client connection, for reason.
+func (h *HealthChecker) MarkUnhealthy(up *u.Upstream, reason string) {
+	h.mu.Lock()
+	doctor, found := h.doctors[up]
+	h.mu.Unlock()
+	if !found {
+		return
+	}
+	if e, changed := doctor.markUnhealthy(reason); changed {
+		h.publish(up, e)
+	}
+}
+
+// appointment is when a doctor probes its upstream next.
+type appointment struct {
+	doctor  *Doctor
+	due     time.Time
+	running bool
+	// removed appointments are dropped once their probe finishes
+	removed bool
+}
+
+// schedule runs the probes of every doctor, each once per jittered interval, at most
+// maxProbes at a time. A probe of an upstream never overlaps its previous one.
+func (h *HealthChecker) schedule(ctx context.Context) {
+	defer h.running.Done()
+
+	var slots chan struct{}
+	if h.maxProbes > 0 {
+		slots = make(chan struct{}, h.maxProbes)
+	}
+	finished := make(chan *appointment)
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var appointments []*appointment
+
+	for {
+		appointments = h.reschedule(appointments, random)
+		now := time.Now()
+		var next time.Time
+		for _, a := range appointments {
+			if a.running {
+				continue
+			}
+			if a.due.After(now) {
+				if next.IsZero() || a.due.Before(next) {
+					next = a.due
 				}
-				h.doctors = []*Doctor{}
-				log.Info("health checker stopped")
-				return
-			default:
+				continue
+			}
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+				default:
+					// retried when a probe finishes
+					continue
+				}
+			}
+			a.running = true
+			h.running.Add(1)
+			go h.probe(ctx, a, slots, finished)
+		}
+
+		var timer *time.Timer
+		var wake <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(now))
+			wake = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case a := <-finished:
+			a.running = false
+			a.due = time.Now().Add(h.jittered(random))
+			if a.removed {
+				appointments = dropAppointment(appointments, a)
+			}
+		case <-h.wake:
+		case <-wake:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// reschedule applies the upstreams added and removed since it last ran. First probes
+// are spread over an interval.
+func (h *HealthChecker) reschedule(appointments []*appointment, random *rand.Rand) []*appointment {
+	h.mu.Lock()
+	updates := h.updates
+	h.updates = nil
+	doctors := make(map[*u.Upstream]*Doctor, len(h.doctors))
+	for up, d := range h.doctors {
+		doctors[up] = d
+	}
+	h.mu.Unlock()
+
+	for _, c := range updates {
+		var existing *appointment
+		for _, a := range appointments {
+			if a.doctor.upstream == c.Upstream && !a.removed {
+				existing = a
 			}
+		}
+		switch {
+		case c.Type == u.Added && existing == nil && doctors[c.Upstream] != nil:
+			appointments = append(appointments, &appointment{
+				doctor: doctors[c.Upstream],
+				due:    time.Now().Add(time.Duration(random.Int63n(int64(h.healthCheckInterval)))),
+			})
+		case c.Type == u.Removed && existing != nil:
+			existing.removed = true
+			if !existing.running {
+				appointments = dropAppointment(appointments, existing)
+			}
+		}
+	}
+	return appointments
+}
 
+func dropAppointment(appointments []*appointment, a *appointment) []*appointment {
+	for i := range appointments {
+		if appointments[i] == a {
+			return append(appointments[:i], appointments[i+1:]...)
 		}
-	}()
+	}
+	return appointments
 }
 
-func (h *HealthChecker) Stop() {
-	h.stop <- true
+func (h *HealthChecker) probe(ctx context.Context, a *appointment, slots chan struct{}, finished chan *appointment) {
+	defer h.running.Done()
+
+	e, changed := a.doctor.examine(ctx)
+	if slots != nil {
+		<-slots
+	}
+	h.mu.Lock()
+	// the upstream may have been removed while it was probed
+	current := h.doctors[a.doctor.upstream] == a.doctor
+	h.mu.Unlock()
+	if changed && current {
+		h.publish(a.doctor.upstream, e)
+	}
+	select {
+	case finished <- a:
+	case <-ctx.Done():
+	}
+}
+
+// jittered returns the interval moved randomly by up to jitter of itself either way,
+// so that probes of many upstreams do not line up.
+func (h *HealthChecker) jittered(random *rand.Rand) time.Duration {
+	if h.jitter <= 0 {
+		return h.healthCheckInterval
+	}
+	d := float64(h.healthCheckInterval) * (1 + h.jitter*(2*random.Float64()-1))
+	return time.Duration(d)
+}
+
+// publish records a change of health for deliver to report, and the event of it.
+func (h *HealthChecker) publish(up *u.Upstream, e Event) {
+	h.mu.Lock()
+	if h.stopped {
+		h.mu.Unlock()
+		return
+	}
+	h.pending[up] = e.To == Healthy
+	h.record(e)
+	h.mu.Unlock()
+	select {
+	case h.changed <- struct{}{}:
+	default:
+	}
+}
+
+// deliver reports pending changes until the health checker stops.
+func (h *HealthChecker) deliver(ctx context.Context) {
+	defer h.running.Done()
+
+	for {
+		var up *u.Upstream
+		var isHealthy bool
+		h.mu.Lock()
+		for up, isHealthy = range h.pending {
+			break
+		}
+		h.mu.Unlock()
+
+		if up == nil {
+			select {
+			case <-h.changed:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		reports := h.UnhealthyUpstreams
+		if isHealthy {
+			reports = h.HealthyUpstreams
+		}
+		select {
+		case reports <- up:
+			h.mu.Lock()
+			if latest, found := h.pending[up]; found && latest == isHealthy {
+				delete(h.pending, up)
+			}
+			h.mu.Unlock()
+		case <-h.changed:
+			// the change may have been superseded
+		case <-ctx.Done():
+			return
+		}
+	}
 }
@@ -1,11 +1,26 @@
 package healthcheck
 
 import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
 	"layer4balancer/config"
+	"layer4balancer/pkg/latency"
 	u "layer4balancer/pkg/upstream"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func TestHealthChecker(t *testing.T) {
@@ -41,10 +56,13 @@ func TestHealthChecker(t *testing.T) {
 	// avoid race conditions in tests
 	var mu sync.Mutex
 	for _, tc := range tests {
-		hc := New(config.HealthCheckCfg{
+		hc, err := New(config.HealthCheckCfg{
 			HealthCheckInterval: 1 * time.Second,
 			Timeout:             1 * time.Second,
 		})
+		if err != nil {
+			t.Fatal(err)
+		}
 		hc.Start(tc.upstreams)
 
 		set := make(map[*u.Upstream]bool)
@@ -74,3 +92,557 @@ func TestHealthChecker(t *testing.T) {
 	}
 
 }
+
+// startTestUpstream starts an upstream that replies to anything it receives with reply.
+func startTestUpstream(t *testing.T, reply string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 1024)
+				if _, err := c.Read(buf); err != nil {
+					return
+				}
+				c.Write([]byte(reply))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestProbes(t *testing.T) {
+	upstream := startTestUpstream(t, "Reply from upstream")
+	silent := startTestUpstream(t, "")
+
+	tests := []struct {
+		description string
+		check       config.CheckCfg
+		address     string
+		wantErr     bool
+	}{
+		{
+			description: "connect only",
+			check:       config.CheckCfg{},
+			address:     upstream,
+		},
+		{
+			description: "reply matches",
+			check:       config.CheckCfg{Send: "ping", Expect: "^Reply from"},
+			address:     upstream,
+		},
+		{
+			description: "reply does not match",
+			check:       config.CheckCfg{Send: "ping", Expect: "^pong$"},
+			address:     upstream,
+			wantErr:     true,
+		},
+		{
+			description: "no reply before the timeout",
+			check:       config.CheckCfg{Send: "ping", Expect: ".", Timeout: 100 * time.Millisecond},
+			address:     silent,
+			wantErr:     true,
+		},
+		{
+			description: "unreachable",
+			check:       config.CheckCfg{},
+			address:     "127.0.0.1:1",
+			wantErr:     true,
+		},
+	}
+	for _, tc := range tests {
+		c, err := newCheck(tc.check, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		err = c.probe.Probe(ctx, tc.address)
+		cancel()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s, %v", tc.description, err)
+		}
+	}
+
+	bad := []config.CheckCfg{
+		{Type: "smtp"},
+		{Expect: "("},
+	}
+	for i, b := range bad {
+		if _, err := New(config.HealthCheckCfg{Check: b}); err == nil {
+			t.Errorf("bad check %d accepted", i)
+		}
+	}
+}
+
+// scriptedProbe passes or fails as told, one result per probe.
+type scriptedProbe struct {
+	results []bool
+}
+
+func (p *scriptedProbe) Probe(ctx context.Context, address string) error {
+	pass := p.results[0]
+	p.results = p.results[1:]
+	if !pass {
+		return errors.New("probe failed")
+	}
+	return nil
+}
+
+func TestRiseFall(t *testing.T) {
+	probes := []bool{true, false, true, false, false, false, true, true}
+	// what the doctor reports after each probe: healthy, unhealthy or nothing
+	want := []string{"", "", "", "", "", "unhealthy", "", "healthy"}
+
+	d := &Doctor{
+		upstream: &u.Upstream{Host: "127.0.0.1", Port: "8000"},
+		check:    &check{probe: &scriptedProbe{results: probes}, timeout: time.Second, rise: 2, fall: 3},
+	}
+	for i := range probes {
+		e, changed := d.examine(context.Background())
+		got := ""
+		if changed {
+			got = e.To.String()
+		}
+		if got != want[i] {
+			t.Errorf("probe %d, %q != %q", i, got, want[i])
+		}
+	}
+}
+
+// writeCA saves the certificate of a test server for probes to trust.
+func writeCA(t *testing.T, server *httptest.Server) string {
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHTTPProbe(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write([]byte(r.Method + " ok " + string(body)))
+		case "/moved":
+			http.Redirect(w, r, "/healthz", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+	ca := writeCA(t, secure)
+
+	tests := []struct {
+		description string
+		check       config.CheckCfg
+		server      *httptest.Server
+		wantErr     bool
+	}{
+		{
+			description: "status within the default range",
+			check:       config.CheckCfg{Type: "http", Path: "/healthz"},
+			server:      plain,
+		},
+		{
+			description: "status outside the range",
+			check:       config.CheckCfg{Type: "http", Path: "/missing"},
+			server:      plain,
+			wantErr:     true,
+		},
+		{
+			description: "redirects are not followed",
+			check:       config.CheckCfg{Type: "http", Path: "/moved", StatusMin: 200, StatusMax: 299},
+			server:      plain,
+			wantErr:     true,
+		},
+		{
+			description: "method and body",
+			check:       config.CheckCfg{Type: "http", Method: "POST", Path: "/healthz", Send: "ping", Expect: "^POST ok ping$"},
+			server:      plain,
+		},
+		{
+			description: "body does not match",
+			check:       config.CheckCfg{Type: "http", Path: "/healthz", Expect: "^degraded"},
+			server:      plain,
+			wantErr:     true,
+		},
+		{
+			description: "https",
+			check:       config.CheckCfg{Type: "http", Path: "/healthz", TLS: true, CaPath: ca},
+			server:      secure,
+		},
+		{
+			description: "https with an untrusted certificate",
+			check:       config.CheckCfg{Type: "http", Path: "/healthz", TLS: true},
+			server:      secure,
+			wantErr:     true,
+		},
+	}
+	for _, tc := range tests {
+		c, err := newCheck(tc.check, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		err = c.probe.Probe(ctx, strings.TrimPrefix(strings.TrimPrefix(tc.server.URL, "http://"), "https://"))
+		cancel()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s, %v", tc.description, err)
+		}
+	}
+}
+
+func TestGRPCProbe(t *testing.T) {
+	// health status by service, as a gRPC health server would report it
+	statuses := map[string]byte{"": 1, "payments": 2, "flaky": 1}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != "/grpc.health.v1.Health/Check" || r.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(w, "not a gRPC health check", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		service := ""
+		if len(body) > 7 {
+			service = string(body[7:])
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		status, found := statuses[service]
+		if !found {
+			// a trailers-only response
+			w.Header().Set("Grpc-Status", "5") // NOT_FOUND
+			w.Header().Set("Grpc-Message", "unknown service")
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write(grpcMessage([]byte{0x08, status}))
+		if service == "flaky" {
+			// a SERVING message does not make up for a failed call
+			w.Header().Set("Grpc-Status", "14") // UNAVAILABLE
+			w.Header().Set("Grpc-Message", "going away")
+			return
+		}
+		w.Header().Set("Grpc-Status", "0")
+	})
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	ca := writeCA(t, tlsServer)
+	// cleartext HTTP/2 with prior knowledge, as gRPC servers inside a cluster usually speak
+	h2cServer := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2cServer.Close()
+
+	tests := []struct {
+		description string
+		service     string
+		wantErr     bool
+	}{
+		{"server is serving", "", false},
+		{"service is not serving", "payments", true},
+		{"unknown service", "search", true},
+		{"call fails after the message", "flaky", true},
+	}
+	for _, tc := range tests {
+		for _, cfg := range []config.CheckCfg{
+			{Type: "grpc", Service: tc.service, TLS: true, CaPath: ca},
+			{Type: "grpc", Service: tc.service},
+		} {
+			address := strings.TrimPrefix(tlsServer.URL, "https://")
+			if !cfg.TLS {
+				address = strings.TrimPrefix(h2cServer.URL, "http://")
+			}
+			c, err := newCheck(cfg, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			err = c.probe.Probe(ctx, address)
+			cancel()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("%s, TLS %v, %v", tc.description, cfg.TLS, err)
+			}
+		}
+	}
+
+	status, err := healthStatus([]byte{0x12, 0x02, 'h', 'i', 0x08, 0x01})
+	if err != nil || status != 1 {
+		t.Errorf("%v, %v != %v", err, status, 1)
+	}
+}
+
+// startSilentUpstream starts an upstream that accepts connections and never replies.
+func startSilentUpstream(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		for _, c := range conns {
+			c.Close()
+		}
+		mu.Unlock()
+	})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestStop(t *testing.T) {
+	silent := startSilentUpstream(t)
+	host, port, _ := net.SplitHostPort(silent)
+	before := runtime.NumGoroutine()
+
+	hc, err := New(config.HealthCheckCfg{
+		HealthCheckInterval: 10 * time.Millisecond,
+		Timeout:             time.Minute,
+		Check:               config.CheckCfg{Send: "ping", Expect: "pong"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreams := []*u.Upstream{{Host: host, Port: port}, {Host: host, Port: port}, {Host: host, Port: port}}
+	hc.Start(upstreams)
+	// let the probes block on the upstream, nobody receiving the reports
+	time.Sleep(100 * time.Millisecond)
+	hc.MarkUnhealthy(upstreams[0], "refused")
+
+	stopped := time.Now()
+	hc.Stop()
+	if took := time.Since(stopped); took > time.Second {
+		t.Errorf("stop took %v", took)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines leaked, %v != %v", after, before)
+	}
+}
+
+// countingProbe blocks for a while and records how many probes run at once.
+type countingProbe struct {
+	running int
+	most    int
+	mu      sync.Mutex
+}
+
+func (p *countingProbe) Probe(ctx context.Context, address string) error {
+	p.mu.Lock()
+	p.running++
+	if p.running > p.most {
+		p.most = p.running
+	}
+	p.mu.Unlock()
+	select {
+	case <-time.After(20 * time.Millisecond):
+	case <-ctx.Done():
+	}
+	p.mu.Lock()
+	p.running--
+	p.mu.Unlock()
+	return nil
+}
+
+func TestMaxConcurrentProbes(t *testing.T) {
+	tests := []struct {
+		description string
+		maxProbes   int
+		// bounds on the most probes seen running at once
+		atLeast int
+		atMost  int
+	}{
+		{description: "bounded", maxProbes: 2, atLeast: 2, atMost: 2},
+		{description: "unbounded", maxProbes: 0, atLeast: 3, atMost: 6},
+	}
+	for _, tc := range tests {
+		hc, err := New(config.HealthCheckCfg{
+			HealthCheckInterval: 10 * time.Millisecond,
+			Timeout:             time.Second,
+			MaxConcurrentProbes: tc.maxProbes,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		probe := &countingProbe{}
+		hc.check = &check{probe: probe, timeout: time.Second, rise: 1, fall: 1}
+		var upstreams []*u.Upstream
+		for i := 0; i < 6; i++ {
+			upstreams = append(upstreams, &u.Upstream{Host: "127.0.0.1", Port: strconv.Itoa(8000 + i)})
+		}
+		hc.Start(upstreams)
+		// drain reports so the checker is never held up by them
+		go func() {
+			for range hc.HealthyUpstreams {
+			}
+		}()
+		time.Sleep(300 * time.Millisecond)
+		hc.Stop()
+		close(hc.HealthyUpstreams)
+
+		probe.mu.Lock()
+		got := probe.most
+		probe.mu.Unlock()
+		if got < tc.atLeast || got > tc.atMost {
+			t.Errorf("%s, %v not in [%v, %v]", tc.description, got, tc.atLeast, tc.atMost)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	hc, err := New(config.HealthCheckCfg{
+		HealthCheckInterval: 5 * time.Millisecond,
+		Timeout:             time.Second,
+		HistorySize:         3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every probe flips the upstream
+	var results []bool
+	for i := 0; i < 1000; i++ {
+		results = append(results, i%2 == 1)
+	}
+	hc.check = &check{probe: &scriptedProbe{results: results}, timeout: time.Second, rise: 1, fall: 1}
+	events, _ := hc.Subscribe(1000)
+	hc.Latencies = latency.New(time.Second)
+	up := &u.Upstream{Host: "127.0.0.1", Port: "8000"}
+	hc.Start([]*u.Upstream{up})
+
+	var got []Event
+	timeout := time.After(3 * time.Second)
+	for len(got) < 5 {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		case <-timeout:
+			t.Fatalf("%v events received", len(got))
+		}
+	}
+	hc.Stop()
+	// the channel is closed once the events sent before stopping are received
+	for e := range events {
+		got = append(got, e)
+	}
+
+	from := Unknown
+	for i, e := range got {
+		want := Unhealthy
+		if i%2 == 1 {
+			want = Healthy
+		}
+		if e.Upstream != "127.0.0.1:8000" || e.From != from || e.To != want || e.Reason == "" || e.Time.IsZero() {
+			t.Errorf("event %d, %+v", i, e)
+		}
+		from = e.To
+	}
+
+	history := hc.History("127.0.0.1:8000")
+	if len(history) != 3 {
+		t.Fatalf("%v != %v", len(history), 3)
+	}
+	for i, e := range history {
+		if want := got[len(got)-3+i]; e != want {
+			t.Errorf("history %d, %+v != %+v", i, e, want)
+		}
+	}
+	if _, found := hc.Histories()["127.0.0.1:8000"]; !found {
+		t.Errorf("history missing from %v", hc.Histories())
+	}
+	// passing probes are timed
+	if _, found := hc.Latencies.Get("127.0.0.1:8000"); !found {
+		t.Errorf("latency of probes not observed")
+	}
+}
+
+// recordingProbe passes every probe and counts the probes of each address.
+type recordingProbe struct {
+	probes map[string]int
+	mu     sync.Mutex
+}
+
+func (p *recordingProbe) Probe(ctx context.Context, address string) error {
+	p.mu.Lock()
+	p.probes[address]++
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *recordingProbe) count(address string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.probes[address]
+}
+
+func TestAddRemove(t *testing.T) {
+	hc, err := New(config.HealthCheckCfg{
+		HealthCheckInterval: 10 * time.Millisecond,
+		Timeout:             time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe := &recordingProbe{probes: make(map[string]int)}
+	hc.check = &check{probe: probe, timeout: time.Second, rise: 1, fall: 1}
+	events, _ := hc.Subscribe(100)
+	a := &u.Upstream{Host: "127.0.0.1", Port: "8000"}
+	b := &u.Upstream{Host: "127.0.0.1", Port: "8001"}
+	hc.Start([]*u.Upstream{a})
+	go func() {
+		for range hc.HealthyUpstreams {
+		}
+	}()
+
+	hc.Add(b)
+	// the added upstream is probed and reported
+	timeout := time.After(3 * time.Second)
+	for seen := false; !seen; {
+		select {
+		case e := <-events:
+			seen = e.Upstream == "127.0.0.1:8001" && e.To == Healthy
+		case <-timeout:
+			t.Fatalf("127.0.0.1:8001 not reported healthy")
+		}
+	}
+
+	hc.Remove(a)
+	// a probe may still be running when the upstream is removed
+	time.Sleep(20 * time.Millisecond)
+	before := probe.count("127.0.0.1:8000")
+	time.Sleep(100 * time.Millisecond)
+	if got := probe.count("127.0.0.1:8000"); got != before {
+		t.Errorf("removed upstream probed, %v != %v", got, before)
+	}
+	if got := probe.count("127.0.0.1:8001"); got < 2 {
+		t.Errorf("added upstream probed %v times", got)
+	}
+	hc.Stop()
+	close(hc.HealthyUpstreams)
+}
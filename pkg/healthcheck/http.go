@@ -0,0 +1,124 @@
+package healthcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"layer4balancer/config"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// HTTPProbe sends an HTTP(S) request and checks the status and, optionally, the body of the response.
+type HTTPProbe struct {
+	client    *http.Client
+	scheme    string
+	method    string
+	path      string
+	body      string
+	statusMin int
+	statusMax int
+	expect    *regexp.Regexp
+}
+
+func NewHTTPProbe(cfg config.CheckCfg) (*HTTPProbe, error) {
+	p := &HTTPProbe{
+		scheme:    "http",
+		method:    cfg.Method,
+		path:      cfg.Path,
+		body:      cfg.Send,
+		statusMin: cfg.StatusMin,
+		statusMax: cfg.StatusMax,
+	}
+	if p.method == "" {
+		p.method = http.MethodGet
+	}
+	if p.path == "" {
+		p.path = "/"
+	}
+	if p.statusMin == 0 {
+		p.statusMin = 200
+	}
+	if p.statusMax == 0 {
+		p.statusMax = 399
+	}
+	if cfg.Expect != "" {
+		re, err := regexp.Compile(cfg.Expect)
+		if err != nil {
+			return nil, err
+		}
+		p.expect = re
+	}
+
+	// every probe opens a new connection, as clients of the load balancer would
+	transport := &http.Transport{DisableKeepAlives: true}
+	if cfg.TLS {
+		tlsConfig, err := probeTlsConfig(cfg.CaPath)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+		p.scheme = "https"
+	}
+	p.client = &http.Client{
+		Transport: transport,
+		// a redirect is an answer of the upstream; its target may be elsewhere
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return p, nil
+}
+
+func (p *HTTPProbe) Probe(ctx context.Context, address string) error {
+	var body io.Reader
+	if p.body != "" {
+		body = strings.NewReader(p.body)
+	}
+	req, err := http.NewRequest(p.method, p.scheme+"://"+address+p.path, body)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < p.statusMin || res.StatusCode > p.statusMax {
+		return fmt.Errorf("status %d not within %d-%d", res.StatusCode, p.statusMin, p.statusMax)
+	}
+	if p.expect == nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxResponse))
+	if err != nil {
+		return err
+	}
+	if !p.expect.Match(data) {
+		return fmt.Errorf("body %q does not match %q", data, p.expect)
+	}
+	return nil
+}
+
+// probeTlsConfig trusts the CA in caPath, or the system roots if caPath is empty.
+func probeTlsConfig(caPath string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caPath == "" {
+		return tlsConfig, nil
+	}
+	pem, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.RootCAs = x509.NewCertPool()
+	if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in " + caPath)
+	}
+	return tlsConfig, nil
+}
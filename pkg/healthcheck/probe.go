@@ -0,0 +1,133 @@
+package healthcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"layer4balancer/config"
+	"net"
+	"regexp"
+	"time"
+)
+
+// maxResponse is how much of a reply probes read looking for the expected data.
+const maxResponse = 4096
+
+// Probe checks once whether the upstream at address is healthy. It gives up when ctx is done.
+type Probe interface {
+	Probe(ctx context.Context, address string) error
+}
+
+// check is a probe with the settings the doctor applies around it.
+type check struct {
+	probe   Probe
+	timeout time.Duration
+	rise    int
+	fall    int
+}
+
+func newCheck(cfg config.CheckCfg, timeout time.Duration) (*check, error) {
+	probe, err := newProbe(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := &check{
+		probe:   probe,
+		timeout: timeout,
+		rise:    cfg.Rise,
+		fall:    cfg.Fall,
+	}
+	if cfg.Timeout > 0 {
+		c.timeout = cfg.Timeout
+	}
+	if c.rise < 1 {
+		c.rise = 1
+	}
+	if c.fall < 1 {
+		c.fall = 1
+	}
+	return c, nil
+}
+
+// closeOnDone bounds the reads and writes on conn by ctx, closing conn when ctx is done
+// since deadlines do not see cancellation. Call the returned func once done with conn.
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-finished:
+		}
+	}()
+	return func() { close(finished) }
+}
+
+func newProbe(cfg config.CheckCfg) (Probe, error) {
+	switch cfg.Type {
+	case "", "tcp":
+		return NewTCPProbe(cfg.Send, cfg.Expect)
+	case "http":
+		return NewHTTPProbe(cfg)
+	case "grpc":
+		return NewGRPCProbe(cfg)
+	default:
+		return nil, errors.New("unknown health check type: " + cfg.Type)
+	}
+}
+
+// TCPProbe connects to the upstream, optionally sends a payload and expects a reply.
+type TCPProbe struct {
+	send   []byte
+	expect *regexp.Regexp
+}
+
+// NewTCPProbe returns a probe that writes send, if not empty, and then reads until the
+// reply matches expect, if not empty.
+func NewTCPProbe(send, expect string) (*TCPProbe, error) {
+	p := &TCPProbe{send: []byte(send)}
+	if expect != "" {
+		re, err := regexp.Compile(expect)
+		if err != nil {
+			return nil, err
+		}
+		p.expect = re
+	}
+	return p, nil
+}
+
+func (p *TCPProbe) Probe(ctx context.Context, address string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+
+	if len(p.send) > 0 {
+		if _, err := conn.Write(p.send); err != nil {
+			return err
+		}
+	}
+	if p.expect == nil {
+		return nil
+	}
+
+	buf := make([]byte, maxResponse)
+	n := 0
+	for n < len(buf) {
+		nRead, err := conn.Read(buf[n:])
+		n += nRead
+		if p.expect.Match(buf[:n]) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reply %q does not match %q: %v", buf[:n], p.expect, err)
+		}
+	}
+	return fmt.Errorf("reply %q does not match %q", buf[:n], p.expect)
+}
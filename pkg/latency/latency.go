@@ -0,0 +1,70 @@
+// latency package keeps a moving average of how long upstreams take to answer
+package latency
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type average struct {
+	value float64
+	at    time.Time
+}
+
+// Tracker keeps a peak exponentially weighted moving average of latency per upstream address:
+// a latency above the average replaces it at once, while lower ones pull it down gradually,
+// an observation weighing less the more recent the average is.
+type Tracker struct {
+	// decay is how long it takes an average to move most of the way to lower latencies
+	decay    time.Duration
+	averages map[string]*average
+	now      func() time.Time
+	mu       sync.Mutex
+}
+
+func New(decay time.Duration) *Tracker {
+	return NewWithClock(decay, time.Now)
+}
+
+// NewWithClock is like New but reads the time from now.
+func NewWithClock(decay time.Duration, now func() time.Time) *Tracker {
+	if decay <= 0 {
+		decay = 10 * time.Second
+	}
+	return &Tracker{
+		decay:    decay,
+		averages: make(map[string]*average),
+		now:      now,
+	}
+}
+
+// Observe counts a latency of the upstream at addr and returns its new average.
+func (t *Tracker) Observe(addr string, latency time.Duration) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	a, found := t.averages[addr]
+	if !found {
+		a = &average{value: float64(latency)}
+		t.averages[addr] = a
+	} else if float64(latency) > a.value {
+		a.value = float64(latency)
+	} else {
+		w := math.Exp(-float64(now.Sub(a.at)) / float64(t.decay))
+		a.value = a.value*w + float64(latency)*(1-w)
+	}
+	a.at = now
+	return time.Duration(a.value)
+}
+
+// Get returns the average latency of the upstream at addr, and whether any was observed.
+func (t *Tracker) Get(addr string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a, found := t.averages[addr]
+	if !found {
+		return 0, false
+	}
+	return time.Duration(a.value), true
+}
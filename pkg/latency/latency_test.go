@@ -0,0 +1,43 @@
+package latency
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	now := time.Unix(0, 0)
+	tracker := NewWithClock(10*time.Second, func() time.Time { return now })
+
+	tests := []struct {
+		description string
+		// time since the previous observation
+		elapsed time.Duration
+		latency time.Duration
+		want    time.Duration
+	}{
+		{description: "first observation", latency: 100 * time.Millisecond, want: 100 * time.Millisecond},
+		{description: "peaks are taken at once", elapsed: time.Second, latency: 300 * time.Millisecond, want: 300 * time.Millisecond},
+		{description: "immediate lower latency weighs nothing", latency: 100 * time.Millisecond, want: 300 * time.Millisecond},
+		{
+			description: "lower latency after one decay",
+			elapsed:     10 * time.Second,
+			latency:     100 * time.Millisecond,
+			want:        time.Duration(100e6 + 200e6*math.Exp(-1)),
+		},
+	}
+	for _, tc := range tests {
+		now = now.Add(tc.elapsed)
+		got := tracker.Observe("127.0.0.1:8000", tc.latency)
+		if diff := got - tc.want; diff < -time.Microsecond || diff > time.Microsecond {
+			t.Errorf("%s, %v != %v", tc.description, got, tc.want)
+		}
+		if avg, found := tracker.Get("127.0.0.1:8000"); !found || avg != got {
+			t.Errorf("%s, %v, %v != %v", tc.description, found, avg, got)
+		}
+	}
+	if _, found := tracker.Get("127.0.0.1:8001"); found {
+		t.Errorf("latency of an upstream never observed")
+	}
+}
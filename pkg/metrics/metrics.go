@@ -0,0 +1,205 @@
+// metrics package provides counters and gauges exported in the Prometheus text format
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Default is the registry the load balancer exports.
+var Default = NewRegistry()
+
+type kind string
+
+const (
+	counterKind kind = "counter"
+	gaugeKind   kind = "gauge"
+)
+
+type Registry struct {
+	families map[string]*family
+	mu       sync.Mutex
+}
+
+// family is a metric and its values, one per combination of label values.
+type family struct {
+	name   string
+	help   string
+	kind   kind
+	labels []string
+	values map[string]*sample
+	mu     sync.Mutex
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	f *family
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	f *family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]*family),
+	}
+}
+
+// Counter returns the counter registered under name, registering it first if needed.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, counterKind, labels)}
+}
+
+// Gauge returns the gauge registered under name, registering it first if needed.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, gaugeKind, labels)}
+}
+
+func (r *Registry) register(name, help string, k kind, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, found := r.families[name]; found {
+		if f.kind != k || len(f.labels) != len(labels) {
+			panic(fmt.Sprintf("metric %s registered twice with different definitions", name))
+		}
+		return f
+	}
+	f := &family{
+		name:   name,
+		help:   help,
+		kind:   k,
+		labels: labels,
+		values: make(map[string]*sample),
+	}
+	r.families[name] = f
+	return f
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.f.add(1, labelValues)
+}
+
+// Add increases the counter. v must not be negative.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+	c.f.add(v, labelValues)
+}
+
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.f.get(labelValues)
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.set(v, labelValues)
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.f.add(v, labelValues)
+}
+
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.f.get(labelValues)
+}
+
+func (f *family) sample(labelValues []string) *sample {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, found := f.values[key]
+	if !found {
+		s = &sample{labelValues: append([]string(nil), labelValues...)}
+		f.values[key] = s
+	}
+	return s
+}
+
+func (f *family) add(v float64, labelValues []string) {
+	f.mu.Lock()
+	f.sample(labelValues).value += v
+	f.mu.Unlock()
+}
+
+func (f *family) set(v float64, labelValues []string) {
+	f.mu.Lock()
+	f.sample(labelValues).value = v
+	f.mu.Unlock()
+}
+
+func (f *family) get(labelValues []string) float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, found := f.values[strings.Join(labelValues, "\xff")]; found {
+		return s.value
+	}
+	return 0
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	var buf bytes.Buffer
+	for _, f := range families {
+		f.writeTo(&buf)
+	}
+	return buf.WriteTo(w)
+}
+
+func (f *family) writeTo(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.values[key]
+		fmt.Fprintf(w, "%s%s %v\n", f.name, formatLabels(f.labels, s.labelValues), s.value)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", names[i], values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// ServeHTTP serves the registry for scraping.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
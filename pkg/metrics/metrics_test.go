@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	denied := r.Counter("denied_total", "Denied connections.", "reason")
+	active := r.Gauge("active", "Active connections.")
+
+	denied.Inc("forbidden")
+	denied.Add(2, "forbidden")
+	denied.Inc("rate_limited")
+	denied.Add(-1, "rate_limited")
+	active.Set(5)
+	active.Add(-2)
+
+	tests := []struct {
+		description string
+		got         float64
+		want        float64
+	}{
+		{"counter adds up", denied.Value("forbidden"), 3},
+		{"counter ignores negative values", denied.Value("rate_limited"), 1},
+		{"unknown label values are zero", denied.Value("no_upstream"), 0},
+		{"gauge goes down", active.Value(), 3},
+		{"registering again returns the same metric", r.Counter("denied_total", "Denied connections.", "reason").Value("forbidden"), 3},
+	}
+	for _, tc := range tests {
+		if tc.got != tc.want {
+			t.Errorf("%s, %v != %v", tc.description, tc.got, tc.want)
+		}
+	}
+
+	want := `# HELP active Active connections.
+# TYPE active gauge
+active 3
+# HELP denied_total Denied connections.
+# TYPE denied_total counter
+denied_total{reason="forbidden"} 3
+denied_total{reason="rate_limited"} 1
+`
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("%q != %q", buf.String(), want)
+	}
+}
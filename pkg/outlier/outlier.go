@@ -0,0 +1,199 @@
+// outlier package ejects upstreams that fail live connections more often than their peers tolerate
+package outlier
+
+import (
+	"layer4balancer/config"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Outcome is how a proxied connection to an upstream went.
+type Outcome int
+
+const (
+	Success Outcome = iota
+	// DialFailure is a connection the upstream did not accept.
+	DialFailure
+	// Reset is a connection the upstream reset.
+	Reset
+	// ShortConnection is a connection the upstream closed within MinConnDuration.
+	ShortConnection
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Success:
+		return "success"
+	case DialFailure:
+		return "dial_failure"
+	case Reset:
+		return "reset"
+	case ShortConnection:
+		return "short_connection"
+	}
+	return "unknown"
+}
+
+// numBuckets is how many buckets the failure window is counted in.
+const numBuckets = 10
+
+type bucket struct {
+	idx    int64
+	total  int
+	failed int
+}
+
+type upstream struct {
+	buckets [numBuckets]bucket
+	// ejectedUntil is when the current or last ejection ends
+	ejectedUntil time.Time
+	// ejections counts the ejections in a row
+	ejections int
+}
+
+// Detector tracks the outcomes of connections per upstream address over a sliding window.
+type Detector struct {
+	cfg       config.OutlierCfg
+	upstreams map[string]*upstream
+	poolSize  int
+	now       func() time.Time
+	mu        sync.Mutex
+}
+
+func New(cfg config.OutlierCfg, poolSize int) *Detector {
+	return NewWithClock(cfg, poolSize, time.Now)
+}
+
+// NewWithClock is like New but reads the time from now.
+func NewWithClock(cfg config.OutlierCfg, poolSize int, now func() time.Time) *Detector {
+	// windows too short to be split into buckets take the default
+	if cfg.FailureWindow < numBuckets {
+		cfg.FailureWindow = 10 * time.Second
+	}
+	return &Detector{
+		cfg:       cfg,
+		upstreams: make(map[string]*upstream),
+		poolSize:  poolSize,
+		now:       now,
+	}
+}
+
+// SetPoolSize changes the number of upstreams MaxEjectionPercent is taken of.
+func (d *Detector) SetPoolSize(n int) {
+	d.mu.Lock()
+	d.poolSize = n
+	d.mu.Unlock()
+}
+
+// Record counts the outcome of a connection to the upstream at addr, and ejects the
+// upstream if it failed too often. It reports whether the upstream was ejected.
+func (d *Detector) Record(addr string, o Outcome) bool {
+	if d.cfg.Failures <= 0 {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	up, found := d.upstreams[addr]
+	if !found {
+		up = &upstream{}
+		d.upstreams[addr] = up
+	}
+	if now.Before(up.ejectedUntil) {
+		// connections opened before the ejection say nothing new
+		return false
+	}
+
+	width := int64(d.cfg.FailureWindow) / numBuckets
+	idx := now.UnixNano() / width
+	b := &up.buckets[idx%numBuckets]
+	if b.idx != idx {
+		*b = bucket{idx: idx}
+	}
+	b.total++
+	if o != Success {
+		b.failed++
+	}
+
+	total, failed := 0, 0
+	for _, b := range up.buckets {
+		if b.idx > idx-numBuckets {
+			total += b.total
+			failed += b.failed
+		}
+	}
+	if failed < d.cfg.Failures || float64(failed) < d.cfg.FailureRatio*float64(total) {
+		return false
+	}
+	if d.ejected(now) >= d.maxEjected() {
+		log.Warn("upstream ", addr, " is failing but too many upstreams are ejected already")
+		return false
+	}
+
+	// an upstream that behaved for a while starts over at the shortest ejection
+	if now.Sub(up.ejectedUntil) > d.forgetAfter(up.ejections) {
+		up.ejections = 0
+	}
+	up.ejections++
+	up.ejectedUntil = now.Add(d.ejectionDuration(up.ejections))
+	up.buckets = [numBuckets]bucket{}
+	log.WithFields(log.Fields{
+		"upstream": addr,
+		"failures": failed,
+		"total":    total,
+		"until":    up.ejectedUntil,
+	}).Warn("upstream ejected")
+	return true
+}
+
+// ejectionDuration returns how long the n-th ejection in a row lasts.
+func (d *Detector) ejectionDuration(n int) time.Duration {
+	t := d.cfg.EjectionDuration
+	for i := 1; i < n && (d.cfg.MaxEjectionDuration <= 0 || t < d.cfg.MaxEjectionDuration); i++ {
+		t *= 2
+	}
+	if d.cfg.MaxEjectionDuration > 0 && t > d.cfg.MaxEjectionDuration {
+		return d.cfg.MaxEjectionDuration
+	}
+	return t
+}
+
+// forgetAfter returns how long an upstream must behave after the n-th ejection in a row
+// for the next one to start over: MaxEjectionDuration, or as long as that ejection if uncapped.
+func (d *Detector) forgetAfter(n int) time.Duration {
+	if d.cfg.MaxEjectionDuration > 0 {
+		return d.cfg.MaxEjectionDuration
+	}
+	return d.ejectionDuration(n)
+}
+
+// maxEjected returns how many upstreams may be ejected at once. One always may be, so that
+// small pools are not spared by rounding down.
+func (d *Detector) maxEjected() int {
+	n := d.poolSize * d.cfg.MaxEjectionPercent / 100
+	if n < 1 && d.cfg.MaxEjectionPercent > 0 {
+		return 1
+	}
+	return n
+}
+
+// Ejected reports whether the upstream at addr is ejected.
+func (d *Detector) Ejected(addr string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	up, found := d.upstreams[addr]
+	return found && d.now().Before(up.ejectedUntil)
+}
+
+func (d *Detector) ejected(now time.Time) int {
+	n := 0
+	for _, up := range d.upstreams {
+		if now.Before(up.ejectedUntil) {
+			n++
+		}
+	}
+	return n
+}
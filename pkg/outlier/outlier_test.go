@@ -0,0 +1,152 @@
+package outlier
+
+import (
+	"layer4balancer/config"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestDetector(t *testing.T) {
+	cfg := config.OutlierCfg{
+		Failures:            3,
+		FailureRatio:        0.5,
+		FailureWindow:       10 * time.Second,
+		EjectionDuration:    time.Minute,
+		MaxEjectionDuration: 3 * time.Minute,
+		MaxEjectionPercent:  50,
+	}
+	clock := &fakeClock{now: time.Date(2022, 8, 3, 10, 0, 0, 0, time.UTC)}
+	d := NewWithClock(cfg, 2, clock.Now)
+	const a = "127.0.0.1:8000"
+
+	tests := []struct {
+		description string
+		advance     time.Duration
+		outcomes    []Outcome
+		want        bool
+	}{
+		{"failures below the threshold", 0, []Outcome{Reset, DialFailure}, false},
+		{"failures below the ratio", 0, []Outcome{Success, Success, Success, Success, ShortConnection}, false},
+		{"failures out of the window are forgotten", 11 * time.Second, []Outcome{Reset, Reset}, false},
+		{"third failure in the window ejects", time.Second, []Outcome{DialFailure}, true},
+		{"still ejected", 59 * time.Second, nil, true},
+		{"ejection over", time.Second, nil, false},
+		{"second ejection", 0, []Outcome{Reset, Reset, Reset}, true},
+		{"second ejection lasts two minutes", 119 * time.Second, nil, true},
+		{"second ejection over", time.Second, nil, false},
+		{"third ejection", 0, []Outcome{Reset, Reset, Reset}, true},
+		{"third ejection is capped at three minutes", 3 * time.Minute, nil, false},
+		{"escalation forgotten", 10 * time.Minute, []Outcome{Reset, Reset, Reset}, true},
+		{"back to a minute", time.Minute, nil, false},
+	}
+	for _, tc := range tests {
+		clock.Advance(tc.advance)
+		for _, o := range tc.outcomes {
+			d.Record(a, o)
+		}
+		if got := d.Ejected(a); got != tc.want {
+			t.Errorf("%s, %v != %v", tc.description, got, tc.want)
+		}
+	}
+}
+
+func TestMaxEjectionPercent(t *testing.T) {
+	cfg := config.OutlierCfg{
+		Failures:           1,
+		FailureWindow:      10 * time.Second,
+		EjectionDuration:   time.Minute,
+		MaxEjectionPercent: 50,
+	}
+	d := New(cfg, 4)
+	addrs := []string{"a:1", "b:1", "c:1", "d:1"}
+	for _, addr := range addrs {
+		d.Record(addr, Reset)
+	}
+	ejected := 0
+	for _, addr := range addrs {
+		if d.Ejected(addr) {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Errorf("%v != %v", ejected, 2)
+	}
+
+	disabled := New(config.OutlierCfg{}, 4)
+	if disabled.Record("a:1", Reset) || disabled.Ejected("a:1") {
+		t.Errorf("ejected with outlier detection disabled")
+	}
+}
+
+func TestUncappedEjections(t *testing.T) {
+	cfg := config.OutlierCfg{
+		Failures:           1,
+		FailureWindow:      10 * time.Second,
+		EjectionDuration:   time.Second,
+		MaxEjectionPercent: 100,
+	}
+	clock := &fakeClock{now: time.Date(2022, 8, 3, 10, 0, 0, 0, time.UTC)}
+	d := NewWithClock(cfg, 2, clock.Now)
+	const a = "127.0.0.1:8000"
+
+	// repeated ejections keep doubling without MaxEjectionDuration
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		if !d.Record(a, Reset) {
+			t.Fatalf("not ejected")
+		}
+		clock.Advance(want - time.Nanosecond)
+		if !d.Ejected(a) {
+			t.Errorf("ejection ended before %v", want)
+		}
+		clock.Advance(time.Nanosecond)
+		if d.Ejected(a) {
+			t.Errorf("ejection lasted over %v", want)
+		}
+	}
+
+	// behaving as long as the last ejection starts over
+	clock.Advance(9 * time.Second)
+	d.Record(a, Reset)
+	clock.Advance(time.Second)
+	if d.Ejected(a) {
+		t.Errorf("escalation not forgotten")
+	}
+}
+
+func TestSmallPools(t *testing.T) {
+	tests := []struct {
+		description   string
+		failureWindow time.Duration
+		percent       int
+		poolSize      int
+		want          bool
+	}{
+		{description: "one upstream at 50%", failureWindow: 10 * time.Second, percent: 50, poolSize: 1, want: true},
+		{description: "no ejections at 0%", failureWindow: 10 * time.Second, percent: 0, poolSize: 1, want: false},
+		{description: "window shorter than its buckets", failureWindow: time.Nanosecond, percent: 100, poolSize: 1, want: true},
+		{description: "no window", failureWindow: 0, percent: 100, poolSize: 1, want: true},
+	}
+	for _, tc := range tests {
+		d := New(config.OutlierCfg{
+			Failures:           1,
+			FailureWindow:      tc.failureWindow,
+			EjectionDuration:   time.Minute,
+			MaxEjectionPercent: tc.percent,
+		}, tc.poolSize)
+		if got := d.Record("a:1", Reset); got != tc.want {
+			t.Errorf("%s, %v != %v", tc.description, got, tc.want)
+		}
+	}
+}
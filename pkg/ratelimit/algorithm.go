@@ -0,0 +1,178 @@
+package ratelimit
+
+import (
+	"errors"
+	"time"
+)
+
+// RateLimiter limits the requests of a single client.
+type RateLimiter interface {
+	// Allow reports whether a request made at now is within the limit, and counts it if so.
+	Allow(now time.Time) bool
+	// SetLimit changes the limit without forgetting the requests already counted.
+	SetLimit(now time.Time, limit Limit)
+}
+
+// Limit is how many requests a client may make.
+type Limit struct {
+	// RatePerSecond is the sustained number of requests per second.
+	RatePerSecond float64
+	// Burst is the most requests a token bucket allows at once.
+	Burst int
+	// Window is the period window limiters count over. They allow
+	// RatePerSecond × Window requests per window.
+	Window time.Duration
+}
+
+// perWindow returns how many requests window limiters allow per window.
+func (l Limit) perWindow() int {
+	return int(l.RatePerSecond * l.window().Seconds())
+}
+
+func (l Limit) window() time.Duration {
+	if l.Window <= 0 {
+		return time.Second
+	}
+	return l.Window
+}
+
+const (
+	TokenBucketAlgorithm      = "token_bucket"
+	FixedWindowAlgorithm      = "fixed_window"
+	SlidingWindowLogAlgorithm = "sliding_window_log"
+)
+
+var algorithms = map[string]func(limit Limit, now time.Time) RateLimiter{
+	TokenBucketAlgorithm:      NewTokenBucket,
+	FixedWindowAlgorithm:      NewFixedWindow,
+	SlidingWindowLogAlgorithm: NewSlidingWindowLog,
+}
+
+// algorithm returns the constructor of the named algorithm, token bucket by default.
+func algorithm(name string) (func(limit Limit, now time.Time) RateLimiter, error) {
+	if name == "" {
+		name = TokenBucketAlgorithm
+	}
+	newLimiter, found := algorithms[name]
+	if !found {
+		return nil, errors.New("unknown rate limit algorithm: " + name)
+	}
+	return newLimiter, nil
+}
+
+// TokenBucket holds up to Burst tokens and refills at RatePerSecond.
+// Every request takes a token.
+type TokenBucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(limit Limit, now time.Time) RateLimiter {
+	return &TokenBucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		last:   now,
+	}
+}
+
+func (b *TokenBucket) Allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *TokenBucket) SetLimit(now time.Time, limit Limit) {
+	b.refill(now)
+	b.limit = limit
+	if b.tokens > float64(limit.Burst) {
+		b.tokens = float64(limit.Burst)
+	}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.limit.RatePerSecond
+		b.last = now
+	}
+	if b.tokens > float64(b.limit.Burst) {
+		b.tokens = float64(b.limit.Burst)
+	}
+}
+
+// FixedWindow counts requests in consecutive windows of Window width,
+// so a client may make up to twice its limit around a window boundary.
+type FixedWindow struct {
+	limit     Limit
+	numReq    int
+	windowIdx int64 // index of the current window since the Unix epoch
+}
+
+func NewFixedWindow(limit Limit, now time.Time) RateLimiter {
+	return &FixedWindow{
+		limit:     limit,
+		windowIdx: now.UnixNano() / int64(limit.window()),
+	}
+}
+
+func (w *FixedWindow) Allow(now time.Time) bool {
+	idx := now.UnixNano() / int64(w.limit.window())
+	if idx != w.windowIdx {
+		w.windowIdx = idx
+		w.numReq = 0
+	}
+	if w.numReq >= w.limit.perWindow() {
+		return false
+	}
+	w.numReq++
+	return true
+}
+
+func (w *FixedWindow) SetLimit(now time.Time, limit Limit) {
+	if limit.window() != w.limit.window() {
+		// windows of another width do not line up; start counting afresh
+		w.windowIdx = now.UnixNano() / int64(limit.window())
+		w.numReq = 0
+	}
+	w.limit = limit
+}
+
+// SlidingWindowLog remembers the time of every allowed request in the last Window,
+// which makes it exact at the cost of memory proportional to the limit.
+type SlidingWindowLog struct {
+	limit Limit
+	log   []time.Time
+}
+
+func NewSlidingWindowLog(limit Limit, now time.Time) RateLimiter {
+	return &SlidingWindowLog{
+		limit: limit,
+	}
+}
+
+func (w *SlidingWindowLog) Allow(now time.Time) bool {
+	w.expire(now)
+	if len(w.log) >= w.limit.perWindow() {
+		return false
+	}
+	w.log = append(w.log, now)
+	return true
+}
+
+func (w *SlidingWindowLog) SetLimit(now time.Time, limit Limit) {
+	w.limit = limit
+	w.expire(now)
+}
+
+// expire forgets requests that fell out of the window.
+func (w *SlidingWindowLog) expire(now time.Time) {
+	start := now.Add(-w.limit.window())
+	i := 0
+	for i < len(w.log) && !w.log[i].After(start) {
+		i++
+	}
+	w.log = append(w.log[:0], w.log[i:]...)
+}
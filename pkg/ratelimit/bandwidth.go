@@ -0,0 +1,142 @@
+package ratelimit
+
+import (
+	"layer4balancer/config"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Throttle paces one direction of a connection. Every limiter it holds must
+// have room for the bytes before they are sent.
+type Throttle struct {
+	limiters []*rate.Limiter
+	// throttled is called with the delay whenever sending has to wait
+	throttled func(delay time.Duration)
+}
+
+// Wait blocks until n bytes may be sent. A nil Throttle never blocks.
+func (t *Throttle) Wait(n int) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	var delay time.Duration
+	for _, l := range t.limiters {
+		r := l.ReserveN(now, n)
+		if !r.OK() {
+			continue
+		}
+		if d := r.DelayFrom(now); d > delay {
+			delay = d
+		}
+	}
+	if delay > 0 {
+		if t.throttled != nil {
+			t.throttled(delay)
+		}
+		time.Sleep(delay)
+	}
+}
+
+// BandwidthLimiter holds token buckets of bytes per client and per upstream, for
+// uploads (client to upstream) and downloads (upstream to client) separately.
+// A bucket is shared by all connections of the same client or upstream and is
+// dropped when the last of them ends.
+type BandwidthLimiter struct {
+	cfg config.BandwidthCfg
+	// largest number of bytes sent at once; buckets are never smaller
+	maxChunk int
+	buckets  map[bucketKey]*bucket
+	mu       sync.Mutex
+}
+
+type bucketKey struct {
+	scope     string // "client" or "upstream"
+	direction string // "upload" or "download"
+	id        string
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+	refs    int
+}
+
+func NewBandwidthLimiter(cfg config.BandwidthCfg, maxChunk int) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		cfg:      cfg,
+		maxChunk: maxChunk,
+		buckets:  make(map[bucketKey]*bucket),
+	}
+}
+
+// Buckets returns the number of buckets held by open connections.
+func (b *BandwidthLimiter) Buckets() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.buckets)
+}
+
+// Acquire returns the throttles for a new connection, nil when a direction is unlimited.
+// throttled is told the direction and delay whenever a throttle makes the connection wait.
+// release must be called when the connection ends.
+func (b *BandwidthLimiter) Acquire(clientId, upstreamAddr string, throttled func(direction string, delay time.Duration)) (upload, download *Throttle, release func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	held := make([]bucketKey, 0, 4)
+	take := func(key bucketKey, bytesPerSecond int) *rate.Limiter {
+		if bytesPerSecond <= 0 {
+			return nil
+		}
+		bk, found := b.buckets[key]
+		if !found {
+			burst := bytesPerSecond
+			if burst < b.maxChunk {
+				burst = b.maxChunk
+			}
+			bk = &bucket{limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), burst)}
+			b.buckets[key] = bk
+		}
+		bk.refs++
+		held = append(held, key)
+		return bk.limiter
+	}
+	throttle := func(direction string, limiters ...*rate.Limiter) *Throttle {
+		t := &Throttle{}
+		for _, l := range limiters {
+			if l != nil {
+				t.limiters = append(t.limiters, l)
+			}
+		}
+		if len(t.limiters) == 0 {
+			return nil
+		}
+		if throttled != nil {
+			t.throttled = func(delay time.Duration) { throttled(direction, delay) }
+		}
+		return t
+	}
+
+	upload = throttle("upload",
+		take(bucketKey{"client", "upload", clientId}, b.cfg.ClientUpload),
+		take(bucketKey{"upstream", "upload", upstreamAddr}, b.cfg.UpstreamUpload))
+	download = throttle("download",
+		take(bucketKey{"client", "download", clientId}, b.cfg.ClientDownload),
+		take(bucketKey{"upstream", "download", upstreamAddr}, b.cfg.UpstreamDownload))
+
+	release = func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for _, key := range held {
+			if bk := b.buckets[key]; bk != nil {
+				bk.refs--
+				if bk.refs <= 0 {
+					delete(b.buckets, key)
+				}
+			}
+		}
+	}
+	return upload, download, release
+}
@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"layer4balancer/config"
+	"sync"
+)
+
+// ConnLimiter caps the number of simultaneous connections per client and in total.
+// A zero limit means unlimited.
+type ConnLimiter struct {
+	maxConns          int
+	maxConnsPerClient int
+	total             int
+	clients           map[string]int
+	mu                sync.Mutex
+}
+
+func NewConnLimiter(cfg config.ConnLimitCfg) *ConnLimiter {
+	return &ConnLimiter{
+		maxConns:          cfg.MaxConns,
+		maxConnsPerClient: cfg.MaxConnsPerClient,
+		clients:           make(map[string]int),
+	}
+}
+
+// Acquire reserves a connection slot for the client. Every successful Acquire must be
+// followed by a Release.
+func (c *ConnLimiter) Acquire(clientId string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.maxConns > 0 && c.total >= c.maxConns {
+		return false
+	}
+	if c.maxConnsPerClient > 0 && c.clients[clientId] >= c.maxConnsPerClient {
+		return false
+	}
+	c.total++
+	c.clients[clientId]++
+	return true
+}
+
+func (c *ConnLimiter) Release(clientId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.total--
+	c.clients[clientId]--
+	if c.clients[clientId] <= 0 {
+		delete(c.clients, clientId)
+	}
+}
+
+// Active returns the number of connections held by the client and in total.
+func (c *ConnLimiter) Active(clientId string) (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clients[clientId], c.total
+}
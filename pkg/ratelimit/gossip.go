@@ -0,0 +1,273 @@
+package ratelimit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxGossipSize is about how large a datagram of counts gets, well below the UDP limit.
+const maxGossipSize = 8 * 1024
+
+// GossipStore shares counts without a central server. Every replica counts locally
+// and sends its counts to its peers every interval, so totals lag by up to an interval.
+// Counts are only taken from the peers, and only if signed with the key when there is one.
+type GossipStore struct {
+	conn     *net.UDPConn
+	peers    []*net.UDPAddr
+	interval time.Duration
+	key      []byte
+	local    map[string]int64
+	remote   map[string]map[string]int64 // peer address to its counts
+	stop     chan struct{}
+	done     sync.WaitGroup
+	mu       sync.Mutex
+}
+
+// gossip is what a replica sends its peers: some of its counts of the current windows.
+// Counts only grow within a window, so a count replaces an older one only if it is higher.
+type gossip struct {
+	Counts map[string]int64
+}
+
+// NewGossipStore listens on bind for the counts of peers. If key is not empty, datagrams
+// are signed with HMAC-SHA256 under it, and unsigned ones are dropped.
+func NewGossipStore(bind string, peers []string, interval time.Duration, key string) (*GossipStore, error) {
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	addr, err := net.ResolveUDPAddr("udp", bind)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	g := &GossipStore{
+		conn:     conn,
+		interval: interval,
+		key:      []byte(key),
+		local:    make(map[string]int64),
+		remote:   make(map[string]map[string]int64),
+		stop:     make(chan struct{}),
+	}
+	if err := g.SetPeers(peers); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	g.done.Add(2)
+	go g.receive()
+	go g.send()
+	return g, nil
+}
+
+// Addr returns the address peers send their counts to.
+func (g *GossipStore) Addr() net.Addr {
+	return g.conn.LocalAddr()
+}
+
+// SetPeers replaces the replicas counts are sent to.
+func (g *GossipStore) SetPeers(peers []string) error {
+	addrs := make([]*net.UDPAddr, 0, len(peers))
+	for _, p := range peers {
+		addr, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+	}
+	g.mu.Lock()
+	g.peers = addrs
+	g.mu.Unlock()
+	return nil
+}
+
+func (g *GossipStore) Add(key string, window time.Duration, now time.Time) (int64, error) {
+	k := windowKey(key, window, now)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.local[k]++
+	count := g.local[k]
+	for _, counts := range g.remote {
+		count += counts[k]
+	}
+	return count, nil
+}
+
+func (g *GossipStore) Close() error {
+	close(g.stop)
+	err := g.conn.Close()
+	g.done.Wait()
+	return err
+}
+
+func (g *GossipStore) send() {
+	defer g.done.Done()
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.broadcast(time.Now())
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+func (g *GossipStore) broadcast(now time.Time) {
+	g.mu.Lock()
+	expire(g.local, now)
+	// split into datagrams of at most about maxGossipSize bytes
+	var chunks []map[string]int64
+	size := maxGossipSize
+	for k, count := range g.local {
+		if size+len(k)+32 > maxGossipSize {
+			chunks = append(chunks, make(map[string]int64))
+			size = 0
+		}
+		chunks[len(chunks)-1][k] = count
+		size += len(k) + 32
+	}
+	peers := g.peers
+	g.mu.Unlock()
+
+	for _, counts := range chunks {
+		msg, err := json.Marshal(gossip{Counts: counts})
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		msg = g.sign(msg)
+		for _, p := range peers {
+			if _, err := g.conn.WriteToUDP(msg, p); err != nil {
+				log.Warnf("gossip to %s failed: %v", p, err)
+			}
+		}
+	}
+}
+
+// sign prepends the MAC of msg, if there is a key.
+func (g *GossipStore) sign(msg []byte) []byte {
+	if len(g.key) == 0 {
+		return msg
+	}
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write(msg)
+	return append(mac.Sum(nil), msg...)
+}
+
+// verify returns the message of a datagram, or false if it is not signed with the key.
+func (g *GossipStore) verify(datagram []byte) ([]byte, bool) {
+	if len(g.key) == 0 {
+		return datagram, true
+	}
+	if len(datagram) < sha256.Size {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write(datagram[sha256.Size:])
+	if !hmac.Equal(mac.Sum(nil), datagram[:sha256.Size]) {
+		return nil, false
+	}
+	return datagram[sha256.Size:], true
+}
+
+// isPeer reports whether addr is one of the peers.
+func (g *GossipStore) isPeer(addr *net.UDPAddr) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, p := range g.peers {
+		if p.IP.Equal(addr.IP) && p.Port == addr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GossipStore) receive() {
+	defer g.done.Done()
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-g.stop:
+				return
+			default:
+				log.Debugf("gossip read failed: %v", err)
+				continue
+			}
+		}
+		if !g.isPeer(from) {
+			log.Debugf("gossip from %s dropped, it is not a peer", from)
+			continue
+		}
+		data, ok := g.verify(buf[:n])
+		if !ok {
+			log.Warnf("gossip from %s dropped, it is not signed with the key", from)
+			continue
+		}
+		var msg gossip
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Debugf("bad gossip from %s: %v", from, err)
+			continue
+		}
+		g.mu.Lock()
+		counts, found := g.remote[from.String()]
+		if !found {
+			counts = make(map[string]int64)
+			g.remote[from.String()] = counts
+		}
+		for k, count := range msg.Counts {
+			if _, _, ok := parseWindowKey(k); !ok {
+				log.Debugf("bad gossip key %q from %s", k, from)
+				continue
+			}
+			if count > counts[k] {
+				counts[k] = count
+			}
+		}
+		expire(counts, time.Now())
+		g.mu.Unlock()
+	}
+}
+
+// expire forgets the counts of windows that ended over a window ago, and malformed keys.
+func expire(counts map[string]int64, now time.Time) {
+	for k := range counts {
+		window, idx, ok := parseWindowKey(k)
+		if !ok || idx < now.UnixNano()/window-1 {
+			delete(counts, k)
+		}
+	}
+}
+
+// parseWindowKey returns the window width and index of a key made by windowKey.
+func parseWindowKey(k string) (window, idx int64, ok bool) {
+	i := strings.LastIndexByte(k, ':')
+	if i <= 0 {
+		return 0, 0, false
+	}
+	j := strings.LastIndexByte(k[:i], ':')
+	if j < 0 {
+		return 0, 0, false
+	}
+	window, err1 := strconv.ParseInt(k[j+1:i], 10, 64)
+	idx, err2 := strconv.ParseInt(k[i+1:], 10, 64)
+	if err1 != nil || err2 != nil || window <= 0 {
+		return 0, 0, false
+	}
+	return window, idx, true
+}
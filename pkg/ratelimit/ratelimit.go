@@ -1,40 +1,135 @@
 package ratelimit
 
 import (
+	"crypto/x509"
+	"errors"
 	"layer4balancer/config"
+	"path"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/time/rate"
 )
 
+// defaultTier names the tier made of the top level limit of RateLimiterCfg.
+const defaultTier = ""
+
+// Identity is what a client is known by when picking its rate limit tier.
+type Identity struct {
+	CommonName         string
+	Organization       []string
+	OrganizationalUnit []string
+}
+
+// NewIdentity returns the identity carried by a client certificate.
+func NewIdentity(cert *x509.Certificate) Identity {
+	return Identity{
+		CommonName:         cert.Subject.CommonName,
+		Organization:       cert.Subject.Organization,
+		OrganizationalUnit: cert.Subject.OrganizationalUnit,
+	}
+}
+
 type client struct {
 	lastSeen    time.Time
-	rateLimiter *rate.Limiter
+	rateLimiter RateLimiter
+	identity    Identity
+	tier        string
 }
 
-type RateLimiter struct {
+// ClientLimiter limits how often each client may connect, with one RateLimiter per client.
+type ClientLimiter struct {
 	clients         map[string]*client
 	stop            chan bool
 	cleanupInterval time.Duration
-	burst           int
-	token           int
-	mu              sync.Mutex
+	newLimiter      func(limit Limit, now time.Time) RateLimiter
+	tiers           map[string]Limit
+	assignments     []config.TierAssignmentCfg
+	defaultTier     string
+	now             func() time.Time
+	store           Store
+	storeDown       bool
+	// the store is not called before storeRetryAt once it failed
+	storeRetryAt time.Time
+	storeRetry   time.Duration
+	mu           sync.Mutex
+}
+
+func New(cfg config.RateLimiterCfg) (*ClientLimiter, error) {
+	return NewWithClock(cfg, time.Now)
 }
 
-func New(cfg config.RateLimiterCfg) *RateLimiter {
+// NewWithClock is like New but reads the time from now.
+func NewWithClock(cfg config.RateLimiterCfg, now func() time.Time) (*ClientLimiter, error) {
 
-	return &RateLimiter{
+	newLimiter, err := algorithm(cfg.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	store, err := newStore(cfg.Store)
+	if err != nil {
+		return nil, err
+	}
+	r := &ClientLimiter{
 		clients:         make(map[string]*client),
 		stop:            make(chan bool),
 		cleanupInterval: cfg.CleanupInterval,
-		burst:           cfg.Burst,
-		token:           cfg.Token,
+		newLimiter:      newLimiter,
+		now:             now,
+		store:           store,
+		storeRetry:      cfg.Store.RetryInterval,
+	}
+	if r.storeRetry <= 0 {
+		r.storeRetry = time.Second
+	}
+	if err := r.Reconfigure(cfg); err != nil {
+		if store != nil {
+			store.Close()
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reconfigure replaces the limits, tiers and assignments. Clients keep what they
+// have consumed, and their limiters take the limits of their new tier from now on.
+// The algorithm and the store cannot be changed.
+func (r *ClientLimiter) Reconfigure(cfg config.RateLimiterCfg) error {
+	tiers := map[string]Limit{defaultTier: {cfg.RatePerSecond, cfg.Burst, cfg.Window}}
+	for _, t := range cfg.Tiers {
+		if t.Name == defaultTier {
+			return errors.New("rate limit tier without a name")
+		}
+		if _, found := tiers[t.Name]; found {
+			return errors.New("duplicate rate limit tier: " + t.Name)
+		}
+		tiers[t.Name] = Limit{t.RatePerSecond, t.Burst, cfg.Window}
+	}
+	for _, a := range cfg.Assignments {
+		if _, found := tiers[a.Tier]; !found {
+			return errors.New("unknown rate limit tier: " + a.Tier)
+		}
+		if _, err := path.Match(a.CommonName, ""); err != nil {
+			return err
+		}
+	}
+	if _, found := tiers[cfg.DefaultTier]; !found {
+		return errors.New("unknown default rate limit tier: " + cfg.DefaultTier)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tiers = tiers
+	r.assignments = cfg.Assignments
+	r.defaultTier = cfg.DefaultTier
+	now := r.now()
+	for _, c := range r.clients {
+		r.assign(c, now)
 	}
+	return nil
 }
 
-func (r *RateLimiter) Start() {
+func (r *ClientLimiter) Start() {
 
 	ticker := time.NewTicker(r.cleanupInterval)
 
@@ -57,31 +152,150 @@ func (r *RateLimiter) Start() {
 	log.Info("rate limiter started!")
 }
 
-func (r *RateLimiter) cleanup() {
+func (r *ClientLimiter) cleanup() {
 	r.mu.Lock()
 
+	now := r.now()
 	for commonName, client := range r.clients {
-		if time.Since(client.lastSeen) > r.cleanupInterval {
+		if now.Sub(client.lastSeen) > r.cleanupInterval {
 			delete(r.clients, commonName)
 		}
 	}
 	r.mu.Unlock()
 }
 
-func (r *RateLimiter) Stop() {
+func (r *ClientLimiter) Stop() {
 	r.stop <- true
+	if r.store != nil {
+		r.store.Close()
+	}
+}
+
+// Allows checks a client known only by its common name.
+func (r *ClientLimiter) Allows(clientId string) bool {
+	return r.AllowsIdentity(Identity{CommonName: clientId})
+}
+
+// AllowsIdentity checks the client against the limit of its tier, counted
+// by the store if there is one and it is reachable. Once the store fails, it is
+// left alone for a retry interval so that admissions do not wait on it.
+func (r *ClientLimiter) AllowsIdentity(id Identity) bool {
+
+	r.mu.Lock()
+	now := r.now()
+	c := r.client(id, now)
+	if r.store == nil || r.storeDown && now.Before(r.storeRetryAt) {
+		defer r.mu.Unlock()
+		return c.rateLimiter.Allow(now)
+	}
+	if r.storeDown {
+		// a single admission tries the store again, the others stay local meanwhile
+		r.storeRetryAt = now.Add(r.storeRetry)
+	}
+	limit := r.tiers[c.tier]
+	r.mu.Unlock()
+
+	// the store may be remote, so it is not called under the lock
+	count, err := r.store.Add(id.CommonName, limit.window(), now)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		if !r.storeDown {
+			log.WithError(err).Warn("rate limit store unreachable, falling back to local limits")
+			r.storeDown = true
+		}
+		r.storeRetryAt = r.now().Add(r.storeRetry)
+		return c.rateLimiter.Allow(now)
+	}
+	if r.storeDown {
+		log.Info("rate limit store reachable again")
+		r.storeDown = false
+	}
+	return count <= int64(limit.perWindow())
 }
 
-func (r *RateLimiter) Allows(clientId string) bool {
+// client returns the state of the client, creating it or updating its tier as needed.
+func (r *ClientLimiter) client(id Identity, now time.Time) *client {
+	c, found := r.clients[id.CommonName]
+	if !found {
+		c = &client{
+			identity: id,
+		}
+		r.clients[id.CommonName] = c
+	}
+	c.lastSeen = now
+	if !found || !sameIdentity(c.identity, id) {
+		c.identity = id
+		r.assign(c, now)
+	}
+	return c
+}
 
+// Tier returns the name of the tier the client is assigned to.
+func (r *ClientLimiter) Tier(id Identity) string {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if _, found := r.clients[clientId]; !found {
-		r.clients[clientId] = &client{
-			time.Now(),
-			rate.NewLimiter(rate.Limit(r.burst), r.token),
+	return r.tierFor(id)
+}
+
+// assign sets the client's limiter to the limit of its tier, keeping what it has consumed.
+func (r *ClientLimiter) assign(c *client, now time.Time) {
+	c.tier = r.tierFor(c.identity)
+	limit := r.tiers[c.tier]
+	if c.rateLimiter == nil {
+		c.rateLimiter = r.newLimiter(limit, now)
+		return
+	}
+	c.rateLimiter.SetLimit(now, limit)
+}
+
+func (r *ClientLimiter) tierFor(id Identity) string {
+	for _, a := range r.assignments {
+		if matches(a, id) {
+			return a.Tier
 		}
 	}
-	return r.clients[clientId].rateLimiter.Allow()
+	return r.defaultTier
+}
 
+func matches(a config.TierAssignmentCfg, id Identity) bool {
+	if a.CommonName != "" {
+		if ok, _ := path.Match(a.CommonName, id.CommonName); !ok {
+			return false
+		}
+	}
+	if a.Organization != "" && !contains(id.Organization, a.Organization) {
+		return false
+	}
+	if a.OrganizationalUnit != "" && !contains(id.OrganizationalUnit, a.OrganizationalUnit) {
+		return false
+	}
+	return true
+}
+
+func sameIdentity(a, b Identity) bool {
+	if a.CommonName != b.CommonName || len(a.Organization) != len(b.Organization) || len(a.OrganizationalUnit) != len(b.OrganizationalUnit) {
+		return false
+	}
+	for i := range a.Organization {
+		if a.Organization[i] != b.Organization[i] {
+			return false
+		}
+	}
+	for i := range a.OrganizationalUnit {
+		if a.OrganizationalUnit[i] != b.OrganizationalUnit[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
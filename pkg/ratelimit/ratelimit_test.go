@@ -1,11 +1,35 @@
 package ratelimit
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
 	"layer4balancer/config"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+// fakeClock is a clock tests move forward by hand.
+type fakeClock struct {
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2022, 8, 3, 10, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
 func TestRateLimit(t *testing.T) {
 
 	tests := []struct {
@@ -18,8 +42,8 @@ func TestRateLimit(t *testing.T) {
 			description: "happy path",
 			config: config.RateLimiterCfg{
 				CleanupInterval: 60 * time.Second,
-				Burst:           2,
-				Token:           1,
+				RatePerSecond:   2,
+				Burst:           1,
 			},
 			clientReqs: []string{
 				"client a",
@@ -33,8 +57,8 @@ func TestRateLimit(t *testing.T) {
 			description: "reject all requests",
 			config: config.RateLimiterCfg{
 				CleanupInterval: 60 * time.Second,
+				RatePerSecond:   0,
 				Burst:           0,
-				Token:           0,
 			},
 			clientReqs: []string{
 				"client a",
@@ -44,10 +68,45 @@ func TestRateLimit(t *testing.T) {
 			},
 			want: []bool{false, false, false, false},
 		},
+		{
+			description: "fixed window",
+			config: config.RateLimiterCfg{
+				CleanupInterval: 60 * time.Second,
+				Algorithm:       FixedWindowAlgorithm,
+				RatePerSecond:   2,
+				Window:          time.Second,
+			},
+			clientReqs: []string{
+				"client a",
+				"client a",
+				"client a",
+				"client b",
+			},
+			want: []bool{true, true, false, true},
+		},
+		{
+			description: "sliding window log",
+			config: config.RateLimiterCfg{
+				CleanupInterval: 60 * time.Second,
+				Algorithm:       SlidingWindowLogAlgorithm,
+				RatePerSecond:   1,
+				Window:          2 * time.Second,
+			},
+			clientReqs: []string{
+				"client a",
+				"client a",
+				"client a",
+				"client b",
+			},
+			want: []bool{true, true, false, true},
+		},
 	}
 
 	for _, tc := range tests {
-		r := New(tc.config)
+		r, err := NewWithClock(tc.config, newFakeClock().Now)
+		if err != nil {
+			t.Fatalf("%s, %v", tc.description, err)
+		}
 
 		for i, req := range tc.clientReqs {
 			got := r.Allows(req)
@@ -57,6 +116,83 @@ func TestRateLimit(t *testing.T) {
 		}
 
 	}
+
+	if _, err := New(config.RateLimiterCfg{Algorithm: "leaky_bucket"}); err == nil {
+		t.Errorf("unknown algorithm accepted")
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	limit := Limit{RatePerSecond: 2, Burst: 2, Window: time.Second}
+
+	tests := []struct {
+		description string
+		newLimiter  func(limit Limit, now time.Time) RateLimiter
+		// request times, relative to the start of a window
+		reqs []time.Duration
+		want []bool
+	}{
+		{
+			description: "token bucket refills continuously",
+			newLimiter:  NewTokenBucket,
+			reqs:        []time.Duration{0, 0, 0, 250 * time.Millisecond, 500 * time.Millisecond, 500 * time.Millisecond},
+			want:        []bool{true, true, false, false, true, false},
+		},
+		{
+			description: "token bucket never holds more than its burst",
+			newLimiter:  NewTokenBucket,
+			reqs:        []time.Duration{0, 10 * time.Second, 10 * time.Second, 10 * time.Second},
+			want:        []bool{true, true, true, false},
+		},
+		{
+			description: "fixed window resets at the window boundary",
+			newLimiter:  NewFixedWindow,
+			reqs:        []time.Duration{900 * time.Millisecond, 950 * time.Millisecond, 999 * time.Millisecond, 1000 * time.Millisecond, 1050 * time.Millisecond, 1100 * time.Millisecond},
+			want:        []bool{true, true, false, true, true, false},
+		},
+		{
+			description: "sliding window log counts the last window",
+			newLimiter:  NewSlidingWindowLog,
+			reqs:        []time.Duration{900 * time.Millisecond, 950 * time.Millisecond, 1000 * time.Millisecond, 1050 * time.Millisecond, 1900 * time.Millisecond, 1950 * time.Millisecond},
+			want:        []bool{true, true, false, false, true, true},
+		},
+	}
+
+	start := time.Unix(1659520800, 0)
+	for _, tc := range tests {
+		l := tc.newLimiter(limit, start)
+		for i, req := range tc.reqs {
+			if got := l.Allow(start.Add(req)); got != tc.want[i] {
+				t.Errorf("%s, request %d at %v: %v != %v", tc.description, i, req, got, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestSetLimit(t *testing.T) {
+	start := time.Unix(1659520800, 0)
+	tests := []struct {
+		description string
+		newLimiter  func(limit Limit, now time.Time) RateLimiter
+		// requests after raising the limit from 2 to 3, with 2 already made
+		want []bool
+	}{
+		{"token bucket keeps its empty bucket", NewTokenBucket, []bool{false}},
+		{"fixed window keeps its count", NewFixedWindow, []bool{true, false}},
+		{"sliding window log keeps its log", NewSlidingWindowLog, []bool{true, false}},
+	}
+
+	for _, tc := range tests {
+		l := tc.newLimiter(Limit{RatePerSecond: 2, Burst: 2, Window: time.Second}, start)
+		l.Allow(start)
+		l.Allow(start)
+		l.SetLimit(start, Limit{RatePerSecond: 3, Burst: 3, Window: time.Second})
+		for i, want := range tc.want {
+			if got := l.Allow(start); got != want {
+				t.Errorf("%s, request %d: %v != %v", tc.description, i, got, want)
+			}
+		}
+	}
 }
 
 func TestCleanup(t *testing.T) {
@@ -71,8 +207,8 @@ func TestCleanup(t *testing.T) {
 			description: "client a got deleted twice and client b got deleted once",
 			config: config.RateLimiterCfg{
 				CleanupInterval: 100 * time.Millisecond,
+				RatePerSecond:   1,
 				Burst:           1,
-				Token:           1,
 			},
 			clientReqs: []string{
 				"client a",
@@ -88,8 +224,8 @@ func TestCleanup(t *testing.T) {
 			description: "no clients got deleted",
 			config: config.RateLimiterCfg{
 				CleanupInterval: 10 * time.Second,
-				Burst:           0,
-				Token:           1,
+				RatePerSecond:   0,
+				Burst:           1,
 			},
 			clientReqs: []string{
 				"client a",
@@ -103,20 +239,626 @@ func TestCleanup(t *testing.T) {
 	}
 
 	for _, tc := range tests {
-		r := New(tc.config)
-		r.Start()
+		clock := newFakeClock()
+		r, err := NewWithClock(tc.config, clock.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
 		for i, req := range tc.clientReqs {
 			r.Allows(req)
-			// prevent data race in test
-			r.mu.Lock()
 			got := len(r.clients)
 			if got != tc.want[i] {
-				r.mu.Unlock()
 				t.Errorf("%s, %v != %v", tc.description, got, tc.want[i])
 			}
-			r.mu.Unlock()
-			time.Sleep(tc.sleep)
+			clock.Advance(tc.sleep)
+			// what the cleanup goroutine does on every tick
+			r.cleanup()
+		}
+	}
+
+	// the cleanup goroutine starts and stops
+	r, _ := New(config.RateLimiterCfg{CleanupInterval: time.Millisecond})
+	r.Start()
+	r.Stop()
+}
+
+func TestConnLimiter(t *testing.T) {
+	tests := []struct {
+		description string
+		config      config.ConnLimitCfg
+		// a client name acquires a slot, "-" followed by a client name releases one
+		ops  []string
+		want []bool
+	}{
+		{
+			description: "per client limit",
+			config: config.ConnLimitCfg{
+				MaxConnsPerClient: 2,
+			},
+			ops:  []string{"client a", "client a", "client a", "client b", "-client a", "client a"},
+			want: []bool{true, true, false, true, true, true},
+		},
+		{
+			description: "global limit",
+			config: config.ConnLimitCfg{
+				MaxConns: 2,
+			},
+			ops:  []string{"client a", "client b", "client c", "-client a", "client c"},
+			want: []bool{true, true, false, true, true},
+		},
+		{
+			description: "unlimited",
+			config:      config.ConnLimitCfg{},
+			ops:         []string{"client a", "client a", "client a"},
+			want:        []bool{true, true, true},
+		},
+	}
+
+	for _, tc := range tests {
+		c := NewConnLimiter(tc.config)
+		for i, op := range tc.ops {
+			got := true
+			if op[0] == '-' {
+				c.Release(op[1:])
+			} else {
+				got = c.Acquire(op)
+			}
+			if got != tc.want[i] {
+				t.Errorf("%s, op %d: %v != %v", tc.description, i, got, tc.want[i])
+			}
 		}
-		r.Stop()
+	}
+
+	c := NewConnLimiter(config.ConnLimitCfg{})
+	c.Acquire("client a")
+	c.Release("client a")
+	if perClient, total := c.Active("client a"); perClient != 0 || total != 0 {
+		t.Errorf("released slots still held: %v, %v", perClient, total)
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	b := NewBandwidthLimiter(config.BandwidthCfg{
+		ClientUpload:   10240,
+		ClientDownload: 0,
+		UpstreamUpload: 1 << 30,
+	}, 1024)
+
+	var throttled []string
+	var delays []time.Duration
+	onThrottle := func(direction string, delay time.Duration) {
+		throttled = append(throttled, direction)
+		delays = append(delays, delay)
+	}
+
+	upload, download, releaseA := b.Acquire("client a", "127.0.0.1:8000", onThrottle)
+	if download != nil {
+		t.Errorf("unlimited download is throttled")
+	}
+	// the second connection of the same client shares its upload bucket
+	upload2, _, releaseB := b.Acquire("client a", "127.0.0.1:8001", onThrottle)
+
+	// the whole burst is available right away
+	upload.Wait(10240)
+	if len(throttled) != 0 {
+		t.Errorf("throttled within burst: %v", delays)
+	}
+	start := time.Now()
+	upload2.Wait(1024)
+	elapsed := time.Since(start)
+	if len(throttled) != 1 || throttled[0] != "upload" {
+		t.Fatalf("expected one upload throttle, got %v", throttled)
+	}
+	if delays[0] < 50*time.Millisecond || delays[0] > 150*time.Millisecond {
+		t.Errorf("delay %v, want about 100ms", delays[0])
+	}
+	if elapsed < delays[0]/2 {
+		t.Errorf("waited %v, less than delay %v", elapsed, delays[0])
+	}
+
+	// a nil throttle never blocks
+	download.Wait(1 << 30)
+
+	releaseA()
+	releaseB()
+	b.mu.Lock()
+	if got := len(b.buckets); got != 0 {
+		t.Errorf("buckets kept after release: %v", got)
+	}
+	b.mu.Unlock()
+}
+
+func TestTiers(t *testing.T) {
+	cfg := config.RateLimiterCfg{
+		CleanupInterval: 60 * time.Second,
+		RatePerSecond:   0,
+		Burst:           1,
+		Tiers: []config.RateLimitTierCfg{
+			{Name: "batch", RatePerSecond: 0, Burst: 2},
+			{Name: "admin", RatePerSecond: 0, Burst: 3},
+		},
+		Assignments: []config.TierAssignmentCfg{
+			{Tier: "batch", CommonName: "batch-*"},
+			{Tier: "admin", OrganizationalUnit: "ops", Organization: "acme"},
+		},
+	}
+
+	tests := []struct {
+		description string
+		identity    Identity
+		wantTier    string
+		want        []bool
+	}{
+		{
+			description: "common name pattern",
+			identity:    Identity{CommonName: "batch-1"},
+			wantTier:    "batch",
+			want:        []bool{true, true, false},
+		},
+		{
+			description: "certificate attributes",
+			identity:    Identity{CommonName: "alice", Organization: []string{"acme"}, OrganizationalUnit: []string{"dev", "ops"}},
+			wantTier:    "admin",
+			want:        []bool{true, true, true, false},
+		},
+		{
+			description: "every attribute of an assignment must match",
+			identity:    Identity{CommonName: "bob", OrganizationalUnit: []string{"ops"}},
+			wantTier:    "",
+			want:        []bool{true, false},
+		},
+	}
+
+	r, err := NewWithClock(cfg, newFakeClock().Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range tests {
+		if got := r.Tier(tc.identity); got != tc.wantTier {
+			t.Errorf("%s, %q != %q", tc.description, got, tc.wantTier)
+		}
+		for i, want := range tc.want {
+			if got := r.AllowsIdentity(tc.identity); got != want {
+				t.Errorf("%s, request %d: %v != %v", tc.description, i, got, want)
+			}
+		}
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	cfg := config.RateLimiterCfg{
+		CleanupInterval: 60 * time.Second,
+		Tiers: []config.RateLimitTierCfg{
+			{Name: "interactive", RatePerSecond: 1, Burst: 2},
+		},
+		DefaultTier: "interactive",
+	}
+	clock := newFakeClock()
+	r, err := NewWithClock(cfg, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Identity{CommonName: "client a"}
+	r.AllowsIdentity(client)
+	r.AllowsIdentity(client)
+	if r.AllowsIdentity(client) {
+		t.Fatalf("burst of 2 allowed a third request")
+	}
+
+	// raising the burst keeps the spent tokens instead of handing out a fresh bucket
+	cfg.Tiers[0].Burst = 3
+	if err := r.Reconfigure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if r.AllowsIdentity(client) {
+		t.Errorf("reconfigure reset the bucket")
+	}
+
+	// moving the client to a new tier changes its rate
+	cfg.Tiers = append(cfg.Tiers, config.RateLimitTierCfg{Name: "admin", RatePerSecond: 1000, Burst: 3})
+	cfg.Assignments = []config.TierAssignmentCfg{{Tier: "admin", CommonName: "client a"}}
+	if err := r.Reconfigure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Tier(client); got != "admin" {
+		t.Errorf("%q != %q", got, "admin")
+	}
+	clock.Advance(10 * time.Millisecond)
+	if !r.AllowsIdentity(client) {
+		t.Errorf("client not refilled at the admin rate")
+	}
+
+	bad := []config.RateLimiterCfg{
+		{Tiers: []config.RateLimitTierCfg{{Name: "a"}, {Name: "a"}}},
+		{Assignments: []config.TierAssignmentCfg{{Tier: "missing"}}},
+		{DefaultTier: "missing"},
+		{Tiers: []config.RateLimitTierCfg{{Name: "a"}}, Assignments: []config.TierAssignmentCfg{{Tier: "a", CommonName: "["}}},
+	}
+	for i, b := range bad {
+		if err := r.Reconfigure(b); err == nil {
+			t.Errorf("bad config %d accepted", i)
+		}
+	}
+	if got := r.Tier(client); got != "admin" {
+		t.Errorf("rejected config was applied: %q", got)
+	}
+}
+
+// respServer is an in-process stand-in for Redis that knows the commands RedisStore sends.
+type respServer struct {
+	listener net.Listener
+	password string
+	counts   map[string]int64
+	conns    []net.Conn
+	mu       sync.Mutex
+}
+
+func startRespServer(t *testing.T, password string) *respServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &respServer{listener: l, password: password, counts: make(map[string]int64)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *respServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server and drops its clients, like an outage.
+func (s *respServer) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *respServer) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	authed := s.password == ""
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		args, _ := reply.([]interface{})
+		if len(args) == 0 {
+			return
+		}
+		cmd, _ := args[0].(string)
+		switch {
+		case strings.EqualFold(cmd, "AUTH") && len(args) == 2:
+			authed = args[1] == s.password
+			if authed {
+				fmt.Fprint(conn, "+OK\r\n")
+			} else {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+			}
+		case !authed:
+			fmt.Fprint(conn, "-NOAUTH Authentication required\r\n")
+		case strings.EqualFold(cmd, "INCR") && len(args) == 2:
+			s.mu.Lock()
+			s.counts[args[1].(string)]++
+			n := s.counts[args[1].(string)]
+			s.mu.Unlock()
+			fmt.Fprintf(conn, ":%d\r\n", n)
+		case strings.EqualFold(cmd, "PEXPIRE") && len(args) == 3:
+			if _, err := strconv.Atoi(args[2].(string)); err != nil {
+				fmt.Fprint(conn, "-ERR value is not an integer\r\n")
+				continue
+			}
+			fmt.Fprint(conn, ":1\r\n")
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command %q\r\n", cmd)
+		}
+	}
+}
+
+func TestSharedStore(t *testing.T) {
+	redis := startRespServer(t, "secret")
+	cfg := config.RateLimiterCfg{
+		CleanupInterval: 60 * time.Second,
+		RatePerSecond:   3,
+		Burst:           1,
+		Window:          time.Second,
+		Store: config.RateLimitStoreCfg{
+			Type:     "redis",
+			Addr:     redis.Addr(),
+			Password: "secret",
+			Timeout:  time.Second,
+		},
+	}
+	clock := newFakeClock()
+	replicas := make([]*ClientLimiter, 2)
+	for i := range replicas {
+		r, err := NewWithClock(cfg, clock.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.store.Close()
+		replicas[i] = r
+	}
+
+	tests := []struct {
+		description string
+		replica     int
+		advance     time.Duration
+		want        bool
+	}{
+		{"first replica", 0, 0, true},
+		{"second replica counts the first one's requests", 1, 0, true},
+		{"burst is ignored by shared windows", 0, 0, true},
+		{"window is shared", 1, 0, false},
+		{"also on the first replica", 0, 0, false},
+		{"next window", 1, time.Second, true},
+	}
+	for _, tc := range tests {
+		clock.Advance(tc.advance)
+		if got := replicas[tc.replica].Allows("client a"); got != tc.want {
+			t.Errorf("%s, %v != %v", tc.description, got, tc.want)
+		}
+	}
+
+	// without the store each replica falls back to its own token bucket of Burst 1
+	redis.Close()
+	clock.Advance(time.Second)
+	for i, r := range replicas {
+		if !r.Allows("client b") {
+			t.Errorf("replica %d did not fall back to local limits", i)
+		}
+		if r.Allows("client b") {
+			t.Errorf("replica %d fallback ignored the local burst", i)
+		}
+	}
+
+	wrongPassword := NewRedisStore(startRespServer(t, "secret").Addr(), "guess", time.Second)
+	if _, err := wrongPassword.Add("client a", time.Second, clock.Now()); err == nil {
+		t.Errorf("wrong password accepted")
+	}
+}
+
+// startSilentServer accepts connections and never replies, like a store that hangs.
+func startSilentServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestStoreDown(t *testing.T) {
+	timeout := 200 * time.Millisecond
+	cfg := config.RateLimiterCfg{
+		CleanupInterval: 60 * time.Second,
+		RatePerSecond:   1000,
+		Burst:           1000,
+		Window:          time.Second,
+		Store: config.RateLimitStoreCfg{
+			Type:          "redis",
+			Addr:          startSilentServer(t),
+			Timeout:       timeout,
+			RetryInterval: time.Second,
+		},
+	}
+	clock := newFakeClock()
+	r, err := NewWithClock(cfg, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.store.Close()
+
+	tests := []struct {
+		description string
+		advance     time.Duration
+		// whether the admission waits on the store
+		wantWait bool
+	}{
+		{description: "store fails", wantWait: true},
+		{description: "local while the store is down", advance: 100 * time.Millisecond},
+		{description: "still local", advance: 500 * time.Millisecond},
+		{description: "store tried again", advance: time.Second, wantWait: true},
+		{description: "local again", advance: 100 * time.Millisecond},
+	}
+	for _, tc := range tests {
+		clock.Advance(tc.advance)
+		start := time.Now()
+		if !r.Allows("client a") {
+			t.Errorf("%s, denied", tc.description)
+		}
+		if waited := time.Since(start) >= timeout/2; waited != tc.wantWait {
+			t.Errorf("%s, waited %v", tc.description, time.Since(start))
+		}
+	}
+
+	// calls to a hung store do not queue behind one another
+	store := NewRedisStore(startSilentServer(t), "", timeout)
+	defer store.Close()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.Add("client a", time.Second, time.Now())
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed >= 2*timeout {
+		t.Errorf("%v >= %v", elapsed, 2*timeout)
+	}
+}
+
+func TestGossipStore(t *testing.T) {
+	stores := make([]*GossipStore, 2)
+	for i := range stores {
+		g, err := NewGossipStore("127.0.0.1:0", nil, 10*time.Millisecond, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer g.Close()
+		stores[i] = g
+	}
+	stores[0].SetPeers([]string{stores[1].Addr().String()})
+	stores[1].SetPeers([]string{stores[0].Addr().String()})
+
+	now := time.Now()
+	stores[0].Add("client a", time.Minute, now)
+	stores[0].Add("client a", time.Minute, now)
+	// far more counts than fit in one datagram
+	for i := 0; i < 5000; i++ {
+		stores[0].Add(fmt.Sprintf("client %d", i), time.Minute, now)
+	}
+
+	// counts reach the peer within a few intervals
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stores[1].mu.Lock()
+		counts := stores[1].remote[stores[0].Addr().String()]
+		seen := counts[windowKey("client a", time.Minute, now)] == 2 && len(counts) == 5001
+		stores[1].mu.Unlock()
+		if seen || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	got, err := stores[1].Add("client a", time.Minute, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 3 {
+		t.Errorf("%v != %v", got, 3)
+	}
+	if got, _ := stores[1].Add("client b", time.Minute, now); got != 1 {
+		t.Errorf("%v != %v", got, 1)
+	}
+	if got, _ := stores[1].Add("client 4999", time.Minute, now); got != 2 {
+		t.Errorf("%v != %v", got, 2)
+	}
+
+	counts := map[string]int64{
+		windowKey("client a", time.Second, now):                     1,
+		windowKey("client a", time.Second, now.Add(-time.Second)):   1,
+		windowKey("client a", time.Second, now.Add(-2*time.Second)): 1,
+	}
+	expire(counts, now)
+	if len(counts) != 2 {
+		t.Errorf("%v != %v", len(counts), 2)
+	}
+}
+
+func TestGossipSenders(t *testing.T) {
+	tests := []struct {
+		description string
+		peer        bool
+		key         string
+		expected    int64
+	}{
+		{description: "peer with the key", peer: true, key: "secret", expected: 2},
+		{description: "peer with another key", peer: true, key: "other", expected: 1},
+		{description: "peer without a key", peer: true, key: "", expected: 1},
+		{description: "stranger with the key", peer: false, key: "secret", expected: 1},
+	}
+	for _, test := range tests {
+		receiver, err := NewGossipStore("127.0.0.1:0", nil, time.Hour, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender, err := NewGossipStore("127.0.0.1:0", []string{receiver.Addr().String()}, 10*time.Millisecond, test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.peer {
+			receiver.SetPeers([]string{sender.Addr().String()})
+		}
+
+		now := time.Now()
+		sender.Add("client a", time.Minute, now)
+		// give the sender plenty of intervals to be heard
+		time.Sleep(200 * time.Millisecond)
+		if got, _ := receiver.Add("client a", time.Minute, now); got != test.expected {
+			t.Errorf("%s, %v != %v", test.description, got, test.expected)
+		}
+		sender.Close()
+		receiver.Close()
+	}
+}
+
+func TestGossipMalformed(t *testing.T) {
+	receiver, err := NewGossipStore("127.0.0.1:0", nil, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	receiver.SetPeers([]string{peer.LocalAddr().String()})
+
+	now := time.Now()
+	valid := windowKey("client a", time.Minute, now)
+	msg, _ := json.Marshal(gossip{Counts: map[string]int64{
+		"nocolon":     5,
+		":":           5,
+		"a:b":         5,
+		"ratelimit:0": 5,
+		"x:0:1":       5,
+		valid:         3,
+	}})
+	if _, err := peer.WriteToUDP(msg, receiver.Addr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the malformed keys are dropped, and the valid one is still counted
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		receiver.mu.Lock()
+		counts := receiver.remote[peer.LocalAddr().String()]
+		seen := counts[valid] == 3
+		size := len(counts)
+		receiver.mu.Unlock()
+		if seen || time.Now().After(deadline) {
+			if size != 1 {
+				t.Errorf("%v != %v", size, 1)
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, _ := receiver.Add("client a", time.Minute, now); got != 4 {
+		t.Errorf("%v != %v", got, 4)
+	}
+
+	counts := map[string]int64{"nocolon": 1, ":": 1, "a:b": 1, valid: 1}
+	expire(counts, now)
+	if len(counts) != 1 {
+		t.Errorf("%v != %v", len(counts), 1)
 	}
 }
@@ -0,0 +1,210 @@
+package ratelimit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxIdleRedisConns is how many connections RedisStore keeps open for later calls.
+const maxIdleRedisConns = 8
+
+// RedisStore keeps shared counts in a server speaking the Redis protocol (RESP).
+// Each window has its own key, which expires once the window is over. Calls run
+// concurrently, each on a connection of its own taken from a small pool.
+type RedisStore struct {
+	addr     string
+	password string
+	timeout  time.Duration
+	idle     []*redisConn
+	closed   bool
+	mu       sync.Mutex
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewRedisStore(addr, password string, timeout time.Duration) *RedisStore {
+	if timeout <= 0 {
+		timeout = 100 * time.Millisecond
+	}
+	return &RedisStore{
+		addr:     addr,
+		password: password,
+		timeout:  timeout,
+	}
+}
+
+func (r *RedisStore) Add(key string, window time.Duration, now time.Time) (int64, error) {
+	k := windowKey(key, window, now)
+	ttl := strconv.FormatInt((2 * window).Milliseconds(), 10)
+
+	// both commands go out in one round trip
+	replies, err := r.do([]string{"INCR", k}, []string{"PEXPIRE", k, ttl})
+	if err != nil {
+		return 0, err
+	}
+	count, ok := replies[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected INCR reply %v", replies[0])
+	}
+	return count, nil
+}
+
+func (r *RedisStore) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for _, c := range r.idle {
+		c.conn.Close()
+	}
+	r.idle = nil
+	return nil
+}
+
+// do sends the commands and reads their replies on a pooled connection, or a new one.
+// The connection is dropped on any error so that later calls start afresh.
+func (r *RedisStore) do(cmds ...[]string) ([]interface{}, error) {
+	c, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := c.roundTrip(r.timeout, cmds)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	r.put(c)
+	return replies, nil
+}
+
+// get takes an idle connection, or dials a new one without holding the lock.
+func (r *RedisStore) get() (*redisConn, error) {
+	r.mu.Lock()
+	if n := len(r.idle); n > 0 {
+		c := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return c, nil
+	}
+	r.mu.Unlock()
+	return r.connect()
+}
+
+// put keeps c for later calls, unless enough connections are idle already.
+func (r *RedisStore) put(c *redisConn) {
+	r.mu.Lock()
+	if r.closed || len(r.idle) >= maxIdleRedisConns {
+		r.mu.Unlock()
+		c.conn.Close()
+		return
+	}
+	r.idle = append(r.idle, c)
+	r.mu.Unlock()
+}
+
+func (r *RedisStore) connect() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", r.addr, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if r.password != "" {
+		if _, err := c.roundTrip(r.timeout, [][]string{{"AUTH", r.password}}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *redisConn) roundTrip(timeout time.Duration, cmds [][]string) ([]interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+
+	w := bufio.NewWriter(c.conn)
+	for _, cmd := range cmds {
+		writeCommand(w, cmd)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		reply, err := readReply(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := reply.(redisError); ok {
+			return nil, e
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// writeCommand encodes a command as a RESP array of bulk strings.
+func writeCommand(w *bufio.Writer, args []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// readReply decodes one RESP value: a string, an int64, a redisError, nil or a []interface{}.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed RESP line")
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return redisError(payload), nil
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unknown RESP type %q", kind)
+	}
+}
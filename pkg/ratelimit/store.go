@@ -0,0 +1,37 @@
+package ratelimit
+
+import (
+	"errors"
+	"layer4balancer/config"
+	"strconv"
+	"time"
+)
+
+// Store counts requests across load balancer replicas, so a client gets the same
+// quota however it spreads its connections over them. Shared counts use fixed windows.
+type Store interface {
+	// Add counts one request for key in the window containing now and returns
+	// the number of requests all replicas counted for key in that window.
+	Add(key string, window time.Duration, now time.Time) (int64, error)
+	Close() error
+}
+
+// newStore returns the store configured by cfg, or nil when limits are local only.
+func newStore(cfg config.RateLimitStoreCfg) (Store, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case "redis":
+		return NewRedisStore(cfg.Addr, cfg.Password, cfg.Timeout), nil
+	case "gossip":
+		return NewGossipStore(cfg.Bind, cfg.Peers, cfg.Interval, cfg.Key)
+	default:
+		return nil, errors.New("unknown rate limit store: " + cfg.Type)
+	}
+}
+
+// windowKey names the counter of key in the window containing now. It ends with the
+// window width and index so counts of finished windows can be told apart.
+func windowKey(key string, window time.Duration, now time.Time) string {
+	return "ratelimit:" + key + ":" + strconv.FormatInt(int64(window), 10) + ":" + strconv.FormatInt(now.UnixNano()/int64(window), 10)
+}
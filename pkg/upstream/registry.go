@@ -0,0 +1,331 @@
+package upstream
+
+import (
+	"errors"
+	"sync"
+)
+
+// ChangeType is what happened to an upstream in the registry.
+type ChangeType int
+
+const (
+	// Added upstreams may take connections.
+	Added ChangeType = iota
+	// Draining upstreams take no new connections.
+	Draining
+	// Drained upstreams are draining and their last connection has ended.
+	Drained
+	// Resumed upstreams stopped draining and take connections again.
+	Resumed
+	// Removed upstreams are gone from the registry. Their connections may still be open.
+	Removed
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case Added:
+		return "added"
+	case Draining:
+		return "draining"
+	case Drained:
+		return "drained"
+	case Resumed:
+		return "resumed"
+	case Removed:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// Change is a change of the upstreams in the registry.
+type Change struct {
+	Type     ChangeType
+	Upstream *Upstream
+}
+
+// ErrExists is returned when adding an upstream whose address is already in the registry.
+var ErrExists = errors.New("upstream already exists")
+
+// Registry holds the upstreams connections may go to, and tells subscribers about changes of them.
+// It is safe for concurrent use.
+type Registry struct {
+	// upstreams in the order they were added, draining ones included
+	upstreams []*Upstream
+	// draining upstreams to remove once drained
+	removing map[*Upstream]bool
+	// draining upstreams whose Drained change was sent, so that it is sent once per drain
+	drained     map[*Upstream]bool
+	subscribers map[*subscriber]bool
+	mu          sync.Mutex
+}
+
+func NewRegistry(upstreams []*Upstream) *Registry {
+	r := &Registry{
+		removing:    make(map[*Upstream]bool),
+		drained:     make(map[*Upstream]bool),
+		subscribers: make(map[*subscriber]bool),
+	}
+	for _, up := range upstreams {
+		r.Add(up)
+	}
+	return r
+}
+
+// Add puts up in the registry. Its address must not be there already.
+func (r *Registry) Add(up *Upstream) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.find(up.Host+":"+up.Port) >= 0 {
+		return ErrExists
+	}
+	r.upstreams = append(r.upstreams, up)
+	r.notify(Change{Type: Added, Upstream: up})
+	return nil
+}
+
+// Remove takes the upstream at addr out of the registry at once, leaving its connections open.
+func (r *Registry) Remove(addr string) (*Upstream, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.find(addr)
+	if i < 0 {
+		return nil, false
+	}
+	up := r.upstreams[i]
+	r.remove(i)
+	return up, true
+}
+
+// Drain stops new connections to the upstream at addr, and removes it once its last connection ends.
+func (r *Registry) Drain(addr string) (*Upstream, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.find(addr)
+	if i < 0 {
+		return nil, false
+	}
+	up := r.upstreams[i]
+	if r.removing[up] {
+		return up, true
+	}
+	r.removing[up] = true
+	r.startDraining(up)
+	if up.ActiveConns() == 0 {
+		r.remove(i)
+	}
+	return up, true
+}
+
+// StartDraining stops new connections to the upstream at addr, leaving it in the registry.
+// Subscribers are told once its last connection ends.
+func (r *Registry) StartDraining(addr string) (*Upstream, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.find(addr)
+	if i < 0 {
+		return nil, false
+	}
+	r.startDraining(r.upstreams[i])
+	return r.upstreams[i], true
+}
+
+// StopDraining lets the upstream at addr take new connections again, unless it is being removed.
+func (r *Registry) StopDraining(addr string) (*Upstream, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.find(addr)
+	if i < 0 || r.removing[r.upstreams[i]] {
+		return nil, false
+	}
+	up := r.upstreams[i]
+	if up.SetDraining(false) {
+		delete(r.drained, up)
+		r.notify(Change{Type: Resumed, Upstream: up})
+	}
+	return up, true
+}
+
+// Get returns the upstream at addr, draining or not.
+func (r *Registry) Get(addr string) (*Upstream, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.find(addr)
+	if i < 0 {
+		return nil, false
+	}
+	return r.upstreams[i], true
+}
+
+// Snapshot returns the upstreams new connections may go to, in the order they were added.
+func (r *Registry) Snapshot() []*Upstream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snapshot := make([]*Upstream, 0, len(r.upstreams))
+	for _, up := range r.upstreams {
+		if !up.Draining() {
+			snapshot = append(snapshot, up)
+		}
+	}
+	return snapshot
+}
+
+// List returns every upstream in the registry, draining ones included, in the order they were added.
+func (r *Registry) List() []*Upstream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Upstream(nil), r.upstreams...)
+}
+
+// Serves reports whether new connections may go to up.
+func (r *Registry) Serves(up *Upstream) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.holds(up) && !up.Draining()
+}
+
+// Acquire counts a new connection to up, unless up started draining or was removed since
+// it was selected, in which case it reports false.
+func (r *Registry) Acquire(up *Upstream) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.holds(up) || up.Draining() {
+		return false
+	}
+	up.AddActiveConns(1)
+	return true
+}
+
+// Release counts the end of a connection to up. Once the last connection of a draining
+// upstream ends, subscribers are told, and up is removed if it is being removed.
+func (r *Registry) Release(up *Upstream) {
+	if up.AddActiveConns(-1) > 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the upstream may have been removed, or another added at its address, since it started draining
+	if !up.Draining() || up.ActiveConns() != 0 || !r.holds(up) {
+		return
+	}
+	r.markDrained(up)
+	if r.removing[up] {
+		r.remove(r.find(up.Host + ":" + up.Port))
+	}
+}
+
+// Subscribe returns a channel receiving every change from now on, in order. Changes are
+// queued rather than dropped for subscribers that fall behind. cancel closes the channel.
+func (r *Registry) Subscribe() (changes <-chan Change, cancel func()) {
+	s := &subscriber{
+		changes: make(chan Change),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	r.mu.Lock()
+	r.subscribers[s] = true
+	r.mu.Unlock()
+	go s.deliver()
+	var once sync.Once
+	return s.changes, func() {
+		once.Do(func() {
+			r.mu.Lock()
+			delete(r.subscribers, s)
+			r.mu.Unlock()
+			close(s.done)
+		})
+	}
+}
+
+// find returns the index of the upstream at addr, or -1. It is called with r.mu held.
+func (r *Registry) find(addr string) int {
+	for i, up := range r.upstreams {
+		if up.Host+":"+up.Port == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// holds reports whether up is in the registry. It is called with r.mu held.
+func (r *Registry) holds(up *Upstream) bool {
+	i := r.find(up.Host + ":" + up.Port)
+	return i >= 0 && r.upstreams[i] == up
+}
+
+// startDraining is called with r.mu held.
+func (r *Registry) startDraining(up *Upstream) {
+	if !up.SetDraining(true) {
+		return
+	}
+	r.notify(Change{Type: Draining, Upstream: up})
+	if up.ActiveConns() == 0 {
+		r.markDrained(up)
+	}
+}
+
+// markDrained tells subscribers that up is drained, unless they were told already. The
+// last Release and startDraining may both see no connections left. It is called with r.mu held.
+func (r *Registry) markDrained(up *Upstream) {
+	if r.drained[up] {
+		return
+	}
+	r.drained[up] = true
+	r.notify(Change{Type: Drained, Upstream: up})
+}
+
+// remove is called with r.mu held.
+func (r *Registry) remove(i int) {
+	up := r.upstreams[i]
+	r.upstreams = append(r.upstreams[:i:i], r.upstreams[i+1:]...)
+	delete(r.removing, up)
+	delete(r.drained, up)
+	r.notify(Change{Type: Removed, Upstream: up})
+}
+
+// notify is called with r.mu held, so that every subscriber sees changes in the same order.
+func (r *Registry) notify(c Change) {
+	for s := range r.subscribers {
+		s.push(c)
+	}
+}
+
+type subscriber struct {
+	changes chan Change
+	queue   []Change
+	wake    chan struct{}
+	done    chan struct{}
+	mu      sync.Mutex
+}
+
+func (s *subscriber) push(c Change) {
+	s.mu.Lock()
+	s.queue = append(s.queue, c)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) deliver() {
+	defer close(s.changes)
+	for {
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+
+		for _, c := range queue {
+			select {
+			case s.changes <- c:
+			case <-s.done:
+				return
+			}
+		}
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -1,10 +1,82 @@
 // upstream package provide APIs to create fake upstreams
 package upstream
 
+import (
+	"sync"
+	"sync/atomic"
+)
+
 type Upstream struct {
-	Host          string
-	Port          string
-	NumActiveConn int
-	IsAlive       bool
-	stop          chan bool
+	Host string
+	Port string
+	// NumActiveConn is read and changed with ActiveConns and AddActiveConns once the upstream is in use.
+	NumActiveConn int64
+	MaxConns      int // max simultaneous connections, zero means unlimited
+	// IsAlive is read and changed with Alive and SetAlive once the upstream is in use.
+	IsAlive bool
+	// IsDraining upstreams take no new connections. It is read and changed with Draining
+	// and SetDraining once the upstream is in use.
+	IsDraining bool
+	// Priority is the tier of the upstream; 0 is the primary, higher tiers are backups.
+	Priority int
+	// Zone is the availability zone the upstream runs in, if known.
+	Zone string
+	// Group is the deployment the upstream belongs to, e.g. "blue", "green" or "canary".
+	Group string
+	stop  chan bool
+	mu    sync.Mutex
+}
+
+// ActiveConns returns the number of connections to the upstream.
+func (u *Upstream) ActiveConns() int64 {
+	return atomic.LoadInt64(&u.NumActiveConn)
+}
+
+// AddActiveConns adds delta to the number of connections to the upstream and returns the new number.
+func (u *Upstream) AddActiveConns(delta int64) int64 {
+	return atomic.AddInt64(&u.NumActiveConn, delta)
+}
+
+// Alive reports whether the upstream is healthy.
+func (u *Upstream) Alive() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.IsAlive
+}
+
+// SetAlive marks the upstream healthy or not, and reports whether that is a change.
+func (u *Upstream) SetAlive(alive bool) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	changed := u.IsAlive != alive
+	u.IsAlive = alive
+	return changed
+}
+
+// Draining reports whether the upstream takes no new connections.
+func (u *Upstream) Draining() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.IsDraining
+}
+
+// SetDraining stops or resumes new connections to the upstream, and reports whether that is a change.
+func (u *Upstream) SetDraining(draining bool) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	changed := u.IsDraining != draining
+	u.IsDraining = draining
+	return changed
+}
+
+// InRotation reports whether the upstream may take new connections: it is alive and not draining.
+func (u *Upstream) InRotation() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.IsAlive && !u.IsDraining
+}
+
+// AtCapacity reports whether the upstream cannot take another connection.
+func (u *Upstream) AtCapacity() bool {
+	return u.MaxConns > 0 && u.ActiveConns() >= int64(u.MaxConns)
 }
@@ -0,0 +1,246 @@
+package upstream
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func addrs(upstreams []*Upstream) []string {
+	var addrs []string
+	for _, up := range upstreams {
+		addrs = append(addrs, up.Host+":"+up.Port)
+	}
+	return addrs
+}
+
+func TestRegistry(t *testing.T) {
+	a := &Upstream{Host: "127.0.0.1", Port: "8000"}
+	b := &Upstream{Host: "127.0.0.1", Port: "8001"}
+	c := &Upstream{Host: "127.0.0.1", Port: "8002"}
+	r := NewRegistry([]*Upstream{a, b})
+	changes, cancel := r.Subscribe()
+
+	if err := r.Add(&Upstream{Host: "127.0.0.1", Port: "8000"}); err != ErrExists {
+		t.Errorf("%v != %v", err, ErrExists)
+	}
+	if err := r.Add(c); err != nil {
+		t.Fatal(err)
+	}
+	// a busy upstream stays until its last connection ends
+	r.Acquire(a)
+	r.Acquire(a)
+	if _, ok := r.Drain("127.0.0.1:8000"); !ok {
+		t.Errorf("127.0.0.1:8000 not found")
+	}
+	if r.Serves(a) {
+		t.Errorf("draining upstream serves")
+	}
+	if _, ok := r.Get("127.0.0.1:8000"); !ok {
+		t.Errorf("draining upstream removed while busy")
+	}
+	r.Release(a)
+	if _, ok := r.Get("127.0.0.1:8000"); !ok {
+		t.Errorf("draining upstream removed while busy")
+	}
+	r.Release(a)
+	if _, ok := r.Get("127.0.0.1:8000"); ok {
+		t.Errorf("drained upstream not removed")
+	}
+	// an idle upstream goes at once
+	r.Drain("127.0.0.1:8002")
+	if _, ok := r.Remove("127.0.0.1:8002"); ok {
+		t.Errorf("drained upstream not removed")
+	}
+	if _, ok := r.Remove("127.0.0.1:8001"); !ok {
+		t.Errorf("127.0.0.1:8001 not found")
+	}
+	if got := len(r.Snapshot()); got != 0 {
+		t.Errorf("%v != %v", got, 0)
+	}
+
+	tests := []struct {
+		description string
+		change      ChangeType
+		addr        string
+	}{
+		{description: "add", change: Added, addr: "127.0.0.1:8002"},
+		{description: "drain busy", change: Draining, addr: "127.0.0.1:8000"},
+		{description: "drained", change: Drained, addr: "127.0.0.1:8000"},
+		{description: "removed once drained", change: Removed, addr: "127.0.0.1:8000"},
+		{description: "drain idle", change: Draining, addr: "127.0.0.1:8002"},
+		{description: "drained at once", change: Drained, addr: "127.0.0.1:8002"},
+		{description: "removed at once", change: Removed, addr: "127.0.0.1:8002"},
+		{description: "remove", change: Removed, addr: "127.0.0.1:8001"},
+	}
+	for _, tc := range tests {
+		select {
+		case got := <-changes:
+			addr := got.Upstream.Host + ":" + got.Upstream.Port
+			if got.Type != tc.change || addr != tc.addr {
+				t.Errorf("%s, %v %v != %v %v", tc.description, got.Type, addr, tc.change, tc.addr)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s, no change received", tc.description)
+		}
+	}
+	cancel()
+	if _, ok := <-changes; ok {
+		t.Errorf("changes not closed")
+	}
+}
+
+func TestRegistrySlowSubscriber(t *testing.T) {
+	r := NewRegistry(nil)
+	changes, cancel := r.Subscribe()
+	defer cancel()
+	// nobody receives while the upstreams are added, yet no change is lost
+	for i := 0; i < 100; i++ {
+		if err := r.Add(&Upstream{Host: "127.0.0.1", Port: strconv.Itoa(9000 + i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		got := <-changes
+		if want := strconv.Itoa(9000 + i); got.Type != Added || got.Upstream.Port != want {
+			t.Errorf("%v %v != %v %v", got.Type, got.Upstream.Port, Added, want)
+		}
+	}
+	if got, want := addrs(r.Snapshot()), 100; len(got) != want || got[0] != "127.0.0.1:9000" {
+		t.Errorf("%v != %v upstreams in order", got, want)
+	}
+}
+
+func TestDrainState(t *testing.T) {
+	a := &Upstream{Host: "127.0.0.1", Port: "8000", IsAlive: true}
+	b := &Upstream{Host: "127.0.0.1", Port: "8001", IsAlive: true}
+	r := NewRegistry([]*Upstream{a, b})
+	changes, cancel := r.Subscribe()
+	defer cancel()
+
+	if !r.Acquire(a) {
+		t.Fatalf("connection to a serving upstream refused")
+	}
+	if _, ok := r.StartDraining("127.0.0.1:8000"); !ok {
+		t.Fatalf("127.0.0.1:8000 not found")
+	}
+	if a.InRotation() || r.Serves(a) {
+		t.Errorf("draining upstream in rotation")
+	}
+	if r.Acquire(a) {
+		t.Errorf("connection to a draining upstream counted")
+	}
+	if got := addrs(r.Snapshot()); len(got) != 1 || got[0] != "127.0.0.1:8001" {
+		t.Errorf("%v != %v", got, []string{"127.0.0.1:8001"})
+	}
+	if got := len(r.List()); got != 2 {
+		t.Errorf("%v != %v", got, 2)
+	}
+	r.Release(a)
+	// drained upstreams stay until they are removed
+	if _, found := r.Get("127.0.0.1:8000"); !found {
+		t.Errorf("drained upstream removed")
+	}
+	r.StopDraining("127.0.0.1:8000")
+	if !r.Acquire(a) {
+		t.Errorf("connection to a resumed upstream refused")
+	}
+	// draining for removal cannot be stopped
+	r.Drain("127.0.0.1:8000")
+	if _, ok := r.StopDraining("127.0.0.1:8000"); ok {
+		t.Errorf("removal stopped")
+	}
+	r.Release(a)
+
+	want := []ChangeType{Draining, Drained, Resumed, Draining, Drained, Removed}
+	for i, w := range want {
+		select {
+		case got := <-changes:
+			if got.Type != w || got.Upstream != a {
+				t.Errorf("change %d, %v %v != %v", i, got.Type, got.Upstream.Port, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("change %d, no change received", i)
+		}
+	}
+}
+
+func TestDrainedOnce(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		a := &Upstream{Host: "127.0.0.1", Port: "8000", IsAlive: true}
+		r := NewRegistry([]*Upstream{a})
+		changes, cancel := r.Subscribe()
+		r.Acquire(a)
+
+		// the last connection ends while the upstream starts draining
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			r.Release(a)
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			if i%2 == 0 {
+				r.StartDraining("127.0.0.1:8000")
+			} else {
+				r.Drain("127.0.0.1:8000")
+			}
+		}()
+		close(start)
+		wg.Wait()
+		// changes arrive in order, so every change of a has arrived by the one of b
+		b := &Upstream{Host: "127.0.0.1", Port: "8001"}
+		r.Add(b)
+
+		drained := 0
+		for c := range changes {
+			if c.Upstream == b {
+				break
+			}
+			if c.Type == Drained {
+				drained++
+			}
+		}
+		cancel()
+		if drained != 1 {
+			t.Fatalf("round %d, %v != %v", i, drained, 1)
+		}
+	}
+
+	// the same, with draining starting right between the last Release counting the
+	// connection out and taking the lock
+	a := &Upstream{Host: "127.0.0.1", Port: "8000", IsAlive: true}
+	r := NewRegistry([]*Upstream{a})
+	changes, cancel := r.Subscribe()
+	defer cancel()
+	r.Acquire(a)
+	r.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		r.Release(a)
+		close(done)
+	}()
+	for a.ActiveConns() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	r.startDraining(a)
+	r.mu.Unlock()
+	<-done
+	r.Add(&Upstream{Host: "127.0.0.1", Port: "8001"})
+
+	var got []ChangeType
+	for c := range changes {
+		if c.Upstream != a {
+			break
+		}
+		got = append(got, c.Type)
+	}
+	if len(got) != 2 || got[0] != Draining || got[1] != Drained {
+		t.Errorf("%v != %v", got, []ChangeType{Draining, Drained})
+	}
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"layer4balancer/config"
+	u "layer4balancer/pkg/upstream"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// serveAdmin serves the admin interface on s.adminBind until the server stops.
+func (s *Server) serveAdmin() error {
+	if s.adminBind == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", s.adminBind)
+	if err != nil {
+		return err
+	}
+	if s.adminTlsConfig != nil {
+		l = tls.NewListener(l, s.adminTlsConfig)
+	}
+	s.adminServer = &http.Server{Handler: s.adminHandler()}
+
+	go func() {
+		if err := s.adminServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error("admin server stopped ", err)
+		}
+	}()
+	log.Info("serving admin interface on ", l.Addr())
+	return nil
+}
+
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bans", s.handleBans)
+	mux.HandleFunc("/split", s.handleSplit)
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/health/events", s.handleHealthEvents)
+	mux.HandleFunc("/upstreams", s.handleUpstreams)
+	mux.HandleFunc("/upstreams/drain", s.handleDrain)
+	return s.requireToken(mux)
+}
+
+// makeAdminTlsConfig returns the TLS config of the admin interface, or nil if it is served
+// in cleartext. Its clients are verified against the admin CA, not the clients' CA.
+func makeAdminTlsConfig(tlsConfig *tls.Config, cfg config.AdminCfg) (*tls.Config, error) {
+	if cfg.CaPath == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(cfg.CaPath)
+	if err != nil {
+		return nil, err
+	}
+	adminTlsConfig := tlsConfig.Clone()
+	adminTlsConfig.ClientCAs = x509.NewCertPool()
+	if !adminTlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in " + cfg.CaPath)
+	}
+	if len(cfg.ClientNames) > 0 {
+		names := make(map[string]bool, len(cfg.ClientNames))
+		for _, name := range cfg.ClientNames {
+			names[name] = true
+		}
+		adminTlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 || !names[state.PeerCertificates[0].Subject.CommonName] {
+				return errors.New("not an admin client")
+			}
+			return nil
+		}
+	}
+	return adminTlsConfig, nil
+}
+
+// requireToken refuses requests that do not carry the admin token, reads included, as
+// bans, health events and upstreams tell about clients and the network.
+func (s *Server) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			http.Error(w, "no admin token is configured", http.StatusForbidden)
+			return
+		}
+		token := r.Header.Get("Authorization")
+		if !strings.HasPrefix(token, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(token[len("Bearer "):]), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// upstreamView is how upstreams are shown on the admin interface.
+type upstreamView struct {
+	Host        string
+	Port        string
+	ActiveConns int64
+	MaxConns    int
+	Alive       bool
+	Draining    bool
+	Priority    int
+	Zone        string
+	Group       string
+}
+
+func newUpstreamView(up *u.Upstream) upstreamView {
+	return upstreamView{
+		Host:        up.Host,
+		Port:        up.Port,
+		ActiveConns: up.ActiveConns(),
+		MaxConns:    up.MaxConns,
+		Alive:       up.Alive(),
+		Draining:    up.Draining(),
+		Priority:    up.Priority,
+		Zone:        up.Zone,
+		Group:       up.Group,
+	}
+}
+
+// handleUpstreams lists the upstreams, draining ones included, on GET, and adds the one in the body
+// on POST, e.g. {"Host": "127.0.0.1", "Port": "8003", "Zone": "zone-a"}. Added upstreams take
+// connections once their health checks pass. DELETE removes the upstream given by the addr
+// parameter, e.g. addr=127.0.0.1:8003, or only drains it with drain=true.
+func (s *Server) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		views := []upstreamView{}
+		for _, up := range s.registry.List() {
+			views = append(views, newUpstreamView(up))
+		}
+		writeJSON(w, views)
+	case http.MethodPost:
+		var view upstreamView
+		if err := json.NewDecoder(r.Body).Decode(&view); err != nil {
+			http.Error(w, "bad upstream: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if view.Host == "" || view.Port == "" {
+			http.Error(w, "bad upstream: host and port are required", http.StatusBadRequest)
+			return
+		}
+		up := &u.Upstream{
+			Host:     view.Host,
+			Port:     view.Port,
+			MaxConns: view.MaxConns,
+			Priority: view.Priority,
+			Zone:     view.Zone,
+			Group:    view.Group,
+		}
+		if err := s.registry.Add(up); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Info("upstream added ", view.Host+":"+view.Port)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		addr := r.URL.Query().Get("addr")
+		var ok bool
+		if r.URL.Query().Get("drain") == "true" {
+			_, ok = s.registry.Drain(addr)
+		} else {
+			_, ok = s.registry.Remove(addr)
+		}
+		if !ok {
+			http.Error(w, "no upstream "+addr, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSplit shows the traffic split on GET, and replaces it with the one in the body on PUT,
+// e.g. {"ActiveGroup": "green", "CanaryGroup": "canary", "CanaryPercent": 5, "CanarySticky": true}.
+func (s *Server) handleSplit(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.split.Get())
+	case http.MethodPut:
+		var cfg config.SplitCfg
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "bad split: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.SetSplit(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, cfg)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleHealth lists the recent changes of health of every upstream, or of the one
+// given by the upstream parameter, e.g. upstream=127.0.0.1:8000.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if addr := r.URL.Query().Get("upstream"); addr != "" {
+		writeJSON(w, s.healthChecker.History(addr))
+		return
+	}
+	writeJSON(w, s.healthChecker.Histories())
+}
+
+// handleHealthEvents streams changes of health as they happen, one JSON object per line,
+// until the client goes away or the server stops.
+func (s *Server) handleHealthEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel := s.healthChecker.Subscribe(64)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handleBans lists bans on GET. DELETE lifts the ban of the client given by
+// the key parameter, e.g. key=cn:client.a or key=ip:10.0.0.1, or every ban without it.
+func (s *Server) handleBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.bans.List())
+	case http.MethodDelete:
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			s.bans.ClearAll()
+			log.Info("all bans lifted")
+		} else if s.bans.Clear(key) {
+			log.Info("ban lifted ", key)
+		} else {
+			http.Error(w, "no ban for "+key, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDrain shows on GET whether the upstream given by the addr parameter, e.g.
+// addr=127.0.0.1:8000, is draining and how many connections it has left. PUT stops new
+// connections to it, and DELETE lets it take them again.
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	addr := r.URL.Query().Get("addr")
+	var up *u.Upstream
+	var ok bool
+	switch r.Method {
+	case http.MethodGet:
+		up, ok = s.registry.Get(addr)
+	case http.MethodPut:
+		up, ok = s.registry.StartDraining(addr)
+	case http.MethodDelete:
+		up, ok = s.registry.StopDraining(addr)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ok {
+		http.Error(w, "no upstream "+addr+" to drain", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, newUpstreamView(up))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("failed to write admin response ", err)
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"layer4balancer/pkg/ban"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DenialReason explains why a client connection was not proxied.
+type DenialReason string
+
+const (
+	DeniedNoCertificate DenialReason = "no_certificate"
+	DeniedRateLimited   DenialReason = "rate_limited"
+	DeniedTooManyConns  DenialReason = "too_many_connections"
+	DeniedForbidden     DenialReason = "forbidden"
+	DeniedNoUpstream    DenialReason = "no_upstream"
+	DeniedUpstreamsFull DenialReason = "upstreams_full"
+	DeniedBanned        DenialReason = "banned"
+)
+
+// Denial records a client connection that was refused.
+type Denial struct {
+	Reason     DenialReason
+	ClientId   string
+	SourceAddr string
+	Time       time.Time
+}
+
+func (d *Denial) Error() string {
+	return fmt.Sprintf("client %q from %s denied: %s", d.ClientId, d.SourceAddr, d.Reason)
+}
+
+// verifyConnection returns a tls.Config.VerifyConnection callback that runs the admission
+// stages during the handshake, so refused clients receive a TLS alert instead of a silent close.
+// crypto/tls reports callback errors with a bad_certificate alert; it cannot send access_denied,
+// so the reason itself is only told by tellDenial, after the handshake.
+func (s *Server) verifyConnection(c *connection) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		return s.admit(c, state)
+	}
+}
+
+// tellDenial sends a client refused after the handshake the reason, if denial messages are on.
+func (s *Server) tellDenial(c *connection) {
+	if !s.denialMessage || c.denial == nil {
+		return
+	}
+	c.tlsConn.SetWriteDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(c.tlsConn, "denied: %s\n", c.denial.Reason)
+}
+
+// deny records why the connection is refused.
+func (s *Server) deny(c *connection, reason DenialReason) *Denial {
+	d := &Denial{
+		Reason:   reason,
+		ClientId: c.conn.CommonName,
+		Time:     time.Now(),
+	}
+	if c.conn.SourceAddr != nil {
+		d.SourceAddr = c.conn.SourceAddr.String()
+	}
+	c.denial = d
+
+	s.countDenial(reason)
+
+	log.WithFields(log.Fields{
+		"client": d.ClientId,
+		"source": d.SourceAddr,
+		"reason": d.Reason,
+	}).Info("client connection denied")
+	return d
+}
+
+func (s *Server) countDenial(reason DenialReason) {
+	s.denialsMu.Lock()
+	s.denials[reason]++
+	s.denialsMu.Unlock()
+	deniedTotal.Inc(string(reason))
+}
+
+// rejectBanned closes a connection from a banned address before its TLS handshake.
+func (s *Server) rejectBanned(conn net.Conn) {
+	s.countDenial(DeniedBanned)
+	log.WithFields(log.Fields{
+		"source": conn.RemoteAddr().String(),
+		"reason": DeniedBanned,
+	}).Info("client connection denied")
+	conn.Close()
+}
+
+// strike counts misbehaviour against the client's common name, if known, and its source IP.
+func (s *Server) strike(clientId string, addr net.Addr) {
+	if clientId != "" {
+		s.bans.Strike(ban.CommonName(clientId))
+	}
+	if addr != nil {
+		s.bans.Strike(ban.SourceIP(addr))
+	}
+}
+
+// DenialCount returns how many client connections were refused for the reason.
+func (s *Server) DenialCount(reason DenialReason) int {
+	s.denialsMu.Lock()
+	defer s.denialsMu.Unlock()
+	return s.denials[reason]
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"layer4balancer/pkg/metrics"
+	"net"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	deniedTotal = metrics.Default.Counter("lb_denied_connections_total",
+		"Client connections refused, by reason.", "reason")
+	throttledTotal = metrics.Default.Counter("lb_bandwidth_throttled_total",
+		"Times a connection had to wait for its bandwidth limit.", "client", "upstream", "direction")
+	throttledSeconds = metrics.Default.Counter("lb_bandwidth_throttled_seconds_total",
+		"Time connections spent waiting for their bandwidth limit.", "client", "upstream", "direction")
+	upstreamFailuresTotal = metrics.Default.Counter("lb_upstream_failures_total",
+		"Proxied connections that failed on the upstream's side, by outcome.", "upstream", "outcome")
+	ejectionsTotal = metrics.Default.Counter("lb_outlier_ejections_total",
+		"Times an upstream was ejected for failing live connections.", "upstream")
+	circuitState = metrics.Default.Gauge("lb_circuit_state",
+		"State of the circuit of an upstream: 0 closed, 1 open, 2 half open.", "upstream")
+	circuitTransitionsTotal = metrics.Default.Counter("lb_circuit_transitions_total",
+		"Changes of state of the circuit of an upstream.", "upstream", "from", "to")
+	latencySeconds = metrics.Default.Gauge("lb_upstream_latency_seconds",
+		"Peak moving average of the dial and health check latency of an upstream.", "upstream")
+	mirrorFailuresTotal = metrics.Default.Counter("lb_mirror_failures_total",
+		"Connections that stopped being mirrored to the shadow upstream, by reason.", "reason")
+	healthState = metrics.Default.Gauge("lb_upstream_health",
+		"Health of an upstream: 0 unknown, 1 healthy, 2 unhealthy.", "upstream")
+	healthTransitionsTotal = metrics.Default.Counter("lb_health_transitions_total",
+		"Changes of health of an upstream.", "upstream", "from", "to")
+	drainState = metrics.Default.Gauge("lb_upstream_drain_state",
+		"Draining of an upstream: 0 serving, 1 draining, 2 drained, i.e. draining without connections.", "upstream")
+	healthProbeSeconds = metrics.Default.Gauge("lb_health_probe_latency_seconds",
+		"Latency of the probe that last changed the health of an upstream.", "upstream")
+)
+
+const (
+	drainStateServing  = 0
+	drainStateDraining = 1
+	drainStateDrained  = 2
+)
+
+// serveMetrics serves metrics.Default on s.metricsBind until the server stops.
+func (s *Server) serveMetrics() error {
+	if s.metricsBind == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", s.metricsBind)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+	s.metricsServer = &http.Server{Handler: mux}
+
+	go func() {
+		if err := s.metricsServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error("metrics server stopped ", err)
+		}
+	}()
+	log.Info("serving metrics on ", l.Addr())
+	return nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mirror copies what a client sends to the shadow upstream and discards the replies.
+// It never holds up the client: once the shadow falls behind by more than its queue,
+// fails or cannot be reached, the connection stops being mirrored.
+type mirror struct {
+	addr    string
+	timeout time.Duration
+	queue   chan []byte
+	done    chan struct{}
+	// failed is set once the connection stops being mirrored
+	failed bool
+	closed bool
+	mu     sync.Mutex
+}
+
+// mirrorConn starts mirroring the connection for its share of connections.
+func (s *Server) mirrorConn(c *connection) error {
+	if s.mirrorCfg.MirrorAddr == "" || rand.Float64()*100 >= s.mirrorCfg.MirrorPercent {
+		return nil
+	}
+	queue := s.mirrorCfg.MirrorQueue
+	if queue <= 0 {
+		queue = 64
+	}
+	m := &mirror{
+		addr:    s.mirrorCfg.MirrorAddr,
+		timeout: s.timeout,
+		queue:   make(chan []byte, queue),
+		done:    make(chan struct{}),
+	}
+	go m.run()
+	c.mirror = m
+	c.onRelease(m.Close)
+	return nil
+}
+
+// Write queues a copy of p for the shadow upstream, or drops the mirror if the queue is full.
+// It never blocks and never fails.
+func (m *mirror) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failed || m.closed {
+		return len(p), nil
+	}
+	select {
+	case m.queue <- append([]byte(nil), p...):
+	default:
+		m.fail("overflow", nil)
+	}
+	return len(p), nil
+}
+
+// Close ends the mirrored stream once the queued data is sent, without waiting for it.
+func (m *mirror) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+}
+
+// fail stops mirroring. It is called with m.mu held.
+func (m *mirror) fail(reason string, err error) {
+	if m.failed {
+		return
+	}
+	m.failed = true
+	close(m.done)
+	mirrorFailuresTotal.Inc(reason)
+	log.Debug("stopped mirroring to ", m.addr, ": ", reason, " ", err)
+}
+
+func (m *mirror) run() {
+	conn, err := net.DialTimeout("tcp", m.addr, m.timeout)
+	if err != nil {
+		m.mu.Lock()
+		m.fail("dial", err)
+		m.mu.Unlock()
+		return
+	}
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, conn)
+
+	for {
+		select {
+		case data, ok := <-m.queue:
+			if !ok {
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(m.timeout))
+			if _, err := conn.Write(data); err != nil {
+				m.mu.Lock()
+				m.fail("write", err)
+				m.mu.Unlock()
+				return
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
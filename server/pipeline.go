@@ -0,0 +1,243 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"layer4balancer/pkg/authz"
+	"layer4balancer/pkg/balance"
+	"layer4balancer/pkg/ban"
+	"layer4balancer/pkg/outlier"
+	"layer4balancer/pkg/ratelimit"
+	u "layer4balancer/pkg/upstream"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// connection carries one client connection through the pipeline
+//
+//	identify (and ban check) → rate limit → conn limit → authz → select → dial → mirror → throttle
+//
+// Every stage that reserves a resource registers how to release it,
+// and all releases run, in reverse order, when the connection ends.
+type connection struct {
+	tlsConn *tls.Conn
+	state   tls.ConnectionState
+	conn    *authz.ConnContext
+	// upstreams the client is authorized to reach
+	allowed      []*u.Upstream
+	upstream     *u.Upstream
+	upstreamConn net.Conn
+	// mirror, if not nil, gets a copy of what the client sends
+	mirror   *mirror
+	upload   *ratelimit.Throttle
+	download *ratelimit.Throttle
+	// how the connection went from the upstream's side
+	outcome  outlier.Outcome
+	denial   *Denial
+	admitted bool
+	releases []func()
+}
+
+type stage struct {
+	name string
+	run  func(s *Server, c *connection) error
+}
+
+// admissionStages decide whether the client may connect at all. They run before any
+// upstream is touched, during the TLS handshake when TLS alerts are enabled.
+var admissionStages = []stage{
+	{"identify", (*Server).identify},
+	{"rate limit", (*Server).rateLimit},
+	{"conn limit", (*Server).connLimit},
+	{"authz", (*Server).authorize},
+}
+
+// connectStages reserve an upstream for an admitted client and connect to it.
+var connectStages = []stage{
+	{"select", (*Server).selectUpstream},
+	{"dial", (*Server).dial},
+	{"mirror", (*Server).mirrorConn},
+	{"throttle", (*Server).throttle},
+}
+
+var errServerStopped = errors.New("server stopped")
+
+// runStages runs stages in order and stops at the first failure.
+func (s *Server) runStages(c *connection, stages []stage) error {
+	for _, st := range stages {
+		if err := st.run(s, c); err != nil {
+			log.Debug("pipeline stopped at ", st.name, ": ", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// admit runs the admission stages at most once per connection.
+func (s *Server) admit(c *connection, state tls.ConnectionState) error {
+	if c.admitted {
+		if c.denial != nil {
+			return c.denial
+		}
+		return nil
+	}
+	c.admitted = true
+	c.state = state
+	return s.runStages(c, admissionStages)
+}
+
+// onRelease registers a function undoing a reservation made by a stage.
+func (c *connection) onRelease(release func()) {
+	c.releases = append(c.releases, release)
+}
+
+// release undoes every reservation made for the connection.
+func (c *connection) release() {
+	for i := len(c.releases) - 1; i >= 0; i-- {
+		c.releases[i]()
+	}
+	c.releases = nil
+}
+
+func (s *Server) identify(c *connection) error {
+	c.conn = &authz.ConnContext{
+		SourceAddr: c.tlsConn.RemoteAddr(),
+		TLS:        &c.state,
+	}
+	if len(c.state.PeerCertificates) == 0 {
+		return s.deny(c, DeniedNoCertificate)
+	}
+	c.conn.CommonName = c.state.PeerCertificates[0].Subject.CommonName
+	if s.bans.Banned(ban.CommonName(c.conn.CommonName)) {
+		return s.deny(c, DeniedBanned)
+	}
+	return nil
+}
+
+func (s *Server) rateLimit(c *connection) error {
+	if s.rateLimiter.AllowsIdentity(ratelimit.NewIdentity(c.state.PeerCertificates[0])) == false {
+		s.strike(c.conn.CommonName, c.conn.SourceAddr)
+		return s.deny(c, DeniedRateLimited)
+	}
+	return nil
+}
+
+// connLimit reserves one of the client's and the server's simultaneous connection slots.
+func (s *Server) connLimit(c *connection) error {
+	clientId := c.conn.CommonName
+	if s.connLimiter.Acquire(clientId) == false {
+		return s.deny(c, DeniedTooManyConns)
+	}
+	c.onRelease(func() {
+		s.connLimiter.Release(clientId)
+	})
+	return nil
+}
+
+func (s *Server) authorize(c *connection) error {
+	c.allowed = s.authz.Filter(c.conn, s.registry.Snapshot())
+	if len(c.allowed) == 0 {
+		return s.deny(c, DeniedForbidden)
+	}
+	return nil
+}
+
+// selectUpstream asks the server loop for an upstream. The loop counts the connection
+// against the upstream, and is told when it is given back so that queued requests may take it.
+// When every upstream is at MaxConns the loop queues the request for up to the queue timeout.
+func (s *Server) selectUpstream(c *connection) error {
+	req := &selectUpstreamReq{
+		res:       make(chan selectUpstreamRes, 1),
+		clientId:  c.conn.CommonName,
+		upstreams: c.allowed,
+	}
+	select {
+	case s.loadBalancingReq <- req:
+	case <-s.done:
+		return errServerStopped
+	}
+
+	var res selectUpstreamRes
+	if s.queueTimeout > 0 {
+		timer := time.NewTimer(s.queueTimeout)
+		defer timer.Stop()
+		select {
+		case res = <-req.res:
+		case <-timer.C:
+			select {
+			case s.cancelBalancingReq <- req:
+			case <-s.done:
+				return errServerStopped
+			}
+			// the loop may have served the request before it was cancelled
+			select {
+			case res = <-req.res:
+			default:
+				res.err = balance.ErrNoCapacity
+			}
+		case <-s.done:
+			return errServerStopped
+		}
+	} else {
+		res = <-req.res
+	}
+
+	if res.err != nil {
+		if res.err == balance.ErrNoCapacity {
+			s.deny(c, DeniedUpstreamsFull)
+		} else {
+			s.deny(c, DeniedNoUpstream)
+		}
+		return res.err
+	}
+	upstream := res.upstream
+	c.upstream = upstream
+	c.onRelease(func() {
+		s.registry.Release(upstream)
+		select {
+		case s.releaseUpstreamReq <- upstream:
+		case <-s.done:
+		}
+	})
+	c.onRelease(func() {
+		s.recordOutcome(upstream.Host+":"+upstream.Port, c.outcome)
+	})
+	return nil
+}
+
+func (s *Server) dial(c *connection) error {
+	upstreamAddr := c.upstream.Host + ":" + c.upstream.Port
+	log.Info("Balancer: ", "select upstream ", upstreamAddr)
+
+	started := time.Now()
+	upstreamConn, err := net.DialTimeout("tcp", upstreamAddr, s.timeout)
+	// if attemp to connect to the upstream fails, tell the health checker it is unhealthy
+	if err != nil {
+		log.Info("find an unhealthy upstream during regular LB operation", upstreamAddr)
+		c.outcome = outlier.DialFailure
+		s.healthChecker.MarkUnhealthy(c.upstream, err.Error())
+		return err
+	}
+	latencySeconds.Set(s.latencies.Observe(upstreamAddr, time.Since(started)).Seconds(), upstreamAddr)
+	c.upstreamConn = upstreamConn
+	c.onRelease(func() {
+		upstreamConn.Close()
+	})
+	return nil
+}
+
+// throttle takes the client's and the upstream's bandwidth buckets.
+func (s *Server) throttle(c *connection) error {
+	clientId := c.conn.CommonName
+	upstreamAddr := c.upstream.Host + ":" + c.upstream.Port
+	throttled := func(direction string, delay time.Duration) {
+		throttledTotal.Inc(clientId, upstreamAddr, direction)
+		throttledSeconds.Add(delay.Seconds(), clientId, upstreamAddr, direction)
+	}
+	var release func()
+	c.upload, c.download, release = s.bandwidthLimiter.Acquire(clientId, upstreamAddr, throttled)
+	c.onRelease(release)
+	return nil
+}
@@ -3,17 +3,25 @@ package server
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"layer4balancer/config"
 	"layer4balancer/pkg/authz"
 	"layer4balancer/pkg/balance"
+	"layer4balancer/pkg/ban"
+	"layer4balancer/pkg/breaker"
+	"layer4balancer/pkg/discovery"
 	"layer4balancer/pkg/healthcheck"
+	"layer4balancer/pkg/latency"
+	"layer4balancer/pkg/outlier"
 	"layer4balancer/pkg/ratelimit"
 	u "layer4balancer/pkg/upstream"
 	"net"
+	"net/http"
 	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -25,24 +33,58 @@ const (
 )
 
 type Server struct {
-	listener         net.Listener
-	upstreams        []*u.Upstream
-	connectReq       chan *tls.Conn
-	disconnectReq    chan net.Conn
-	loadBalancingReq chan selectUpstreamReq
+	listener           net.Listener
+	registry           *u.Registry
+	connectReq         chan *connection
+	releaseUpstreamReq chan *u.Upstream
+	loadBalancingReq   chan *selectUpstreamReq
+	cancelBalancingReq chan *selectUpstreamReq
+	// requests waiting for an upstream below MaxConns, oldest first
+	pending          []*selectUpstreamReq
+	queueTimeout     time.Duration
 	tlsConfig        *tls.Config
-	rateLimiter      *ratelimit.RateLimiter
+	rateLimiter      *ratelimit.ClientLimiter
+	connLimiter      *ratelimit.ConnLimiter
+	bandwidthLimiter *ratelimit.BandwidthLimiter
+	authz            authz.AuthzScheme
+	bans             *ban.PenaltyBox
 	balancer         balance.LoadBalancer
 	healthChecker    *healthcheck.HealthChecker
+	outliers         *outlier.Detector
+	breakers         *breaker.Set
+	slowStart        *balance.SlowStart
+	latencies        *latency.Tracker
+	split            *balance.SplitBalancer
+	mirrorCfg        config.MirrorCfg
+	discovery        []*discovery.Poller
+	minConnDuration  time.Duration
 	timeout          time.Duration
 	bind             string
 	clientsConn      map[string]net.Conn
+	tlsAlert         bool
+	denialMessage    bool
+	denials          map[DenialReason]int
+	denialsMu        sync.Mutex
+	metricsBind      string
+	metricsServer    *http.Server
+	adminBind        string
+	adminToken       string
+	adminTlsConfig   *tls.Config
+	adminServer      *http.Server
 	stop             chan bool
+	// closed when the server loop exits
+	done chan struct{}
 }
 
 type selectUpstreamReq struct {
-	res      chan *u.Upstream
-	clientId string
+	res       chan selectUpstreamRes
+	clientId  string
+	upstreams []*u.Upstream
+}
+
+type selectUpstreamRes struct {
+	upstream *u.Upstream
+	err      error
 }
 
 func New(cfg config.ServerCfg) (*Server, error) {
@@ -56,30 +98,99 @@ func New(cfg config.ServerCfg) (*Server, error) {
 	cfg.TlsCfg.CaCertPool = x509.NewCertPool()
 	cfg.TlsCfg.CaCertPool.AppendCertsFromPEM(caCertFile)
 
+	rateLimiter, err := ratelimit.New(cfg.RateLimiterCfg)
+	if err != nil {
+		log.Error("failed to create new rate limiter", err)
+		return nil, err
+	}
+
 	authzScheme, err := authz.New(cfg.AuthzCfg)
 	if err != nil {
 		log.Error("failed to create new Authz scheme", err)
 		return nil, err
 	}
 
+	healthChecker, err := healthcheck.New(cfg.HealthCheckCfg)
+	if err != nil {
+		log.Error("failed to create new health checker", err)
+		return nil, err
+	}
+
+	bans, err := ban.New(cfg.BanCfg)
+	if err != nil {
+		log.Error("failed to load bans", err)
+		return nil, err
+	}
+
 	tlsConfig, err := makeTlsConfig(&cfg.TlsCfg)
 	if err != nil {
 		log.Error("failed to create new TLS config", err)
 		return nil, err
 	}
+
+	adminTlsConfig, err := makeAdminTlsConfig(tlsConfig, cfg.AdminCfg)
+	if err != nil {
+		log.Error("failed to create the admin TLS config", err)
+		return nil, err
+	}
 	// Create server
 	server := &Server{
-		disconnectReq:    make(chan net.Conn),
-		connectReq:       make(chan *tls.Conn),
-		loadBalancingReq: make(chan selectUpstreamReq),
-		upstreams:        cfg.Upstreams,
-		balancer:         balance.New(authzScheme),
-		rateLimiter:      ratelimit.New(cfg.RateLimiterCfg),
-		healthChecker:    healthcheck.New(cfg.HealthCheckCfg),
-		timeout:          cfg.Timeout,
-		bind:             cfg.Bind,
-		tlsConfig:        tlsConfig,
-		stop:             make(chan bool),
+		connectReq:         make(chan *connection),
+		releaseUpstreamReq: make(chan *u.Upstream),
+		loadBalancingReq:   make(chan *selectUpstreamReq),
+		cancelBalancingReq: make(chan *selectUpstreamReq),
+		queueTimeout:       cfg.QueueTimeout,
+		registry:           u.NewRegistry(cfg.Upstreams),
+		authz:              authzScheme,
+		bans:               bans,
+		rateLimiter:        rateLimiter,
+		connLimiter:        ratelimit.NewConnLimiter(cfg.ConnLimitCfg),
+		bandwidthLimiter:   ratelimit.NewBandwidthLimiter(cfg.BandwidthCfg, BUFFER_SIZE),
+		healthChecker:      healthChecker,
+		outliers:           outlier.New(cfg.OutlierCfg, len(cfg.Upstreams)),
+		minConnDuration:    cfg.MinConnDuration,
+		timeout:            cfg.Timeout,
+		bind:               cfg.Bind,
+		tlsConfig:          tlsConfig,
+		tlsAlert:           cfg.TLSAlert,
+		denialMessage:      cfg.DenialMessage,
+		denials:            make(map[DenialReason]int),
+		metricsBind:        cfg.MetricsCfg.Bind,
+		adminBind:          cfg.AdminCfg.Bind,
+		adminToken:         cfg.AdminCfg.Token,
+		adminTlsConfig:     adminTlsConfig,
+		mirrorCfg:          cfg.MirrorCfg,
+		stop:               make(chan bool),
+		done:               make(chan struct{}),
+	}
+	server.breakers = breaker.New(cfg.BreakerCfg, server.circuitChanged)
+	server.slowStart = balance.NewSlowStart(cfg.SlowStartCfg)
+	server.latencies = latency.New(cfg.LatencyDecay)
+	server.healthChecker.Latencies = server.latencies
+	var lb balance.LoadBalancer
+	switch cfg.Balancer {
+	case "", "least_connection":
+		lb = balance.New()
+	case "peak_ewma":
+		lb = balance.NewPeakEWMA(server.latencies)
+	default:
+		return nil, errors.New("unknown balancer: " + cfg.Balancer)
+	}
+	if err := validateSplit(cfg.SplitCfg); err != nil {
+		return nil, err
+	}
+	server.split = balance.WithSplit(
+		balance.WithZones(
+			balance.WithPriorities(
+				balance.WithBreakers(balance.WithSlowStart(lb, server.slowStart), server.breakers),
+				cfg.MinHealthyPercent, server.usable),
+			cfg.Zone, cfg.MinLocalHealthyPercent, server.usable),
+		cfg.SplitCfg)
+	server.balancer = server.split
+
+	if server.discovery, err = discovery.New(cfg.DiscoveryCfg, server.registry); err != nil {
+		log.Error("failed to create upstream discovery", err)
+		return nil, err
 	}
 
 	return server, nil
@@ -94,9 +205,16 @@ func (s *Server) Start() error {
 	}
 	// Start rate limiter
 	s.rateLimiter.Start()
+	s.bans.Start()
 
 	// Start health checker
-	s.healthChecker.Start(s.upstreams)
+	healthEvents, _ := s.healthChecker.Subscribe(64)
+	go s.watchHealth(healthEvents)
+	upstreamChanges, unsubscribe := s.registry.Subscribe()
+	s.healthChecker.Start(s.registry.Snapshot())
+	for _, poller := range s.discovery {
+		poller.Start()
+	}
 
 	go func() {
 
@@ -115,9 +233,30 @@ func (s *Server) Start() error {
 			case req := <-s.loadBalancingReq:
 				s.handleBalancingReq(req)
 
+			case req := <-s.cancelBalancingReq:
+				s.cancelPending(req)
+
+			case <-s.releaseUpstreamReq:
+				s.servePending()
+
+			case change := <-upstreamChanges:
+				s.handleUpstreamChange(change)
+
 			case <-s.stop:
+				close(s.done)
+				for _, poller := range s.discovery {
+					poller.Stop()
+				}
+				unsubscribe()
 				s.rateLimiter.Stop()
+				s.bans.Stop()
 				s.healthChecker.Stop()
+				if s.metricsServer != nil {
+					s.metricsServer.Close()
+				}
+				if s.adminServer != nil {
+					s.adminServer.Close()
+				}
 				if s.listener != nil {
 					s.listener.Close()
 					//TODO: check active connections and close them
@@ -127,6 +266,18 @@ func (s *Server) Start() error {
 		}
 	}()
 
+	if err := s.serveMetrics(); err != nil {
+		log.Error("failed to serve metrics ", err)
+		s.Stop()
+		return err
+	}
+
+	if err := s.serveAdmin(); err != nil {
+		log.Error("failed to serve admin interface ", err)
+		s.Stop()
+		return err
+	}
+
 	// Start listening
 	if err := s.Listen(); err != nil {
 		log.Error("failed to listen", err)
@@ -137,7 +288,7 @@ func (s *Server) Start() error {
 	return nil
 }
 
-func (s *Server) handleClientConnect(client *tls.Conn) {
+func (s *Server) handleClientConnect(client *connection) {
 	go s.handle(client)
 }
 
@@ -145,6 +296,12 @@ func (s *Server) Stop() {
 	s.stop <- true
 }
 
+// ReconfigureRateLimits changes rate limit tiers and their assignments without
+// resetting the buckets of connected clients.
+func (s *Server) ReconfigureRateLimits(cfg config.RateLimiterCfg) error {
+	return s.rateLimiter.Reconfigure(cfg)
+}
+
 func (s *Server) Listen() (err error) {
 
 	s.listener, err = net.Listen("tcp", s.bind)
@@ -163,68 +320,168 @@ func (s *Server) Listen() (err error) {
 				log.Error("error in listener accept ", err)
 				return
 			}
+			// banned addresses are dropped before the TLS handshake
+			if s.bans.Banned(ban.SourceIP(conn.RemoteAddr())) {
+				s.rejectBanned(conn)
+				continue
+			}
 
-			clientConn := tls.Server(conn, s.tlsConfig)
-			s.connectReq <- clientConn
+			tlsConfig := s.tlsConfig
+			client := &connection{}
+			if s.tlsAlert {
+				tlsConfig = s.tlsConfig.Clone()
+				tlsConfig.VerifyConnection = s.verifyConnection(client)
+			}
+			client.tlsConn = tls.Server(conn, tlsConfig)
+			s.connectReq <- client
 		}
 	}()
 
 	return nil
 }
 
-func (s *Server) handle(clientConn *tls.Conn) {
+func (s *Server) handle(c *connection) {
+	defer c.release()
 
-	clientConn.Handshake()
+	clientConn := c.tlsConn
 	defer clientConn.Close()
-	if len(clientConn.ConnectionState().PeerCertificates) == 0 {
-		log.Info("no peer certificate. client connection may be closed")
+	if err := clientConn.Handshake(); err != nil {
+		// refusals during the handshake have already been recorded
+		if c.denial == nil {
+			log.Info("TLS handshake failed ", err)
+			s.strike("", clientConn.RemoteAddr())
+		}
 		return
 	}
-	clientId := clientConn.ConnectionState().PeerCertificates[0].Subject.CommonName
-
-	req := selectUpstreamReq{
-		res:      make(chan *u.Upstream, 1),
-		clientId: clientId,
-	}
-	s.loadBalancingReq <- req
-	upstream := <-req.res
-	if upstream == nil {
+	// admission has already run during the handshake when TLS alerts are enabled
+	if s.admit(c, clientConn.ConnectionState()) != nil {
+		s.tellDenial(c)
 		return
 	}
-
-	if s.rateLimiter.Allows(clientId) == false {
+	if s.runStages(c, connectStages) != nil {
+		s.tellDenial(c)
 		return
 	}
-	upstreamAddr := upstream.Host + ":" + upstream.Port
-	log.Info("Balancer: ", "select upstream ", upstreamAddr)
-
-	upstreamConn, err := net.DialTimeout("tcp", upstreamAddr, 1*time.Second)
 
-	// if attemp to connect to the upstream fails, put it into the UnhealthyUpstreams channel
-	if err != nil {
-		log.Info("find an unhealthy upstream during regular LB operation", upstreamAddr)
-		s.healthChecker.UnhealthyUpstreams <- upstream
-		return
+	clientId := c.conn.CommonName
+	upstreamAddr := c.upstream.Host + ":" + c.upstream.Port
+	opened := time.Now()
+	var upstreamErr error
+	var upstreamClosed time.Time
+	var tee io.Writer
+	if c.mirror != nil {
+		tee = c.mirror
 	}
-	defer upstreamConn.Close()
-	defer func() {
-		// update number of connection
-		upstream.NumActiveConn--
-	}()
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
-	go proxy(upstreamConn, clientConn, clientId, upstreamAddr, "-> lb ->", wg)
-	go proxy(clientConn, upstreamConn, clientId, upstreamAddr, "<- lb <-", wg)
+	go func() {
+		defer wg.Done()
+		proxy(c.upstreamConn, clientConn, clientId, upstreamAddr, "-> lb ->", c.upload, tee)
+	}()
+	go func() {
+		defer wg.Done()
+		upstreamErr = proxy(clientConn, c.upstreamConn, clientId, upstreamAddr, "<- lb <-", c.download, nil)
+		upstreamClosed = time.Now()
+		if upstreamErr != nil {
+			// pass a reset on rather than leave the client waiting
+			clientConn.Close()
+		}
+	}()
 	wg.Wait()
+	c.outcome = connOutcome(upstreamErr, upstreamClosed.Sub(opened), s.minConnDuration)
+}
+
+// connOutcome tells how a connection went from the upstream's side: the error reading
+// from it and how long after the connection was opened it stopped sending.
+func connOutcome(err error, lifetime, minDuration time.Duration) outlier.Outcome {
+	switch {
+	case errors.Is(err, syscall.ECONNRESET):
+		return outlier.Reset
+	case lifetime < minDuration:
+		return outlier.ShortConnection
+	default:
+		return outlier.Success
+	}
 }
 
-func proxy(to net.Conn, from net.Conn, clientId, upstreamAddr, direction string, wg *sync.WaitGroup) {
+// recordOutcome feeds the outlier detector and the circuit breaker of the upstream.
+func (s *Server) recordOutcome(upstreamAddr string, o outlier.Outcome) {
+	if o != outlier.Success {
+		upstreamFailuresTotal.Inc(upstreamAddr, o.String())
+	}
+	if s.outliers.Record(upstreamAddr, o) {
+		ejectionsTotal.Inc(upstreamAddr)
+	}
+	s.breakers.Get(upstreamAddr).Done(o == outlier.Success)
+}
+
+// circuitChanged publishes a change of state of the circuit of an upstream.
+func (s *Server) circuitChanged(t breaker.Transition) {
+	circuitState.Set(float64(t.To), t.Upstream)
+	circuitTransitionsTotal.Inc(t.Upstream, t.From.String(), t.To.String())
+	log.WithFields(log.Fields{
+		"upstream": t.Upstream,
+		"from":     t.From,
+		"to":       t.To,
+	}).Info("circuit changed state")
+}
+
+// SetSplit changes how connections are split between groups of upstreams. Connections
+// already proxied stay where they are; new ones follow the new split at once.
+func (s *Server) SetSplit(cfg config.SplitCfg) error {
+	if err := validateSplit(cfg); err != nil {
+		return err
+	}
+	s.split.Set(cfg)
+	log.WithFields(log.Fields{
+		"active":         cfg.ActiveGroup,
+		"canary":         cfg.CanaryGroup,
+		"canary_percent": cfg.CanaryPercent,
+		"sticky":         cfg.CanarySticky,
+	}).Info("traffic split changed")
+	return nil
+}
+
+func validateSplit(cfg config.SplitCfg) error {
+	if cfg.CanaryPercent < 0 || cfg.CanaryPercent > 100 {
+		return fmt.Errorf("canary percent %v is not between 0 and 100", cfg.CanaryPercent)
+	}
+	if cfg.CanaryGroup != "" && cfg.CanaryGroup == cfg.ActiveGroup {
+		return errors.New("canary group " + cfg.CanaryGroup + " is also the active group")
+	}
+	return nil
+}
+
+// watchHealth publishes the changes of health of upstreams until the health checker stops.
+func (s *Server) watchHealth(events <-chan healthcheck.Event) {
+	for e := range events {
+		healthState.Set(float64(e.To), e.Upstream)
+		healthTransitionsTotal.Inc(e.Upstream, e.From.String(), e.To.String())
+		if e.Latency > 0 {
+			healthProbeSeconds.Set(e.Latency.Seconds(), e.Upstream)
+		}
+		log.WithFields(log.Fields{
+			"upstream": e.Upstream,
+			"from":     e.From,
+			"to":       e.To,
+			"reason":   e.Reason,
+			"latency":  e.Latency,
+		}).Info("upstream changed health")
+	}
+}
+
+// proxy copies from one side of the connection to the other until either fails,
+// and returns the error reading from, if it was not the end of the stream. What is
+// copied is also written to tee, if not nil, which must not block.
+func proxy(to net.Conn, from net.Conn, clientId, upstreamAddr, direction string, throttle *ratelimit.Throttle, tee io.Writer) error {
+	var err error
 
 	buf := make([]byte, BUFFER_SIZE)
 	// TODO: set read write deadline
 	for {
 		nRead, errRead := from.Read(buf)
 		if nRead > 0 {
+			throttle.Wait(nRead)
 			nWrite, errWrite := to.Write(buf[0:nRead])
 			if errWrite != nil {
 				log.Error("error write to upstream ", errWrite)
@@ -235,6 +492,9 @@ func proxy(to net.Conn, from net.Conn, clientId, upstreamAddr, direction string,
 				log.Error("error short write to upstream ", io.ErrShortWrite)
 				break
 			}
+			if tee != nil {
+				tee.Write(buf[0:nRead])
+			}
 		}
 
 		if errRead == io.EOF {
@@ -243,12 +503,13 @@ func proxy(to net.Conn, from net.Conn, clientId, upstreamAddr, direction string,
 
 		if errRead != nil {
 			log.Error("error reading from client ", errRead)
+			err = errRead
 			break
 		}
 	}
 	l := fmt.Sprintf("%s %s upstream %s ", clientId, direction, upstreamAddr)
 	log.Printf(l)
-	wg.Done()
+	return err
 }
 
 func (s *Server) markUnhealthyUpstream(upstream *u.Upstream) {
@@ -256,24 +517,13 @@ func (s *Server) markUnhealthyUpstream(upstream *u.Upstream) {
 		log.Error("unhealthy upstream is nil")
 		return
 	}
-	if s.upstreams == nil {
-		log.Error("empty upstream list")
-		return
-	}
-	idx := -1
-	for i := range s.upstreams {
-		if s.upstreams[i] == upstream {
-			idx = i
-			break
-		}
-	}
 	// upstream is not found
-	if idx == -1 {
+	if found, _ := s.registry.Get(upstream.Host + ":" + upstream.Port); found != upstream {
 		log.Info("unhealthy upstream not found in upstream list")
 		return
 	}
 
-	s.upstreams[idx].IsAlive = false
+	upstream.SetAlive(false)
 	log.Info("find an unhealthy upstream", upstream.Host+":"+upstream.Port)
 }
 
@@ -282,37 +532,121 @@ func (s *Server) markHealthyUpstream(upstream *u.Upstream) {
 		log.Error("healthy upstream is nil")
 		return
 	}
-	if s.upstreams == nil {
-		log.Error("empty upstream list")
-		return
-	}
-	idx := -1
-	for i := range s.upstreams {
-		if s.upstreams[i] == upstream {
-			idx = i
-			break
-		}
-	}
 	// upstream is not found
-	if idx == -1 {
+	if found, _ := s.registry.Get(upstream.Host + ":" + upstream.Port); found != upstream {
 		log.Info("upstream not found in upstream list")
 		return
 	}
-	if s.upstreams[idx].IsAlive == false {
-		s.upstreams[idx].IsAlive = true
+	if upstream.SetAlive(true) {
+		s.slowStart.Begin(upstream.Host + ":" + upstream.Port)
 		log.Info("unhealthy upstream becomes healthy", upstream.Host+":"+upstream.Port)
+		s.servePending()
+	}
+}
+
+// usable reports whether an upstream is alive and not ejected for failing live connections.
+func (s *Server) usable(up *u.Upstream) bool {
+	return up.InRotation() && !s.outliers.Ejected(up.Host+":"+up.Port)
+}
+
+// serving leaves out upstreams removed or draining since the client was authorized to reach them.
+func (s *Server) serving(upstreams []*u.Upstream) []*u.Upstream {
+	serving := make([]*u.Upstream, 0, len(upstreams))
+	for _, up := range upstreams {
+		if s.registry.Serves(up) {
+			serving = append(serving, up)
+		}
+	}
+	return serving
+}
+
+// Upstreams returns the registry of upstreams, to change them while the server runs.
+func (s *Server) Upstreams() *u.Registry {
+	return s.registry
+}
+
+// handleUpstreamChange starts and stops health checks of upstreams added to and removed
+// from the registry, and reports draining ones. Added and resumed upstreams ramp up like
+// recovered ones. Draining upstreams keep being checked.
+func (s *Server) handleUpstreamChange(change u.Change) {
+	upstream := change.Upstream
+	upstreamAddr := upstream.Host + ":" + upstream.Port
+	switch change.Type {
+	case u.Added:
+		s.healthChecker.Add(upstream)
+		s.slowStart.Begin(upstreamAddr)
+	case u.Draining:
+		drainState.Set(drainStateDraining, upstreamAddr)
+	case u.Drained:
+		drainState.Set(drainStateDrained, upstreamAddr)
+		log.WithFields(log.Fields{
+			"upstream": upstreamAddr,
+		}).Info("upstream drained, it has no connections left")
+	case u.Resumed:
+		drainState.Set(drainStateServing, upstreamAddr)
+		s.slowStart.Begin(upstreamAddr)
+	case u.Removed:
+		s.healthChecker.Remove(upstream)
+	}
+	s.outliers.SetPoolSize(len(s.registry.Snapshot()))
+	log.WithFields(log.Fields{
+		"upstream": upstreamAddr,
+		"change":   change.Type,
+	}).Info("upstreams changed")
+	s.servePending()
+}
+
+func (s *Server) handleBalancingReq(req *selectUpstreamReq) {
+	upstream, err := s.acquireUpstream(req)
+	if err == balance.ErrNoCapacity && s.queueTimeout > 0 {
+		s.pending = append(s.pending, req)
+		return
 	}
+	s.replyBalancingReq(req, upstream, err)
 }
 
-func (s *Server) handleBalancingReq(req selectUpstreamReq) {
-	upstream, err := s.balancer.Select(req.clientId, s.upstreams)
+func (s *Server) replyBalancingReq(req *selectUpstreamReq, upstream *u.Upstream, err error) {
 	if err != nil {
-		req.res <- nil
+		req.res <- selectUpstreamRes{err: err}
 	} else {
-		upstream.NumActiveConn++
-		req.res <- upstream
+		req.res <- selectUpstreamRes{upstream: upstream}
 	}
+}
 
+// acquireUpstream selects an upstream for the request and counts the connection against it.
+func (s *Server) acquireUpstream(req *selectUpstreamReq) (*u.Upstream, error) {
+	for {
+		upstream, err := s.balancer.Select(req.clientId, s.serving(req.upstreams))
+		// unless it started draining, or was removed, since it was selected
+		if err != nil || s.registry.Acquire(upstream) {
+			return upstream, err
+		}
+		s.breakers.Get(upstream.Host + ":" + upstream.Port).Release()
+	}
+}
+
+// servePending retries queued requests once an upstream may have room again.
+func (s *Server) servePending() {
+	remaining := s.pending[:0]
+	for _, req := range s.pending {
+		upstream, err := s.acquireUpstream(req)
+		if err == balance.ErrNoCapacity {
+			remaining = append(remaining, req)
+			continue
+		}
+		s.replyBalancingReq(req, upstream, err)
+	}
+	s.pending = remaining
+}
+
+// cancelPending drops a request whose client stopped waiting.
+func (s *Server) cancelPending(req *selectUpstreamReq) {
+	for i := range s.pending {
+		if s.pending[i] == req {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return
+		}
+	}
 }
 
 func makeTlsConfig(tlsCfg *config.TlsCfg) (*tls.Config, error) {
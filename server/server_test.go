@@ -1,14 +1,41 @@
 package server
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"layer4balancer/config"
+	"layer4balancer/pkg/balance"
+	"layer4balancer/pkg/breaker"
+	"layer4balancer/pkg/healthcheck"
 	u "layer4balancer/pkg/upstream"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
 
+const testAdminToken = "admin-token"
+
+// adminRequest returns a request to the admin interface that carries the admin token.
+func adminRequest(method, url string, body io.Reader) *http.Request {
+	req, _ := http.NewRequest(method, url, body)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return req
+}
+
 func createTestConfig() config.ServerCfg {
 	healthCheckCfg := config.HealthCheckCfg{
 		HealthCheckInterval: 1 * time.Second,
@@ -17,8 +44,8 @@ func createTestConfig() config.ServerCfg {
 
 	rateLimiterCfg := config.RateLimiterCfg{
 		CleanupInterval: 20 * time.Second,
+		RatePerSecond:   1,
 		Burst:           1,
-		Token:           1,
 	}
 
 	authzCfg := config.AuthzCfg{
@@ -43,6 +70,7 @@ func createTestConfig() config.ServerCfg {
 		HealthCheckCfg: healthCheckCfg,
 		RateLimiterCfg: rateLimiterCfg,
 		AuthzCfg:       authzCfg,
+		AdminCfg:       config.AdminCfg{Token: testAdminToken},
 		TlsCfg:         tlsCfg,
 		Bind:           ":1234",
 		Timeout:        1 * time.Second,
@@ -70,3 +98,1154 @@ func TestStart(t *testing.T) {
 	}
 	server.Stop()
 }
+
+// startTestUpstream starts an upstream that replies to every message it reads.
+func startTestUpstream(t *testing.T) (*u.Upstream, net.Listener) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, BUFFER_SIZE)
+				n, err := c.Read(buf)
+				if err != nil {
+					return
+				}
+				c.Write(append([]byte("reply: "), buf[:n]...))
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	return &u.Upstream{Host: host, Port: port, IsAlive: true}, l
+}
+
+// testPKI is a throwaway CA with a server certificate, written to a temporary directory.
+type testPKI struct {
+	dir    string
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, ca, ca, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPKI{dir: t.TempDir(), caKey: key}
+	if p.caCert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, p.dir+"/ca.crt", "CERTIFICATE", der)
+
+	server := p.issue(t, "server")
+	writePEM(t, p.dir+"/server.crt", "CERTIFICATE", server.Certificate[0])
+	serverKey, _ := x509.MarshalECPrivateKey(server.PrivateKey.(*ecdsa.PrivateKey))
+	writePEM(t, p.dir+"/server.key", "EC PRIVATE KEY", serverKey)
+	return p
+}
+
+// issue signs a certificate for commonName.
+func (p *testPKI) issue(t *testing.T, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, cert, p.caCert, &key.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (p *testPKI) tlsCfg() config.TlsCfg {
+	return config.TlsCfg{
+		CertPath: p.dir + "/server.crt",
+		KeyPath:  p.dir + "/server.key",
+		CaPath:   p.dir + "/ca.crt",
+	}
+}
+
+func (p *testPKI) clientTlsConfig(t *testing.T, clientId string) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(p.caCert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{p.issue(t, clientId)},
+		RootCAs:      pool,
+		ServerName:   "localhost",
+	}
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitReleased waits for the connections of server to end, and returns an error if its
+// connection slots, upstream connections or bandwidth buckets are not all given back.
+func waitReleased(server *Server) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, conns := server.connLimiter.Active("")
+		var upstreamConns int64
+		for _, up := range server.Upstreams().List() {
+			upstreamConns += up.ActiveConns()
+		}
+		buckets := server.bandwidthLimiter.Buckets()
+		if conns == 0 && upstreamConns == 0 && buckets == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d connection slots, %d upstream connections and %d bandwidth buckets held",
+				conns, upstreamConns, buckets)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startTestServer starts a server in front of upstreams. Authz rules may refer to the
+// first upstream as UPSTREAM.
+func startTestServer(t *testing.T, pki *testPKI, upstreams []*u.Upstream, rules []string, configure func(*config.ServerCfg)) *Server {
+	cfg := createTestConfig()
+	cfg.TlsCfg = pki.tlsCfg()
+	cfg.Bind = "127.0.0.1:0"
+	cfg.Upstreams = upstreams
+	cfg.Rules = make([]string, 0)
+	for _, r := range rules {
+		cfg.Rules = append(cfg.Rules, strings.Replace(r, "UPSTREAM", upstreams[0].Host+":"+upstreams[0].Port, 1))
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	server, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// roundTrip sends a message through the load balancer and returns the reply.
+func roundTrip(addr string, tlsConfig *tls.Config) (string, error) {
+	c, reply, err := open(addr, tlsConfig)
+	if c != nil {
+		c.Close()
+	}
+	return reply, err
+}
+
+// open is like roundTrip but leaves the connection open, so it keeps holding its upstream.
+func open(addr string, tlsConfig *tls.Config) (*tls.Conn, string, error) {
+	c, err := tls.Dial("tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, "", err
+	}
+	c.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := c.Write([]byte("hello")); err != nil {
+		return c, "", err
+	}
+	buf := make([]byte, BUFFER_SIZE)
+	n, err := c.Read(buf)
+	return c, string(buf[:n]), err
+}
+
+func TestAdmission(t *testing.T) {
+	tests := []struct {
+		description string
+		clients     []string
+		rules       []string
+		tlsAlert    bool
+		// denialMessage also sets the upstream down, so that clients may be refused after the handshake
+		denialMessage bool
+		wantErr       []string
+		// wantReply is the reply of clients without an error, "reply: hello" if empty
+		wantReply   string
+		wantReason  DenialReason
+		wantDenials int
+	}{
+		{
+			description: "authorized client is proxied",
+			clients:     []string{"client.a"},
+			rules:       []string{"client.a-allow-UPSTREAM"},
+			wantErr:     []string{""},
+			wantReason:  DeniedForbidden,
+			wantDenials: 0,
+		},
+		{
+			description: "forbidden client is closed after the handshake",
+			clients:     []string{"client.c"},
+			rules:       []string{"client.c-deny-UPSTREAM"},
+			wantErr:     []string{"EOF"},
+			wantReason:  DeniedForbidden,
+			wantDenials: 1,
+		},
+		{
+			description: "forbidden client receives a TLS alert",
+			clients:     []string{"client.c"},
+			rules:       []string{"client.c-deny-UPSTREAM"},
+			tlsAlert:    true,
+			wantErr:     []string{"bad certificate"},
+			wantReason:  DeniedForbidden,
+			wantDenials: 1,
+		},
+		{
+			description: "rate limited client receives a TLS alert",
+			clients:     []string{"client.b", "client.b"},
+			rules:       []string{},
+			tlsAlert:    true,
+			wantErr:     []string{"", "bad certificate"},
+			wantReason:  DeniedRateLimited,
+			wantDenials: 1,
+		},
+		{
+			description:   "forbidden client is told why after the handshake",
+			clients:       []string{"client.c"},
+			rules:         []string{"client.c-deny-UPSTREAM"},
+			denialMessage: true,
+			wantErr:       []string{""},
+			wantReply:     "denied: forbidden\n",
+			wantReason:    DeniedForbidden,
+			wantDenials:   1,
+		},
+		{
+			description:   "with TLS alerts, a client without an upstream is told apart from a forbidden one",
+			clients:       []string{"client.a", "client.c"},
+			rules:         []string{"client.a-allow-UPSTREAM", "client.c-deny-UPSTREAM"},
+			tlsAlert:      true,
+			denialMessage: true,
+			wantErr:       []string{"", "bad certificate"},
+			wantReply:     "denied: no_upstream\n",
+			wantReason:    DeniedNoUpstream,
+			wantDenials:   1,
+		},
+	}
+
+	for _, tc := range tests {
+		upstream, l := startTestUpstream(t)
+		if tc.denialMessage {
+			upstream.IsAlive = false
+		}
+		pki := newTestPKI(t)
+		server := startTestServer(t, pki, []*u.Upstream{upstream}, tc.rules, func(cfg *config.ServerCfg) {
+			cfg.TLSAlert = tc.tlsAlert
+			cfg.DenialMessage = tc.denialMessage
+		})
+		wantReply := tc.wantReply
+		if wantReply == "" {
+			wantReply = "reply: hello"
+		}
+
+		for i, clientId := range tc.clients {
+			reply, err := roundTrip(server.listener.Addr().String(), pki.clientTlsConfig(t, clientId))
+			switch {
+			case tc.wantErr[i] == "" && err != nil:
+				t.Errorf("%s, unexpected error %v", tc.description, err)
+			case tc.wantErr[i] == "" && reply != wantReply:
+				t.Errorf("%s, %q != %q", tc.description, reply, wantReply)
+			case tc.wantErr[i] != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr[i])):
+				t.Errorf("%s, %v does not contain %q", tc.description, err, tc.wantErr[i])
+			}
+		}
+
+		if got := server.DenialCount(tc.wantReason); got != tc.wantDenials {
+			t.Errorf("%s, %v != %v", tc.description, got, tc.wantDenials)
+		}
+		server.Stop()
+		l.Close()
+	}
+}
+
+func TestPipelineReleasesUpstreams(t *testing.T) {
+	tests := []struct {
+		description string
+		clients     []string
+		rules       []string
+		tlsAlert    bool
+		unreachable bool
+	}{
+		{
+			description: "proxied connections",
+			clients:     []string{"client.a", "client.b"},
+		},
+		{
+			description: "upstream cannot be dialed",
+			clients:     []string{"client.a"},
+			unreachable: true,
+		},
+		{
+			description: "rate limited client",
+			clients:     []string{"client.a", "client.a", "client.a"},
+		},
+		{
+			description: "rate limited client refused during the handshake",
+			clients:     []string{"client.a", "client.a", "client.a"},
+			tlsAlert:    true,
+		},
+		{
+			description: "forbidden client",
+			clients:     []string{"client.c"},
+			rules:       []string{"client.c-deny-UPSTREAM"},
+		},
+	}
+
+	for _, tc := range tests {
+		upstream, l := startTestUpstream(t)
+		if tc.unreachable {
+			l.Close()
+		}
+		pki := newTestPKI(t)
+		server := startTestServer(t, pki, []*u.Upstream{upstream}, tc.rules, func(cfg *config.ServerCfg) {
+			cfg.TLSAlert = tc.tlsAlert
+			// so that every connection holds a slot and bandwidth buckets too
+			cfg.ConnLimitCfg = config.ConnLimitCfg{MaxConns: 10, MaxConnsPerClient: 10}
+			cfg.BandwidthCfg = config.BandwidthCfg{ClientUpload: 1 << 20, ClientDownload: 1 << 20,
+				UpstreamUpload: 1 << 20, UpstreamDownload: 1 << 20}
+		})
+
+		for _, clientId := range tc.clients {
+			roundTrip(server.listener.Addr().String(), pki.clientTlsConfig(t, clientId))
+		}
+		if err := waitReleased(server); err != nil {
+			t.Errorf("%s, %v", tc.description, err)
+		}
+		server.Stop()
+		l.Close()
+	}
+}
+
+func TestConnLimits(t *testing.T) {
+	tests := []struct {
+		description string
+		maxConns    int
+		config      config.ConnLimitCfg
+		// a client holding a connection while the second client connects
+		holder string
+		// how long the holder keeps its connection after the second client connects
+		hold        time.Duration
+		client      string
+		wantErr     bool
+		wantReason  DenialReason
+		wantDenials int
+	}{
+		{
+			description: "per client limit",
+			config:      config.ConnLimitCfg{MaxConnsPerClient: 1},
+			holder:      "client.a",
+			hold:        time.Second,
+			client:      "client.a",
+			wantErr:     true,
+			wantReason:  DeniedTooManyConns,
+			wantDenials: 1,
+		},
+		{
+			description: "other clients are not affected by the per client limit",
+			config:      config.ConnLimitCfg{MaxConnsPerClient: 1},
+			holder:      "client.a",
+			hold:        time.Second,
+			client:      "client.b",
+			wantReason:  DeniedTooManyConns,
+			wantDenials: 0,
+		},
+		{
+			description: "global limit",
+			config:      config.ConnLimitCfg{MaxConns: 1},
+			holder:      "client.a",
+			hold:        time.Second,
+			client:      "client.b",
+			wantErr:     true,
+			wantReason:  DeniedTooManyConns,
+			wantDenials: 1,
+		},
+		{
+			description: "upstream at max connections rejects without a queue",
+			maxConns:    1,
+			holder:      "client.a",
+			hold:        time.Second,
+			client:      "client.b",
+			wantErr:     true,
+			wantReason:  DeniedUpstreamsFull,
+			wantDenials: 1,
+		},
+		{
+			description: "queued client times out",
+			maxConns:    1,
+			config:      config.ConnLimitCfg{QueueTimeout: 200 * time.Millisecond},
+			holder:      "client.a",
+			hold:        time.Second,
+			client:      "client.b",
+			wantErr:     true,
+			wantReason:  DeniedUpstreamsFull,
+			wantDenials: 1,
+		},
+		{
+			description: "queued client is served once the upstream has room",
+			maxConns:    1,
+			config:      config.ConnLimitCfg{QueueTimeout: 2 * time.Second},
+			holder:      "client.a",
+			hold:        200 * time.Millisecond,
+			client:      "client.b",
+			wantReason:  DeniedUpstreamsFull,
+			wantDenials: 0,
+		},
+	}
+
+	for _, tc := range tests {
+		upstream, l := startTestUpstream(t)
+		upstream.MaxConns = tc.maxConns
+		pki := newTestPKI(t)
+		server := startTestServer(t, pki, []*u.Upstream{upstream}, nil, func(cfg *config.ServerCfg) {
+			cfg.ConnLimitCfg = tc.config
+			cfg.RateLimiterCfg.RatePerSecond = 10
+			cfg.RateLimiterCfg.Burst = 10
+			cfg.BandwidthCfg = config.BandwidthCfg{ClientUpload: 1 << 20, UpstreamDownload: 1 << 20}
+		})
+		addr := server.listener.Addr().String()
+
+		holder, _, err := open(addr, pki.clientTlsConfig(t, tc.holder))
+		if err != nil {
+			t.Fatalf("%s, %v", tc.description, err)
+		}
+		go func(hold time.Duration) {
+			time.Sleep(hold)
+			holder.Close()
+		}(tc.hold)
+
+		reply, err := roundTrip(addr, pki.clientTlsConfig(t, tc.client))
+		if tc.wantErr && err == nil {
+			t.Errorf("%s, expected an error, got %q", tc.description, reply)
+		}
+		if !tc.wantErr && (err != nil || reply != "reply: hello") {
+			t.Errorf("%s, %q, %v", tc.description, reply, err)
+		}
+		if got := server.DenialCount(tc.wantReason); got != tc.wantDenials {
+			t.Errorf("%s, %v != %v", tc.description, got, tc.wantDenials)
+		}
+
+		if err := waitReleased(server); err != nil {
+			t.Errorf("%s, %v", tc.description, err)
+		}
+		server.Stop()
+		l.Close()
+	}
+}
+
+func TestBans(t *testing.T) {
+	tests := []struct {
+		description string
+		// misbehaving clients connecting in turn; "" connects without a certificate
+		clients  []string
+		wantErr  []bool
+		wantBans []string
+	}{
+		{
+			description: "repeatedly rate limited client is banned",
+			clients:     []string{"client.a", "client.a", "client.a"},
+			wantErr:     []bool{false, true, true},
+			wantBans:    []string{"cn:client.a", "ip:127.0.0.1"},
+		},
+		{
+			description: "failed handshakes ban the source address",
+			clients:     []string{"", ""},
+			wantErr:     []bool{true, true},
+			wantBans:    []string{"ip:127.0.0.1"},
+		},
+	}
+
+	for _, tc := range tests {
+		upstream, l := startTestUpstream(t)
+		pki := newTestPKI(t)
+		server := startTestServer(t, pki, []*u.Upstream{upstream}, nil, func(cfg *config.ServerCfg) {
+			cfg.BanCfg = config.BanCfg{
+				Strikes:      2,
+				StrikeWindow: time.Minute,
+				BanDuration:  time.Minute,
+			}
+		})
+		addr := server.listener.Addr().String()
+
+		for i, clientId := range tc.clients {
+			tlsConfig := &tls.Config{RootCAs: pki.clientTlsConfig(t, "client.a").RootCAs}
+			if clientId != "" {
+				tlsConfig = pki.clientTlsConfig(t, clientId)
+			}
+			_, err := roundTrip(addr, tlsConfig)
+			if (err != nil) != tc.wantErr[i] {
+				t.Errorf("%s, connection %d, %v", tc.description, i, err)
+			}
+		}
+		// a failed handshake is counted after the client has seen the alert
+		deadline := time.Now().Add(3 * time.Second)
+		for !server.bans.Banned("ip:127.0.0.1") && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// any client from a banned address is dropped before its handshake
+		if _, err := roundTrip(addr, pki.clientTlsConfig(t, "client.b")); err == nil {
+			t.Errorf("%s, banned address was proxied", tc.description)
+		}
+		if got := server.DenialCount(DeniedBanned); got != 1 {
+			t.Errorf("%s, %v != %v", tc.description, got, 1)
+		}
+
+		admin := httptest.NewServer(server.adminHandler())
+		res, err := http.DefaultClient.Do(adminRequest(http.MethodGet, admin.URL+"/bans", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		for _, key := range tc.wantBans {
+			if !strings.Contains(string(body), key) {
+				t.Errorf("%s, %s missing from %s", tc.description, key, body)
+			}
+		}
+
+		req := adminRequest(http.MethodDelete, admin.URL+"/bans?key=ip:127.0.0.1", nil)
+		res, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNoContent {
+			t.Errorf("%s, %v != %v", tc.description, res.StatusCode, http.StatusNoContent)
+		}
+		if reply, err := roundTrip(addr, pki.clientTlsConfig(t, "client.c")); err != nil || reply != "reply: hello" {
+			t.Errorf("%s, cleared ban still applies: %q, %v", tc.description, reply, err)
+		}
+
+		admin.Close()
+		if err := waitReleased(server); err != nil {
+			t.Errorf("%s, %v", tc.description, err)
+		}
+		server.Stop()
+		l.Close()
+	}
+}
+
+// startResettingUpstream starts an upstream that resets every connection once it has read from it.
+func startResettingUpstream(t *testing.T) (*u.Upstream, net.Listener) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, BUFFER_SIZE)
+				c.Read(buf)
+				c.(*net.TCPConn).SetLinger(0)
+				c.Close()
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	return &u.Upstream{Host: host, Port: port, IsAlive: true}, l
+}
+
+func TestOutlierEjection(t *testing.T) {
+	failing, fl := startResettingUpstream(t)
+	defer fl.Close()
+	upstream, l := startTestUpstream(t)
+	defer l.Close()
+	pki := newTestPKI(t)
+	server := startTestServer(t, pki, []*u.Upstream{failing, upstream}, nil, func(cfg *config.ServerCfg) {
+		cfg.RateLimiterCfg.RatePerSecond = 100
+		cfg.RateLimiterCfg.Burst = 100
+		cfg.OutlierCfg = config.OutlierCfg{
+			Failures:           2,
+			FailureWindow:      time.Minute,
+			EjectionDuration:   time.Minute,
+			MaxEjectionPercent: 50,
+		}
+	})
+	addr := server.listener.Addr().String()
+	failingAddr := failing.Host + ":" + failing.Port
+
+	// the failing upstream is picked first while both have no connections
+	for i := 0; i < 2; i++ {
+		if _, err := roundTrip(addr, pki.clientTlsConfig(t, "client.a")); err == nil {
+			t.Errorf("connection %d to the failing upstream succeeded", i)
+		}
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for !server.outliers.Ejected(failingAddr) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !server.outliers.Ejected(failingAddr) {
+		t.Fatalf("%s not ejected", failingAddr)
+	}
+	for i := 0; i < 3; i++ {
+		if reply, err := roundTrip(addr, pki.clientTlsConfig(t, "client.a")); err != nil || reply != "reply: hello" {
+			t.Errorf("connection %d after the ejection, %q, %v", i, reply, err)
+		}
+	}
+	if got := ejectionsTotal.Value(failingAddr); got != 1 {
+		t.Errorf("%v != %v", got, 1)
+	}
+
+	if err := waitReleased(server); err != nil {
+		t.Error(err)
+	}
+	server.Stop()
+}
+
+func TestHealthEvents(t *testing.T) {
+	// an upstream nothing listens on
+	upstream, l := startTestUpstream(t)
+	l.Close()
+	pki := newTestPKI(t)
+	server := startTestServer(t, pki, []*u.Upstream{upstream}, nil, func(cfg *config.ServerCfg) {
+		cfg.HealthCheckInterval = 10 * time.Millisecond
+	})
+	addr := upstream.Host + ":" + upstream.Port
+	admin := httptest.NewServer(server.adminHandler())
+
+	res, err := http.DefaultClient.Do(adminRequest(http.MethodGet, admin.URL+"/health/events", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event struct{ Upstream, From, To, Reason string }
+	if err := json.NewDecoder(res.Body).Decode(&event); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if event.Upstream != addr || event.From != "unknown" || event.To != "unhealthy" || event.Reason == "" {
+		t.Errorf("%+v", event)
+	}
+
+	res, err = http.DefaultClient.Do(adminRequest(http.MethodGet, admin.URL+"/health?upstream="+addr, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var history []struct{ To string }
+	if err := json.NewDecoder(res.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if len(history) != 1 || history[0].To != "unhealthy" {
+		t.Errorf("%+v", history)
+	}
+	// the server sees the event on its own subscription
+	deadline := time.Now().Add(time.Second)
+	for healthState.Value(addr) != float64(healthcheck.Unhealthy) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := healthState.Value(addr); got != float64(healthcheck.Unhealthy) {
+		t.Errorf("%v != %v", got, float64(healthcheck.Unhealthy))
+	}
+
+	admin.Close()
+	server.Stop()
+}
+
+func TestBlueGreen(t *testing.T) {
+	blue, bl := startTestUpstream(t)
+	defer bl.Close()
+	green, gl := startResettingUpstream(t)
+	defer gl.Close()
+	blue.Group, green.Group = "blue", "green"
+	pki := newTestPKI(t)
+	server := startTestServer(t, pki, []*u.Upstream{blue, green}, nil, func(cfg *config.ServerCfg) {
+		cfg.RateLimiterCfg.RatePerSecond = 100
+		cfg.RateLimiterCfg.Burst = 100
+		cfg.SplitCfg = config.SplitCfg{ActiveGroup: "blue"}
+	})
+	addr := server.listener.Addr().String()
+	admin := httptest.NewServer(server.adminHandler())
+
+	tests := []struct {
+		description string
+		split       string
+		wantStatus  int
+		// whether connections reach the blue upstream, the only one that replies
+		wantBlue bool
+	}{
+		{description: "switch to green", split: `{"ActiveGroup": "green"}`, wantStatus: http.StatusOK, wantBlue: false},
+		{description: "switch back to blue", split: `{"ActiveGroup": "blue"}`, wantStatus: http.StatusOK, wantBlue: true},
+		{description: "bad percent", split: `{"ActiveGroup": "green", "CanaryPercent": 101}`, wantStatus: http.StatusBadRequest, wantBlue: true},
+		{description: "bad body", split: `{`, wantStatus: http.StatusBadRequest, wantBlue: true},
+	}
+	for _, tc := range tests {
+		req := adminRequest(http.MethodPut, admin.URL+"/split", strings.NewReader(tc.split))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.wantStatus {
+			t.Errorf("%s, %v != %v", tc.description, res.StatusCode, tc.wantStatus)
+		}
+		for i := 0; i < 3; i++ {
+			reply, err := roundTrip(addr, pki.clientTlsConfig(t, "client.a"))
+			if got := err == nil && reply == "reply: hello"; got != tc.wantBlue {
+				t.Errorf("%s, connection %d, %q, %v", tc.description, i, reply, err)
+			}
+		}
+	}
+
+	res, err := http.DefaultClient.Do(adminRequest(http.MethodGet, admin.URL+"/split", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var split config.SplitCfg
+	if err := json.NewDecoder(res.Body).Decode(&split); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if split.ActiveGroup != "blue" {
+		t.Errorf("%v != %v", split.ActiveGroup, "blue")
+	}
+
+	admin.Close()
+	if err := waitReleased(server); err != nil {
+		t.Error(err)
+	}
+	server.Stop()
+}
+
+// startShadowUpstream starts an upstream that replies to everything and hands what it received on each connection to got.
+func startShadowUpstream(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	got := make(chan string, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write([]byte("shadow reply"))
+				data, _ := ioutil.ReadAll(c)
+				got <- string(data)
+			}()
+		}
+	}()
+	return l.Addr().String(), got
+}
+
+func TestMirror(t *testing.T) {
+	shadow, mirrored := startShadowUpstream(t)
+	down, dl := startTestUpstream(t)
+	dl.Close()
+
+	tests := []struct {
+		description string
+		shadow      string
+		wantFailure string
+	}{
+		{description: "mirrored to the shadow", shadow: shadow},
+		{description: "shadow down", shadow: down.Host + ":" + down.Port, wantFailure: "dial"},
+	}
+	for _, tc := range tests {
+		upstream, l := startTestUpstream(t)
+		pki := newTestPKI(t)
+		server := startTestServer(t, pki, []*u.Upstream{upstream}, nil, func(cfg *config.ServerCfg) {
+			cfg.MirrorCfg = config.MirrorCfg{MirrorAddr: tc.shadow, MirrorPercent: 100}
+		})
+		failures := 0.0
+		if tc.wantFailure != "" {
+			failures = mirrorFailuresTotal.Value(tc.wantFailure)
+		}
+
+		// the client only ever sees the primary upstream
+		if reply, err := roundTrip(server.listener.Addr().String(), pki.clientTlsConfig(t, "client.a")); err != nil || reply != "reply: hello" {
+			t.Errorf("%s, %q, %v", tc.description, reply, err)
+		}
+
+		if tc.wantFailure == "" {
+			select {
+			case got := <-mirrored:
+				if got != "hello" {
+					t.Errorf("%s, %q != %q", tc.description, got, "hello")
+				}
+			case <-time.After(3 * time.Second):
+				t.Errorf("%s, nothing mirrored", tc.description)
+			}
+		} else {
+			deadline := time.Now().Add(3 * time.Second)
+			for mirrorFailuresTotal.Value(tc.wantFailure) == failures && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if got := mirrorFailuresTotal.Value(tc.wantFailure); got != failures+1 {
+				t.Errorf("%s, %v != %v", tc.description, got, failures+1)
+			}
+		}
+
+		if err := waitReleased(server); err != nil {
+			t.Errorf("%s, %v", tc.description, err)
+		}
+		server.Stop()
+		l.Close()
+	}
+}
+
+func TestMirrorNeverBlocks(t *testing.T) {
+	// a mirror whose shadow never takes anything
+	m := &mirror{queue: make(chan []byte, 1), done: make(chan struct{})}
+	failures := mirrorFailuresTotal.Value("overflow")
+
+	finished := make(chan bool)
+	go func() {
+		for i := 0; i < 3; i++ {
+			if n, err := m.Write([]byte("hello")); n != 5 || err != nil {
+				t.Errorf("write %d, %v, %v", i, n, err)
+			}
+		}
+		m.Close()
+		finished <- true
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("writes to the mirror blocked")
+	}
+	if !m.failed {
+		t.Errorf("mirror not dropped once full")
+	}
+	if got := mirrorFailuresTotal.Value("overflow"); got != failures+1 {
+		t.Errorf("%v != %v", got, failures+1)
+	}
+}
+
+func TestDynamicUpstreams(t *testing.T) {
+	first, fl := startTestUpstream(t)
+	defer fl.Close()
+	second, sl := startTestUpstream(t)
+	defer sl.Close()
+	pki := newTestPKI(t)
+	server := startTestServer(t, pki, []*u.Upstream{first}, nil, func(cfg *config.ServerCfg) {
+		cfg.HealthCheckInterval = 10 * time.Millisecond
+		cfg.RateLimiterCfg.RatePerSecond = 100
+		cfg.RateLimiterCfg.Burst = 100
+	})
+	addr := server.listener.Addr().String()
+	admin := httptest.NewServer(server.adminHandler())
+	firstAddr := first.Host + ":" + first.Port
+	body := `{"Host": "` + second.Host + `", "Port": "` + second.Port + `"}`
+
+	tests := []struct {
+		description string
+		method      string
+		path        string
+		body        string
+		wantStatus  int
+	}{
+		{description: "add", method: http.MethodPost, path: "/upstreams", body: body, wantStatus: http.StatusCreated},
+		{description: "add again", method: http.MethodPost, path: "/upstreams", body: body, wantStatus: http.StatusConflict},
+		{description: "no address", method: http.MethodPost, path: "/upstreams", body: `{}`, wantStatus: http.StatusBadRequest},
+		{description: "unknown", method: http.MethodDelete, path: "/upstreams?addr=127.0.0.1:1", wantStatus: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		req := adminRequest(tc.method, admin.URL+tc.path, strings.NewReader(tc.body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.wantStatus {
+			t.Errorf("%s, %v != %v", tc.description, res.StatusCode, tc.wantStatus)
+		}
+	}
+
+	// the added upstream takes connections once its health checks pass
+	var upstreams []upstreamView
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		res, err := http.DefaultClient.Do(adminRequest(http.MethodGet, admin.URL+"/upstreams", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstreams = nil
+		json.NewDecoder(res.Body).Decode(&upstreams)
+		res.Body.Close()
+		if len(upstreams) == 2 && upstreams[1].Alive {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(upstreams) != 2 || upstreams[1].Port != second.Port || !upstreams[1].Alive {
+		t.Fatalf("%+v", upstreams)
+	}
+
+	req := adminRequest(http.MethodDelete, admin.URL+"/upstreams?drain=true&addr="+firstAddr, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("%v != %v", res.StatusCode, http.StatusNoContent)
+	}
+	// only the added upstream is left to reply
+	fl.Close()
+	for i := 0; i < 3; i++ {
+		if reply, err := roundTrip(addr, pki.clientTlsConfig(t, "client.a")); err != nil || reply != "reply: hello" {
+			t.Errorf("connection %d, %q, %v", i, reply, err)
+		}
+	}
+	if _, found := server.Upstreams().Get(firstAddr); found {
+		t.Errorf("drained upstream %v not removed", firstAddr)
+	}
+
+	admin.Close()
+	if err := waitReleased(server); err != nil {
+		t.Error(err)
+	}
+	server.Stop()
+}
+
+func TestDrain(t *testing.T) {
+	first, fl := startTestUpstream(t)
+	defer fl.Close()
+	second, sl := startTestUpstream(t)
+	defer sl.Close()
+	pki := newTestPKI(t)
+	server := startTestServer(t, pki, []*u.Upstream{first, second}, nil, func(cfg *config.ServerCfg) {
+		cfg.RateLimiterCfg.RatePerSecond = 100
+		cfg.RateLimiterCfg.Burst = 100
+	})
+	addr := server.listener.Addr().String()
+	admin := httptest.NewServer(server.adminHandler())
+
+	drain := func(method, upstreamAddr string) (upstreamView, int) {
+		req := adminRequest(method, admin.URL+"/upstreams/drain?addr="+upstreamAddr, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var view upstreamView
+		json.NewDecoder(res.Body).Decode(&view)
+		return view, res.StatusCode
+	}
+
+	// an open connection keeps the upstream it went to busy while it drains
+	c, _, err := open(addr, pki.clientTlsConfig(t, "client.a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy, idle := first, second
+	if second.ActiveConns() == 1 {
+		busy, idle = second, first
+	}
+	busyAddr := busy.Host + ":" + busy.Port
+
+	if view, status := drain(http.MethodPut, busyAddr); status != http.StatusOK || !view.Draining || view.ActiveConns != 1 {
+		t.Errorf("%v, %+v", status, view)
+	}
+	for i := 0; i < 3; i++ {
+		if reply, err := roundTrip(addr, pki.clientTlsConfig(t, "client.a")); err != nil || reply != "reply: hello" {
+			t.Errorf("connection %d, %q, %v", i, reply, err)
+		}
+	}
+	if busy.ActiveConns() != 1 {
+		t.Errorf("new connections sent to draining upstream, %v != %v", busy.ActiveConns(), 1)
+	}
+
+	c.Close()
+	// reported once its last connection ends
+	deadline := time.Now().Add(3 * time.Second)
+	for drainState.Value(busyAddr) != drainStateDrained && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := drainState.Value(busyAddr); got != drainStateDrained {
+		t.Errorf("%v != %v", got, drainStateDrained)
+	}
+	if view, status := drain(http.MethodGet, busyAddr); status != http.StatusOK || !view.Draining || view.ActiveConns != 0 {
+		t.Errorf("%v, %+v", status, view)
+	}
+
+	if view, status := drain(http.MethodDelete, busyAddr); status != http.StatusOK || view.Draining {
+		t.Errorf("%v, %+v", status, view)
+	}
+	// the resumed upstream takes its share of connections again
+	c, _, err = open(addr, pki.clientTlsConfig(t, "client.a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, _, err := open(addr, pki.clientTlsConfig(t, "client.a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if busy.ActiveConns()+idle.ActiveConns() != 2 || busy.ActiveConns() == 0 {
+		t.Errorf("resumed upstream takes no connections, %v, %v", busy.ActiveConns(), idle.ActiveConns())
+	}
+	c.Close()
+	c2.Close()
+	if _, status := drain(http.MethodPut, "127.0.0.1:1"); status != http.StatusNotFound {
+		t.Errorf("%v != %v", status, http.StatusNotFound)
+	}
+
+	admin.Close()
+	if err := waitReleased(server); err != nil {
+		t.Error(err)
+	}
+	server.Stop()
+}
+
+// drainingBalancer drains the upstream at addr as soon as it is selected, before the connection to it is counted.
+type drainingBalancer struct {
+	balancer balance.LoadBalancer
+	registry *u.Registry
+	addr     string
+}
+
+func (b *drainingBalancer) Select(clientId string, upstreams []*u.Upstream) (*u.Upstream, error) {
+	upstream, err := b.balancer.Select(clientId, upstreams)
+	if err == nil && upstream.Host+":"+upstream.Port == b.addr {
+		b.registry.StartDraining(b.addr)
+	}
+	return upstream, err
+}
+
+func TestDrainReleasesTrial(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.BreakerCfg = config.BreakerCfg{ConsecutiveFailures: 1, HalfOpenTrials: 1, HalfOpenSuccesses: 1}
+	first := &u.Upstream{Host: "127.0.0.1", Port: "8000", IsAlive: true}
+	second := &u.Upstream{Host: "127.0.0.1", Port: "8001", IsAlive: true}
+	cfg.Upstreams = []*u.Upstream{first, second}
+	server, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the circuit of the first upstream opens, and half opens at once
+	circuit := server.breakers.Get("127.0.0.1:8000")
+	circuit.Done(false)
+	if got := circuit.State(); got != breaker.HalfOpen {
+		t.Fatalf("%v != %v", got, breaker.HalfOpen)
+	}
+	server.balancer = &drainingBalancer{balancer: server.balancer, registry: server.registry, addr: "127.0.0.1:8000"}
+
+	got, err := server.acquireUpstream(&selectUpstreamReq{clientId: "client.a", upstreams: []*u.Upstream{first, second}})
+	if err != nil || got != second {
+		t.Fatalf("%v, %v != %v", err, got, second)
+	}
+	// the only trial slot of the drained upstream was given back
+	if !circuit.Acquire() {
+		t.Errorf("trial slot leaked")
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	tests := []struct {
+		description   string
+		token         string
+		method        string
+		authorization string
+		want          int
+	}{
+		{description: "reading needs the token", token: testAdminToken, method: http.MethodGet, want: http.StatusUnauthorized},
+		{description: "reading with the token", token: testAdminToken, method: http.MethodGet, authorization: "Bearer " + testAdminToken, want: http.StatusOK},
+		{description: "changing needs the token", token: testAdminToken, method: http.MethodDelete, want: http.StatusUnauthorized},
+		{description: "wrong token", token: testAdminToken, method: http.MethodDelete, authorization: "Bearer other", want: http.StatusUnauthorized},
+		{description: "token without bearer", token: testAdminToken, method: http.MethodDelete, authorization: testAdminToken, want: http.StatusUnauthorized},
+		{description: "right token", token: testAdminToken, method: http.MethodDelete, authorization: "Bearer " + testAdminToken, want: http.StatusNoContent},
+		{description: "no token configured", token: "", method: http.MethodDelete, authorization: "Bearer ", want: http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		cfg := createTestConfig()
+		cfg.AdminCfg.Token = tc.token
+		server, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		admin := httptest.NewServer(server.adminHandler())
+		req, _ := http.NewRequest(tc.method, admin.URL+"/bans", nil)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		admin.Close()
+		if res.StatusCode != tc.want {
+			t.Errorf("%s, %v != %v", tc.description, res.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestAdminTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	adminPKI := newTestPKI(t)
+	cfg := createTestConfig()
+	cfg.TlsCfg = pki.tlsCfg()
+	cfg.AdminCfg.CaPath = adminPKI.dir + "/ca.crt"
+	cfg.AdminCfg.ClientNames = []string{"ops"}
+	server, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := httptest.NewUnstartedServer(server.adminHandler())
+	admin.TLS = server.adminTlsConfig
+	admin.StartTLS()
+	defer admin.Close()
+
+	tests := []struct {
+		description string
+		pki         *testPKI
+		clientId    string
+		wantErr     bool
+	}{
+		{description: "admin client", pki: adminPKI, clientId: "ops", wantErr: false},
+		{description: "client of the load balancer", pki: pki, clientId: "ops", wantErr: true},
+		{description: "admin CA, other name", pki: adminPKI, clientId: "dev", wantErr: true},
+	}
+	for _, tc := range tests {
+		tlsConfig := pki.clientTlsConfig(t, tc.clientId)
+		tlsConfig.Certificates = []tls.Certificate{tc.pki.issue(t, tc.clientId)}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		res, err := client.Do(adminRequest(http.MethodGet, admin.URL+"/bans", nil))
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				err = fmt.Errorf("status %d", res.StatusCode)
+			}
+		}
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s, %v", tc.description, err)
+		}
+	}
+}